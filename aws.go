@@ -0,0 +1,1025 @@
+package spt
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+)
+
+func fetchAWSMetadata(ctx context.Context) (string, bool) {
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+	}
+
+	tokenUrl := "http://169.254.169.254/latest/api/token"
+	req, err := http.NewRequestWithContext(ctx, "PUT", tokenUrl, nil)
+	if err != nil {
+		return "", false
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", false
+	}
+
+	tokenBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", false
+	}
+	token := string(tokenBody)
+
+	instanceUrl := "http://169.254.169.254/latest/meta-data/instance-id"
+	req, err = http.NewRequestWithContext(ctx, "GET", instanceUrl, nil)
+	if err != nil {
+		return "", false
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+
+	resp, err = client.Do(req)
+	if err != nil {
+		return "", false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", false
+	}
+
+	instanceBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", false
+	}
+
+	return string(instanceBody), true
+}
+
+// ttlScript returns a user-data fragment that powers the machine off once
+// ttl has elapsed since boot.
+func ttlScript(ttl time.Duration) string {
+	return fmt.Sprintf(`
+# Power off when the time-to-live expires
+systemd-run --unit=spt-ttl --on-active=%ds /bin/systemctl poweroff
+`, int(ttl.Seconds()))
+}
+
+// armTTL returns script with the time-to-live watchdog inserted right after
+// the interpreter line, so that it is armed before the slower setup steps
+// run and still fires when one of them hangs.
+func armTTL(script, watchdog string) string {
+	shebang, rest, _ := strings.Cut(script, "\n")
+	return shebang + watchdog + rest
+}
+
+// EC2API is the part of the EC2 API spt uses. *ec2.Client implements it.
+type EC2API interface {
+	CreateLaunchTemplate(ctx context.Context, params *ec2.CreateLaunchTemplateInput, optFns ...func(*ec2.Options)) (*ec2.CreateLaunchTemplateOutput, error)
+	DeleteLaunchTemplate(ctx context.Context, params *ec2.DeleteLaunchTemplateInput, optFns ...func(*ec2.Options)) (*ec2.DeleteLaunchTemplateOutput, error)
+	CreateFleet(ctx context.Context, params *ec2.CreateFleetInput, optFns ...func(*ec2.Options)) (*ec2.CreateFleetOutput, error)
+	DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+	TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error)
+	CancelSpotInstanceRequests(ctx context.Context, params *ec2.CancelSpotInstanceRequestsInput, optFns ...func(*ec2.Options)) (*ec2.CancelSpotInstanceRequestsOutput, error)
+	DescribeSpotPriceHistory(ctx context.Context, params *ec2.DescribeSpotPriceHistoryInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSpotPriceHistoryOutput, error)
+}
+
+var _ EC2API = (*ec2.Client)(nil)
+
+// AWS EC2 provider
+type awsProvider struct {
+	client EC2API
+	config Config
+	// opts are kept for the providers of fallback configurations.
+	opts []AWSOption
+}
+
+// AWSOption customizes the AWS provider.
+type AWSOption func(*awsProvider)
+
+// WithEC2Client makes the AWS provider use client instead of an EC2 client
+// created from the configuration.
+func WithEC2Client(client EC2API) AWSOption {
+	return func(p *awsProvider) {
+		p.client = client
+	}
+}
+
+func NewAWSProvider(cfg Config, opts ...AWSOption) (Provider, error) {
+	p := &awsProvider{config: cfg, opts: opts}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.client != nil {
+		return p, nil
+	}
+
+	accessKey := cfg.Service.AWS.AccessKey
+	secretKey := cfg.Service.AWS.SecretKey
+	region := cfg.Service.AWS.Region
+
+	awsCfg, err := config.LoadDefaultConfig(context.Background(),
+		config.WithRegion(region),
+		config.WithCredentialsProvider(aws.CredentialsProviderFunc(
+			func(ctx context.Context) (aws.Credentials, error) {
+				return aws.Credentials{
+					AccessKeyID:     accessKey,
+					SecretAccessKey: secretKey,
+				}, nil
+			},
+		)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	p.client = ec2.NewFromConfig(awsCfg, func(o *ec2.Options) {
+		if endpoint := cfg.Service.AWS.Endpoint; endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	return p, nil
+}
+
+func (p *awsProvider) Name() string {
+	return "aws"
+}
+
+func (p *awsProvider) withConfig(cfg Config) (Provider, error) {
+	return NewAWSProvider(cfg, p.opts...)
+}
+
+func (p *awsProvider) Provision(ctx context.Context) (Device, error) {
+	if p.autoLocation() {
+		price, err := cheapestPrice(ctx, p, p.config.Service.AWS.SpotPriceMax)
+		if err != nil {
+			return nil, err
+		}
+
+		Log("Cheapest location is %s with %s at $%.4f/h", price.Location, price.InstanceType, price.Price)
+		resolved := *p
+		resolved.config.Service.AWS.AvailabilityZones = []string{price.Location}
+		resolved.config.Service.AWS.InstanceType = price.InstanceType
+		resolved.config.Service.AWS.InstanceTypes = nil
+		return resolved.Provision(ctx)
+	}
+
+	config := p.config
+
+	message := fmt.Sprintf("Provisioning AWS spot instance in %s", config.Service.AWS.Region)
+	if config.Service.AWS.OnDemand {
+		message = fmt.Sprintf("Provisioning AWS on-demand instance in %s", config.Service.AWS.Region)
+	}
+	emit(Event{
+		Type:         EventProvisionRequested,
+		Provider:     p.Name(),
+		Location:     config.Service.AWS.Region,
+		InstanceType: strings.Join(p.instanceTypes(), ","),
+		Message:      message,
+	})
+
+	hostKey, err := newHostKey()
+	if err != nil {
+		return nil, err
+	}
+
+	loginKey, err := newDeviceKey()
+	if err != nil {
+		return nil, err
+	}
+
+	completeScript := loginKey.authorize(hostKey.install(userScript))
+	var instanceProfile *types.IamInstanceProfileSpecification
+	if profile := config.Service.AWS.IAMInstanceProfile; profile != "" {
+		// The instance terminates itself with the profile's role
+		// credentials, fetched from IMDS by `spt self --delete`.
+		instanceProfile = &types.IamInstanceProfileSpecification{Name: aws.String(profile)}
+		if strings.HasPrefix(profile, "arn:") {
+			instanceProfile = &types.IamInstanceProfileSpecification{Arn: aws.String(profile)}
+		}
+	} else if config.Service.AWS.EmbedAccessKeys {
+		Log("Warning: no iam_instance_profile configured, embedding access keys in user-data for self-termination")
+		completeScript += `
+# AWS credentials for self-termination
+cat > ` + awsCredentialsFile + ` << 'EOL'
+{
+  "region": "` + config.Service.AWS.Region + `",
+  "access_key": "` + config.Service.AWS.AccessKey + `",
+  "secret_key": "` + config.Service.AWS.SecretKey + `"
+}
+EOL
+chmod 600 ` + awsCredentialsFile + `
+`
+	} else {
+		Log("Warning: no iam_instance_profile configured, `spt self --delete` will not work on the instance")
+	}
+
+	completeScript += readyScript
+	if ttl := config.Run.MaxDuration; ttl > 0 {
+		completeScript = armTTL(completeScript, ttlScript(ttl))
+		Log("Instance will be terminated after %s", ttl)
+	}
+	userData := base64.StdEncoding.EncodeToString([]byte(completeScript))
+
+	tags := newTags(config)
+	instanceId, err := p.launchFleet(ctx, userData, instanceProfile, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	emit(Event{
+		Type:     EventSpotRequestCreated,
+		Provider: p.Name(),
+		DeviceID: instanceId,
+		Message:  fmt.Sprintf("Instance %s created, waiting for it to be ready", instanceId),
+	})
+
+	return finishProvisioning(ctx, instanceId,
+		func(ctx context.Context) (Device, error) { return p.waitRunning(ctx, instanceId, tags) },
+		func(ctx context.Context) error { return terminateAWSInstance(ctx, p.client, instanceId) },
+		hostKey, loginKey, config)
+}
+
+// waitRunning waits until the new instance is running with a public IP
+// address.
+func (p *awsProvider) waitRunning(ctx context.Context, instanceId string, tags Tags) (Device, error) {
+	instanceInput := &ec2.DescribeInstancesInput{
+		InstanceIds: []string{instanceId},
+	}
+
+	for {
+		instanceResult, err := p.client.DescribeInstances(ctx, instanceInput)
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidInstanceID.NotFound" {
+			// The new instance is not visible to Describe calls yet.
+			if err := sleep(ctx, runningPollInterval); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(instanceResult.Reservations) == 0 || len(instanceResult.Reservations[0].Instances) == 0 {
+			return nil, fmt.Errorf("instance not found")
+		}
+
+		instance := instanceResult.Reservations[0].Instances[0]
+
+		if instance.State.Name == types.InstanceStateNameRunning {
+			if instance.PublicIpAddress == nil {
+				// The address is assigned before the instance runs, it
+				// never gets one later.
+				return nil, fmt.Errorf("instance %s is running without a public IP address, check that its subnet assigns one", instanceId)
+			}
+			emit(Event{
+				Type:         EventInstanceRunning,
+				Provider:     p.Name(),
+				DeviceID:     instanceId,
+				IP:           aws.ToString(instance.PublicIpAddress),
+				Location:     ec2Zone(instance),
+				InstanceType: string(instance.InstanceType),
+				Message:      fmt.Sprintf("Instance is running at IP %s", aws.ToString(instance.PublicIpAddress)),
+			})
+
+			awsInstance := p.newInstance(instance)
+			awsInstance.tags = tags
+			return awsInstance, nil
+		}
+
+		if instance.State.Name == types.InstanceStateNameTerminated {
+			var code, reason string
+			if instance.StateReason != nil {
+				code, reason = aws.ToString(instance.StateReason.Code), aws.ToString(instance.StateReason.Message)
+			}
+			if strings.HasPrefix(code, "Server.SpotInstance") || code == "Server.InsufficientInstanceCapacity" {
+				return nil, fmt.Errorf("%w: instance was reclaimed while starting (%s)", ErrNoCapacity, reason)
+			}
+			return nil, fmt.Errorf("instance was terminated (%s)", reason)
+		}
+
+		if err := sleep(ctx, runningPollInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// awsFallbacks returns the fallback candidates for cfg: each fallback
+// instance type, then the same in every fallback region, then on-demand
+// capacity when enabled.
+func awsFallbacks(cfg Config) []Fallback {
+	primary := cfg.Service.AWS
+
+	regions := []Config{cfg}
+	for _, r := range primary.FallbackRegions {
+		c := cfg
+		c.Service.AWS.Region = r.Region
+		c.Service.AWS.AMI = r.AMI
+		c.Service.AWS.SecurityGroup = r.SecurityGroup
+		c.Service.AWS.Subnets = r.Subnets
+		c.Service.AWS.AvailabilityZones = nil
+		regions = append(regions, c)
+	}
+
+	var fallbacks []Fallback
+	for i, c := range regions {
+		region := c.Service.AWS.Region
+		if i > 0 {
+			fallbacks = append(fallbacks, Fallback{
+				Description: fmt.Sprintf("%s in %s", strings.Join((&awsProvider{config: c}).instanceTypes(), ", "), region),
+				Config:      c,
+			})
+		}
+
+		for _, instanceType := range primary.Fallback {
+			c := c
+			c.Service.AWS.InstanceType = instanceType
+			c.Service.AWS.InstanceTypes = nil
+			fallbacks = append(fallbacks, Fallback{
+				Description: fmt.Sprintf("%s in %s", instanceType, region),
+				Config:      c,
+			})
+		}
+	}
+
+	if primary.OnDemandFallback && !primary.OnDemand {
+		for _, c := range regions {
+			c.Service.AWS.OnDemand = true
+			fallbacks = append(fallbacks, Fallback{
+				Description: fmt.Sprintf("on-demand capacity in %s", c.Service.AWS.Region),
+				Config:      c,
+			})
+		}
+	}
+
+	return fallbacks
+}
+
+// autoLocation reports whether the availability zone is picked by price.
+// It has no effect when subnets are configured.
+func (p *awsProvider) autoLocation() bool {
+	zones := p.config.Service.AWS.AvailabilityZones
+	return len(zones) == 1 && zones[0] == AutoLocation && len(p.config.Service.AWS.Subnets) == 0
+}
+
+// Prices returns the latest Linux spot price of every configured instance
+// type in each availability zone of the region.
+func (p *awsProvider) Prices(ctx context.Context) ([]Price, error) {
+	var instanceTypes []types.InstanceType
+	for _, instanceType := range p.instanceTypes() {
+		instanceTypes = append(instanceTypes, types.InstanceType(instanceType))
+	}
+
+	input := &ec2.DescribeSpotPriceHistoryInput{
+		InstanceTypes:       instanceTypes,
+		ProductDescriptions: []string{"Linux/UNIX"},
+		StartTime:           aws.Time(time.Now()),
+	}
+
+	latest := make(map[string]types.SpotPrice)
+	paginator := ec2.NewDescribeSpotPriceHistoryPaginator(p.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, sp := range page.SpotPriceHistory {
+			key := aws.ToString(sp.AvailabilityZone) + "/" + string(sp.InstanceType)
+			if old, ok := latest[key]; !ok || aws.ToTime(sp.Timestamp).After(aws.ToTime(old.Timestamp)) {
+				latest[key] = sp
+			}
+		}
+	}
+
+	var prices []Price
+	for _, sp := range latest {
+		price, err := strconv.ParseFloat(aws.ToString(sp.SpotPrice), 64)
+		if err != nil {
+			continue
+		}
+		prices = append(prices, Price{
+			Location:     aws.ToString(sp.AvailabilityZone),
+			InstanceType: string(sp.InstanceType),
+			Price:        price,
+		})
+	}
+
+	return prices, nil
+}
+
+// DefaultAllocationStrategy is the spot allocation strategy used when
+// `allocation_strategy` is not set.
+const DefaultAllocationStrategy = types.SpotAllocationStrategyPriceCapacityOptimized
+
+// instanceTypes returns the configured candidate instance types.
+func (p *awsProvider) instanceTypes() []string {
+	candidates := p.config.Service.AWS.InstanceTypes
+	if it := p.config.Service.AWS.InstanceType; it != "" {
+		candidates = append([]string{it}, candidates...)
+	}
+	return candidates
+}
+
+// launchFleet launches a single spot instance with an instant EC2 Fleet,
+// letting the allocation strategy pick among every configured instance type
+// and subnet or availability zone, and returns the instance ID.
+func (p *awsProvider) launchFleet(ctx context.Context, userData string, instanceProfile *types.IamInstanceProfileSpecification, tags Tags) (string, error) {
+	config := p.config.Service.AWS
+
+	volumeSize := 8
+	if config.VolumeSize > 0 {
+		volumeSize = config.VolumeSize
+	}
+
+	templateData := &types.RequestLaunchTemplateData{
+		ImageId:  aws.String(config.AMI),
+		UserData: aws.String(userData),
+		SecurityGroupIds: []string{
+			config.SecurityGroup,
+		},
+		BlockDeviceMappings: []types.LaunchTemplateBlockDeviceMappingRequest{
+			{
+				DeviceName: aws.String("/dev/sda1"),
+				Ebs: &types.LaunchTemplateEbsBlockDeviceRequest{
+					VolumeSize: aws.Int32(int32(volumeSize)),
+					VolumeType: types.VolumeTypeGp2,
+				},
+			},
+		},
+		// Shutting down from inside the instance, e.g. by the TTL
+		// watchdog, terminates it.
+		InstanceInitiatedShutdownBehavior: types.ShutdownBehaviorTerminate,
+		TagSpecifications: []types.LaunchTemplateTagSpecificationRequest{
+			{ResourceType: types.ResourceTypeInstance, Tags: ec2Tags(tags)},
+			{ResourceType: types.ResourceTypeVolume, Tags: ec2Tags(tags)},
+		},
+	}
+	if config.KeyName != "" {
+		templateData.KeyName = aws.String(config.KeyName)
+	}
+	if instanceProfile != nil {
+		templateData.IamInstanceProfile = &types.LaunchTemplateIamInstanceProfileSpecificationRequest{
+			Arn:  instanceProfile.Arn,
+			Name: instanceProfile.Name,
+		}
+	}
+
+	template, err := p.client.CreateLaunchTemplate(ctx, &ec2.CreateLaunchTemplateInput{
+		LaunchTemplateName: aws.String(fmt.Sprintf("spt-%s-%d", tags.Project, time.Now().UnixNano())),
+		LaunchTemplateData: templateData,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	templateId := template.LaunchTemplate.LaunchTemplateId
+	defer func() {
+		_, err := p.client.DeleteLaunchTemplate(context.WithoutCancel(ctx), &ec2.DeleteLaunchTemplateInput{
+			LaunchTemplateId: templateId,
+		})
+		if err != nil {
+			Log("Error deleting launch template %s: %v", aws.ToString(templateId), err)
+		}
+	}()
+
+	var maxPrice *string
+	if config.SpotPriceMax != 0 && !config.OnDemand {
+		maxPrice = aws.String(fmt.Sprintf("%f", config.SpotPriceMax))
+	}
+
+	var overrides []types.FleetLaunchTemplateOverridesRequest
+	for _, instanceType := range p.instanceTypes() {
+		override := types.FleetLaunchTemplateOverridesRequest{
+			InstanceType: types.InstanceType(instanceType),
+			MaxPrice:     maxPrice,
+		}
+
+		switch {
+		case len(config.Subnets) > 0:
+			for _, subnet := range config.Subnets {
+				override.SubnetId = aws.String(subnet)
+				overrides = append(overrides, override)
+			}
+		case len(config.AvailabilityZones) > 0:
+			for _, zone := range config.AvailabilityZones {
+				override.AvailabilityZone = aws.String(zone)
+				overrides = append(overrides, override)
+			}
+		default:
+			overrides = append(overrides, override)
+		}
+	}
+
+	strategy := types.SpotAllocationStrategy(config.AllocationStrategy)
+	if strategy == "" {
+		strategy = DefaultAllocationStrategy
+	}
+
+	capacity := &types.TargetCapacitySpecificationRequest{
+		TotalTargetCapacity:       aws.Int32(1),
+		DefaultTargetCapacityType: types.DefaultTargetCapacityTypeSpot,
+	}
+	spotOptions := &types.SpotOptionsRequest{
+		AllocationStrategy: strategy,
+	}
+	if config.OnDemand {
+		capacity.DefaultTargetCapacityType = types.DefaultTargetCapacityTypeOnDemand
+		spotOptions = nil
+		Log("Requesting on-demand capacity for %v", p.instanceTypes())
+	} else {
+		Log("Requesting spot capacity for %v (%s)", p.instanceTypes(), strategy)
+	}
+
+	result, err := p.client.CreateFleet(ctx, &ec2.CreateFleetInput{
+		Type: types.FleetTypeInstant,
+		LaunchTemplateConfigs: []types.FleetLaunchTemplateConfigRequest{
+			{
+				LaunchTemplateSpecification: &types.FleetLaunchTemplateSpecificationRequest{
+					LaunchTemplateId: templateId,
+					Version:          aws.String("$Latest"),
+				},
+				Overrides: overrides,
+			},
+		},
+		TargetCapacitySpecification: capacity,
+		SpotOptions:                 spotOptions,
+		TagSpecifications: []types.TagSpecification{
+			{ResourceType: types.ResourceTypeFleet, Tags: ec2Tags(tags)},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, instance := range result.Instances {
+		if len(instance.InstanceIds) > 0 {
+			return instance.InstanceIds[0], nil
+		}
+	}
+
+	if len(result.Errors) == 0 {
+		return "", ErrNoCapacity
+	}
+
+	// The fleet reports an error for every pool it could not launch into.
+	// It is worth falling back only if none of them is a configuration
+	// error.
+	var errs []error
+	retriable, priceTooLow := true, false
+	for _, e := range result.Errors {
+		code := aws.ToString(e.ErrorCode)
+		errs = append(errs, fmt.Errorf("%s: %s", code, aws.ToString(e.ErrorMessage)))
+		switch {
+		case code == "SpotMaxPriceTooLow":
+			priceTooLow = true
+		case !awsCapacityErrors[code]:
+			retriable = false
+		}
+	}
+
+	err = errors.Join(errs...)
+	switch {
+	case !retriable:
+		return "", err
+	case priceTooLow:
+		return "", fmt.Errorf("%w: %w", ErrPriceTooLow, err)
+	default:
+		return "", fmt.Errorf("%w: %w", ErrNoCapacity, err)
+	}
+}
+
+// awsCapacityErrors are the fleet error codes that another instance type or
+// region might not run into.
+var awsCapacityErrors = map[string]bool{
+	"InsufficientInstanceCapacity": true,
+	"InsufficientCapacity":         true,
+	"InsufficientHostCapacity":     true,
+	"UnfulfillableCapacity":        true,
+	"MaxSpotInstanceCountExceeded": true,
+	"Unsupported":                  true,
+}
+
+func (p *awsProvider) Attach(ctx context.Context, instanceId string) (Device, error) {
+	input := &ec2.DescribeInstancesInput{
+		InstanceIds: []string{instanceId},
+	}
+
+	result, err := p.client.DescribeInstances(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Reservations) == 0 || len(result.Reservations[0].Instances) == 0 {
+		return nil, fmt.Errorf("AWS instance not found: %s", instanceId)
+	}
+
+	instance := result.Reservations[0].Instances[0]
+
+	if instance.State.Name != types.InstanceStateNameRunning {
+		return nil, fmt.Errorf("AWS instance %s is not running (state: %s)", instanceId, instance.State.Name)
+	}
+
+	if instance.PublicIpAddress == nil {
+		return nil, fmt.Errorf("AWS instance %s has no public IP address", instanceId)
+	}
+
+	Log("Attached to AWS instance %s at IP %s", instanceId, aws.ToString(instance.PublicIpAddress))
+	return p.newInstance(instance), nil
+}
+
+// List returns the instances tagged with the configured project. Instant
+// fleets leave no open spot requests behind, and the requests they create
+// are not tagged.
+func (p *awsProvider) List(ctx context.Context) ([]Device, error) {
+	input := &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("tag:" + tagProject), Values: []string{p.config.Project.Name}},
+			{Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "stopping", "stopped"}},
+		},
+	}
+
+	var devices []Device
+	paginator := ec2.NewDescribeInstancesPaginator(p.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				devices = append(devices, p.newInstance(instance))
+			}
+		}
+	}
+
+	return devices, nil
+}
+
+// Delete terminates the instance with the given ID, or cancels the spot
+// request when given an unfulfilled request ID.
+func (p *awsProvider) Delete(ctx context.Context, id string) error {
+	if strings.HasPrefix(id, "sir-") {
+		return cancelSpotRequest(ctx, p.client, id)
+	}
+
+	return terminateAWSInstance(ctx, p.client, id)
+}
+
+func (p *awsProvider) Self(ctx context.Context) (Device, error) {
+	instanceId, ok := fetchAWSMetadata(ctx)
+	if !ok {
+		return nil, nil
+	}
+
+	Log("Detected AWS EC2 instance: %s", instanceId)
+
+	// For self-device operations inside an EC2 instance, we don't need
+	// to initialize a full AWS client with credentials since we can use
+	// instance metadata service for self-operations
+
+	var ipAddr string
+
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+	}
+
+	// First get a token for IMDSv2
+	tokenUrl := "http://169.254.169.254/latest/api/token"
+	req, err := http.NewRequestWithContext(ctx, "PUT", tokenUrl, nil)
+	if err == nil {
+		req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+		resp, err := client.Do(req)
+		if err == nil && resp.StatusCode == 200 {
+			tokenBody, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if err == nil {
+				token := string(tokenBody)
+				// Get public IP
+				ipUrl := "http://169.254.169.254/latest/meta-data/public-ipv4"
+				req, err = http.NewRequestWithContext(ctx, "GET", ipUrl, nil)
+				if err == nil {
+					req.Header.Set("X-aws-ec2-metadata-token", token)
+					resp, err = client.Do(req)
+					if err == nil && resp.StatusCode == 200 {
+						ipBytes, err := ioutil.ReadAll(resp.Body)
+						resp.Body.Close()
+						if err == nil {
+							ipAddr = string(ipBytes)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return &AWSInstance{
+		instanceId: instanceId,
+		ipAddr:     ipAddr,
+	}, nil
+}
+
+// terminateAWSInstance terminates the instance and cancels the spot request
+// that launched it, if any.
+func terminateAWSInstance(ctx context.Context, client EC2API, instanceId string) error {
+	_, err := client.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
+		InstanceIds: []string{instanceId},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Get spot instance request ID
+	describeInput := &ec2.DescribeInstancesInput{
+		InstanceIds: []string{instanceId},
+	}
+	result, err := client.DescribeInstances(ctx, describeInput)
+	if err != nil {
+		return fmt.Errorf("error getting spot instance request ID: %w", err)
+	}
+
+	if len(result.Reservations) > 0 && len(result.Reservations[0].Instances) > 0 {
+		instance := result.Reservations[0].Instances[0]
+		if instance.SpotInstanceRequestId != nil {
+			return cancelSpotRequest(ctx, client, *instance.SpotInstanceRequestId)
+		}
+	}
+
+	return nil
+}
+
+func cancelSpotRequest(ctx context.Context, client EC2API, spotRequestId string) error {
+	Log("Canceling spot request %s", spotRequestId)
+
+	cancelInput := &ec2.CancelSpotInstanceRequestsInput{
+		SpotInstanceRequestIds: []string{spotRequestId},
+	}
+	_, err := client.CancelSpotInstanceRequests(ctx, cancelInput)
+	if err != nil {
+		return fmt.Errorf("error canceling spot instance request: %w", err)
+	}
+
+	Log("Spot request %s canceled", spotRequestId)
+	return nil
+}
+
+// newInstance returns the device for a described instance.
+func (p *awsProvider) newInstance(instance types.Instance) *AWSInstance {
+	var state string
+	if instance.State != nil {
+		state = string(instance.State.Name)
+	}
+
+	return &AWSInstance{
+		instanceId:    aws.ToString(instance.InstanceId),
+		spotRequestId: aws.ToString(instance.SpotInstanceRequestId),
+		tags:          parseEC2Tags(instance.Tags),
+		ipAddr:        aws.ToString(instance.PublicIpAddress),
+		zone:          ec2Zone(instance),
+		instanceType:  string(instance.InstanceType),
+		state:         state,
+		client:        p.client,
+		config:        p.config,
+	}
+}
+
+// ec2Zone returns the availability zone of instance.
+func ec2Zone(instance types.Instance) string {
+	if instance.Placement == nil {
+		return ""
+	}
+	return aws.ToString(instance.Placement.AvailabilityZone)
+}
+
+func ec2Tags(tags Tags) []types.Tag {
+	var ec2Tags []types.Tag
+	for k, v := range tags.Map() {
+		ec2Tags = append(ec2Tags, types.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	return ec2Tags
+}
+
+func parseEC2Tags(ec2Tags []types.Tag) Tags {
+	m := make(map[string]string)
+	for _, tag := range ec2Tags {
+		m[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	tags, _ := parseTags(m)
+	return tags
+}
+
+// awsCredentialsFile is where instances provisioned with embed_access_keys
+// keep the credentials used for self-termination.
+const awsCredentialsFile = "/opt/spt/aws-credentials.json"
+
+// selfEC2Client returns an EC2 client for use from inside an instance. It
+// prefers the legacy credentials file when present and otherwise uses the
+// instance profile's role credentials and region from IMDS.
+func selfEC2Client(ctx context.Context) (*ec2.Client, error) {
+	credsData, err := ioutil.ReadFile(awsCredentialsFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		Log("Using instance profile credentials")
+		awsCfg, err := config.LoadDefaultConfig(ctx, config.WithEC2IMDSRegion())
+		if err != nil {
+			return nil, fmt.Errorf("error creating AWS config: %w", err)
+		}
+		return ec2.NewFromConfig(awsCfg), nil
+	}
+	if err != nil {
+		Log("If running in Docker, make sure to mount /opt/spt from host")
+		return nil, fmt.Errorf("error reading AWS credentials: %w", err)
+	}
+
+	var creds struct {
+		Region    string `json:"region"`
+		AccessKey string `json:"access_key"`
+		SecretKey string `json:"secret_key"`
+	}
+
+	if err := json.Unmarshal(credsData, &creds); err != nil {
+		return nil, fmt.Errorf("error parsing AWS credentials: %w", err)
+	}
+
+	Log("Using stored credentials")
+	awsCfg, err := config.LoadDefaultConfig(ctx,
+		config.WithRegion(creds.Region),
+		config.WithCredentialsProvider(aws.CredentialsProviderFunc(
+			func(ctx context.Context) (aws.Credentials, error) {
+				return aws.Credentials{
+					AccessKeyID:     creds.AccessKey,
+					SecretAccessKey: creds.SecretKey,
+				}, nil
+			},
+		)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error creating AWS config: %w", err)
+	}
+
+	return ec2.NewFromConfig(awsCfg), nil
+}
+
+// AWS implementation
+type AWSInstance struct {
+	instanceId    string
+	spotRequestId string
+	tags          Tags
+	client        EC2API
+	config        Config
+	ipAddr        string
+	zone          string
+	instanceType  string
+	state         string
+}
+
+// ID returns the instance ID, or the spot request ID while the request has
+// not launched an instance.
+func (c *AWSInstance) ID() string {
+	if c.instanceId == "" {
+		return c.spotRequestId
+	}
+	return c.instanceId
+}
+
+func (c *AWSInstance) IP() string {
+	return c.ipAddr
+}
+
+// Location returns the region of the instance.
+func (c *AWSInstance) Location() string {
+	return c.config.Service.AWS.Region
+}
+
+func (c *AWSInstance) Tags() Tags {
+	return c.tags
+}
+
+// InstanceType returns the instance type, if known.
+func (c *AWSInstance) InstanceType() string {
+	return c.instanceType
+}
+
+// State returns the instance state, or the spot request state while the
+// request has not launched an instance.
+func (c *AWSInstance) State() string {
+	return c.state
+}
+
+// Price returns the current spot price of the instance's type in its
+// availability zone. On-demand instances report zero.
+func (c *AWSInstance) Price(ctx context.Context) (float64, error) {
+	if c.spotRequestId == "" || c.instanceType == "" || c.zone == "" {
+		return 0, nil
+	}
+
+	history, err := c.client.DescribeSpotPriceHistory(ctx, &ec2.DescribeSpotPriceHistoryInput{
+		InstanceTypes:       []types.InstanceType{types.InstanceType(c.instanceType)},
+		AvailabilityZone:    aws.String(c.zone),
+		ProductDescriptions: []string{"Linux/UNIX"},
+		StartTime:           aws.Time(time.Now()),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var latest types.SpotPrice
+	for _, sp := range history.SpotPriceHistory {
+		if aws.ToTime(sp.Timestamp).After(aws.ToTime(latest.Timestamp)) {
+			latest = sp
+		}
+	}
+	if latest.SpotPrice == nil {
+		return 0, nil
+	}
+	return strconv.ParseFloat(aws.ToString(latest.SpotPrice), 64)
+}
+
+// SpotRequestID returns the spot instance request that launched the
+// instance, if known.
+func (c *AWSInstance) SpotRequestID() string {
+	return c.spotRequestId
+}
+
+// spotInstanceActionScript prints the pending spot instance action from
+// IMDS. curl fails with exit status 22 while no action is scheduled.
+const spotInstanceActionScript = `TOKEN=$(curl -sf -X PUT http://169.254.169.254/latest/api/token -H "X-aws-ec2-metadata-token-ttl-seconds: 60") && curl -sf -H "X-aws-ec2-metadata-token: $TOKEN" http://169.254.169.254/latest/meta-data/spot/instance-action`
+
+// InterruptionNotice checks the instance's metadata for a spot
+// interruption notice.
+func (c *AWSInstance) InterruptionNotice(ctx context.Context, output func(cmd string) ([]byte, error)) (time.Time, bool, error) {
+	out, err := output(spotInstanceActionScript)
+	if status, ok := sshExitStatus(err); ok && status == 22 {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	var action struct {
+		Action string    `json:"action"`
+		Time   time.Time `json:"time"`
+	}
+	if err := json.Unmarshal(out, &action); err != nil {
+		return time.Time{}, false, err
+	}
+
+	return action.Time, true, nil
+}
+
+func (c *AWSInstance) Run(ctx context.Context, detach bool, args []string) (RunResult, error) {
+	return runAndDelete(ctx, "aws", c, c.config, detach, args)
+}
+
+func (c *AWSInstance) Delete(ctx context.Context) error {
+	Log("Terminating the AWS spot instance")
+
+	selfInstanceId, isSelf := fetchAWSMetadata(ctx)
+	if isSelf && selfInstanceId == c.instanceId {
+		Log("Self-terminating EC2 instance %s", c.instanceId)
+
+		ec2Client, err := selfEC2Client(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = ec2Client.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
+			InstanceIds: []string{c.instanceId},
+		})
+		if err != nil {
+			return fmt.Errorf("error terminating instance: %w", err)
+		}
+
+		Log("Instance termination initiated")
+		return nil
+	}
+
+	if c.client == nil {
+		return fmt.Errorf("AWS client not initialized for external termination")
+	}
+
+	if c.instanceId == "" {
+		return cancelSpotRequest(ctx, c.client, c.spotRequestId)
+	}
+
+	return terminateAWSInstance(ctx, c.client, c.instanceId)
+}
@@ -0,0 +1,169 @@
+package spt
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestArmTTL(t *testing.T) {
+	script := armTTL(userScript+readyScript, ttlScript(time.Hour))
+
+	if !strings.HasPrefix(script, "#!/bin/bash\n") {
+		t.Fatalf("script does not start with the interpreter line:\n%s", script)
+	}
+	watchdog := strings.Index(script, "systemd-run --unit=spt-ttl --on-active=3600s")
+	if watchdog < 0 {
+		t.Fatalf("script has no watchdog:\n%s", script)
+	}
+	if setup := strings.Index(script, "apt-get update"); watchdog > setup {
+		t.Errorf("watchdog is armed after the setup steps:\n%s", script)
+	}
+}
+
+// mockEC2 launches every fleet into fleetErrors, or else an instance that
+// is described as instance.
+type mockEC2 struct {
+	EC2API
+	fleetErrors []string
+	instance    types.Instance
+
+	fleets     int
+	terminated int
+}
+
+func (m *mockEC2) CreateLaunchTemplate(ctx context.Context, params *ec2.CreateLaunchTemplateInput, optFns ...func(*ec2.Options)) (*ec2.CreateLaunchTemplateOutput, error) {
+	return &ec2.CreateLaunchTemplateOutput{
+		LaunchTemplate: &types.LaunchTemplate{LaunchTemplateId: aws.String("lt-mock")},
+	}, nil
+}
+
+func (m *mockEC2) DeleteLaunchTemplate(ctx context.Context, params *ec2.DeleteLaunchTemplateInput, optFns ...func(*ec2.Options)) (*ec2.DeleteLaunchTemplateOutput, error) {
+	return &ec2.DeleteLaunchTemplateOutput{}, nil
+}
+
+func (m *mockEC2) CreateFleet(ctx context.Context, params *ec2.CreateFleetInput, optFns ...func(*ec2.Options)) (*ec2.CreateFleetOutput, error) {
+	m.fleets++
+	var output ec2.CreateFleetOutput
+	for _, code := range m.fleetErrors {
+		output.Errors = append(output.Errors, types.CreateFleetError{
+			ErrorCode:    aws.String(code),
+			ErrorMessage: aws.String(code + " from the mock"),
+		})
+	}
+	if len(output.Errors) == 0 {
+		output.Instances = []types.CreateFleetInstance{{InstanceIds: []string{"i-mock"}}}
+	}
+	return &output, nil
+}
+
+func (m *mockEC2) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	instance := m.instance
+	instance.InstanceId = aws.String("i-mock")
+	return &ec2.DescribeInstancesOutput{
+		Reservations: []types.Reservation{{Instances: []types.Instance{instance}}},
+	}, nil
+}
+
+func (m *mockEC2) TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error) {
+	m.terminated++
+	return &ec2.TerminateInstancesOutput{}, nil
+}
+
+func terminatedInstance(code string) types.Instance {
+	return types.Instance{
+		State:       &types.InstanceState{Name: types.InstanceStateNameTerminated},
+		StateReason: &types.StateReason{Code: aws.String(code), Message: aws.String(code + ": from the mock")},
+	}
+}
+
+func TestAWSProvision(t *testing.T) {
+	tests := []struct {
+		name           string
+		fleetErrors    []string
+		instance       types.Instance
+		wantErr        error
+		wantFleets     int
+		wantTerminated int
+	}{
+		{
+			name:        "no capacity",
+			fleetErrors: []string{"InsufficientInstanceCapacity"},
+			wantErr:     ErrNoCapacity,
+			wantFleets:  2,
+		},
+		{
+			name:        "spot price too low",
+			fleetErrors: []string{"SpotMaxPriceTooLow", "InsufficientInstanceCapacity"},
+			wantErr:     ErrPriceTooLow,
+			wantFleets:  2,
+		},
+		{
+			name:        "configuration error",
+			fleetErrors: []string{"InsufficientInstanceCapacity", "InvalidParameterValue"},
+			wantFleets:  1,
+		},
+		{
+			name:           "reclaimed before running",
+			instance:       terminatedInstance("Server.SpotInstanceTermination"),
+			wantErr:        ErrNoCapacity,
+			wantFleets:     2,
+			wantTerminated: 2,
+		},
+		{
+			name:           "terminated before running",
+			instance:       terminatedInstance("Server.InternalError"),
+			wantFleets:     1,
+			wantTerminated: 1,
+		},
+		{
+			name:           "missing public IP",
+			instance:       types.Instance{State: &types.InstanceState{Name: types.InstanceStateNameRunning}},
+			wantFleets:     1,
+			wantTerminated: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg Config
+			cfg.Project.Name = "spt-test"
+			cfg.Service.AWS.Region = "us-east-1"
+			cfg.Service.AWS.InstanceType = "c6i.metal"
+			cfg.Service.AWS.Fallback = []string{"c7i.metal-24xl"}
+
+			mock := &mockEC2{fleetErrors: tt.fleetErrors, instance: tt.instance}
+			provider, err := NewAWSProvider(cfg, WithEC2Client(mock))
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := NewClient(cfg, WithProvider(provider))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = client.Provision(context.Background())
+			if err == nil {
+				t.Fatal("Provision() succeeded, want an error")
+			}
+			for _, sentinel := range []error{ErrNoCapacity, ErrPriceTooLow} {
+				if got, want := errors.Is(err, sentinel), sentinel == tt.wantErr; got != want {
+					t.Errorf("Provision() = %v, errors.Is(err, %q) = %v, want %v", err, sentinel, got, want)
+				}
+			}
+			// Fallbacks use the injected client too.
+			if mock.fleets != tt.wantFleets {
+				t.Errorf("CreateFleet called %d times, want %d", mock.fleets, tt.wantFleets)
+			}
+			if mock.terminated != tt.wantTerminated {
+				t.Errorf("TerminateInstances called %d times, want %d", mock.terminated, tt.wantTerminated)
+			}
+		})
+	}
+}
@@ -0,0 +1,546 @@
+package spt
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+)
+
+// DefaultAzureImage is the URN of the boot image of Azure Spot VMs when
+// `image` is not set.
+const DefaultAzureImage = "Canonical:0001-com-ubuntu-server-jammy:22_04-lts-gen2:latest"
+
+// Azure provider
+type azureProvider struct {
+	client AzureAPI
+	config Config
+}
+
+// AzureOption customizes the Azure provider.
+type AzureOption func(*azureProvider)
+
+// WithAzureClient makes the provider call api instead of the Azure Resource
+// Manager API, e.g. a stub in tests.
+func WithAzureClient(api AzureAPI) AzureOption {
+	return func(p *azureProvider) {
+		p.client = api
+	}
+}
+
+func NewAzureProvider(cfg Config, opts ...AzureOption) (Provider, error) {
+	p := &azureProvider{config: cfg}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if p.client == nil {
+		azure := cfg.Service.Azure
+		cred, err := newAzureCredential(azure.TenantID, azure.ClientID, azure.ClientSecret)
+		if err != nil {
+			return nil, fmt.Errorf("Azure credentials: %w", err)
+		}
+		if p.client, err = newARMClient(azure.Endpoint, azure.SubscriptionID, cred); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+func (p *azureProvider) Name() string {
+	return "azure"
+}
+
+func (p *azureProvider) Provision(ctx context.Context) (Device, error) {
+	config := p.config
+	azure := config.Service.Azure
+	name := newDeviceName(config.Project.Name)
+
+	emit(Event{
+		Type:         EventProvisionRequested,
+		Provider:     p.Name(),
+		Location:     azure.Location,
+		InstanceType: azure.VMSize,
+		Message:      fmt.Sprintf("Provisioning Azure Spot VM in %s", azure.Location),
+	})
+
+	hostKey, err := newHostKey()
+	if err != nil {
+		return nil, err
+	}
+	loginKey, err := newDeviceKey()
+	if err != nil {
+		return nil, err
+	}
+
+	script := userScript + readyScript
+	if ttl := config.Run.MaxDuration; ttl > 0 {
+		if azure.Identity != "" {
+			script = armTTL(script, azureTTLScript(p.endpoint(), azure.SubscriptionID, azure.ResourceGroup, name, ttl))
+			Log("VM will be deleted after %s", ttl)
+		} else {
+			Log("Warning: no identity configured, the VM cannot delete itself after %s", ttl)
+		}
+	}
+	script = loginKey.authorize(hostKey.install(script))
+
+	vm, err := p.newVirtualMachine(name, script, loginKey, newTags(config))
+	if err != nil {
+		return nil, err
+	}
+	if err = p.client.CreateVirtualMachine(ctx, azure.ResourceGroup, name, *vm); err != nil {
+		if azureCapacityErrors[azureErrorCode(err)] {
+			return nil, fmt.Errorf("%w: %w", ErrNoCapacity, err)
+		}
+		return nil, err
+	}
+
+	emit(Event{
+		Type:     EventSpotRequestCreated,
+		Provider: p.Name(),
+		DeviceID: name,
+		Message:  fmt.Sprintf("VM %s requested, waiting for it to be ready", name),
+	})
+
+	return finishProvisioning(ctx, name,
+		func(ctx context.Context) (Device, error) { return p.waitRunning(ctx, name) },
+		func(ctx context.Context) error {
+			if err := p.Delete(ctx, name); err != nil && !isAzureNotFound(err) {
+				return err
+			}
+			return nil
+		},
+		hostKey, loginKey, config)
+}
+
+// waitRunning waits until the new VM is provisioned with a public IP
+// address.
+func (p *azureProvider) waitRunning(ctx context.Context, name string) (Device, error) {
+	resourceGroup := p.config.Service.Azure.ResourceGroup
+
+	for {
+		created, err := p.client.GetVirtualMachine(ctx, resourceGroup, name)
+		if isAzureNotFound(err) {
+			return nil, fmt.Errorf("%w: VM %s was evicted while starting", ErrNoCapacity, name)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var state string
+		if created.Properties != nil {
+			state = deref(created.Properties.ProvisioningState)
+		}
+
+		var device *AzureVM
+		switch state {
+		case "Failed":
+			return nil, fmt.Errorf("VM %s failed to provision", name)
+		case "Deleting":
+			return nil, fmt.Errorf("%w: VM %s was evicted while starting", ErrNoCapacity, name)
+		case "Succeeded":
+			device = p.newVM(ctx, created)
+		}
+
+		if device != nil && device.ip != "" {
+			emit(Event{
+				Type:         EventInstanceRunning,
+				Provider:     p.Name(),
+				DeviceID:     name,
+				IP:           device.ip,
+				Location:     device.location,
+				InstanceType: device.vmSize,
+				Message:      fmt.Sprintf("VM is running at IP %s", device.ip),
+			})
+			return device, nil
+		}
+
+		if err := sleep(ctx, runningPollInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// azureCapacityErrors are the error codes of VM creation that another
+// size or region might not run into.
+var azureCapacityErrors = map[string]bool{
+	"SkuNotAvailable":                       true,
+	"AllocationFailed":                      true,
+	"ZonalAllocationFailed":                 true,
+	"OverconstrainedAllocationRequest":      true,
+	"OverconstrainedZonalAllocationRequest": true,
+}
+
+// newVirtualMachine returns the Spot VM resource to create.
+func (p *azureProvider) newVirtualMachine(name, script string, loginKey *deviceKey, tags Tags) (*armcompute.VirtualMachine, error) {
+	azure := p.config.Service.Azure
+
+	urn := azure.Image
+	if urn == "" {
+		urn = DefaultAzureImage
+	}
+	image := strings.Split(urn, ":")
+	if len(image) != 4 {
+		return nil, fmt.Errorf("invalid image URN %q, expected publisher:offer:sku:version", urn)
+	}
+
+	maxPrice := float64(azure.SpotPriceMax)
+	if maxPrice <= 0 {
+		maxPrice = -1
+	}
+
+	vm := &armcompute.VirtualMachine{
+		Location: to.Ptr(azure.Location),
+		Tags:     azureTags(tags),
+	}
+	if azure.Identity != "" {
+		// The VM deletes itself with the identity's token.
+		vm.Identity = &armcompute.VirtualMachineIdentity{
+			Type: to.Ptr(armcompute.ResourceIdentityTypeUserAssigned),
+			UserAssignedIdentities: map[string]*armcompute.UserAssignedIdentitiesValue{
+				azure.Identity: {},
+			},
+		}
+	}
+
+	var diskSize *int32
+	if azure.DiskSize > 0 {
+		diskSize = to.Ptr(int32(azure.DiskSize))
+	}
+
+	// The network interface and public IP address are created with the VM
+	// and deleted along with it.
+	nic := &armcompute.VirtualMachineNetworkInterfaceConfiguration{
+		Name: to.Ptr(name + "-nic"),
+		Properties: &armcompute.VirtualMachineNetworkInterfaceConfigurationProperties{
+			Primary:      to.Ptr(true),
+			DeleteOption: to.Ptr(armcompute.DeleteOptionsDelete),
+			IPConfigurations: []*armcompute.VirtualMachineNetworkInterfaceIPConfiguration{{
+				Name: to.Ptr("ipconfig"),
+				Properties: &armcompute.VirtualMachineNetworkInterfaceIPConfigurationProperties{
+					Subnet: &armcompute.SubResource{ID: to.Ptr(azure.Subnet)},
+					PublicIPAddressConfiguration: &armcompute.VirtualMachinePublicIPAddressConfiguration{
+						Name: to.Ptr(azurePublicIPName(name)),
+						SKU:  &armcompute.PublicIPAddressSKU{Name: to.Ptr(armcompute.PublicIPAddressSKUNameStandard)},
+						Properties: &armcompute.VirtualMachinePublicIPAddressConfigurationProperties{
+							DeleteOption:             to.Ptr(armcompute.DeleteOptionsDelete),
+							PublicIPAllocationMethod: to.Ptr(armcompute.PublicIPAllocationMethodStatic),
+						},
+					},
+				},
+			}},
+		},
+	}
+
+	vm.Properties = &armcompute.VirtualMachineProperties{
+		HardwareProfile: &armcompute.HardwareProfile{VMSize: to.Ptr(armcompute.VirtualMachineSizeTypes(azure.VMSize))},
+		Priority:        to.Ptr(armcompute.VirtualMachinePriorityTypesSpot),
+		EvictionPolicy:  to.Ptr(armcompute.VirtualMachineEvictionPolicyTypesDelete),
+		BillingProfile:  &armcompute.BillingProfile{MaxPrice: to.Ptr(maxPrice)},
+		StorageProfile: &armcompute.StorageProfile{
+			ImageReference: &armcompute.ImageReference{
+				Publisher: to.Ptr(image[0]),
+				Offer:     to.Ptr(image[1]),
+				SKU:       to.Ptr(image[2]),
+				Version:   to.Ptr(image[3]),
+			},
+			OSDisk: &armcompute.OSDisk{
+				CreateOption: to.Ptr(armcompute.DiskCreateOptionTypesFromImage),
+				DeleteOption: to.Ptr(armcompute.DiskDeleteOptionTypesDelete),
+				DiskSizeGB:   diskSize,
+			},
+		},
+		// Azure requires an SSH key for the admin user, the login key is
+		// authorized by the script as well.
+		OSProfile: &armcompute.OSProfile{
+			ComputerName:  to.Ptr(name),
+			AdminUsername: to.Ptr(sshUser),
+			CustomData:    to.Ptr(base64.StdEncoding.EncodeToString([]byte(script))),
+			LinuxConfiguration: &armcompute.LinuxConfiguration{
+				DisablePasswordAuthentication: to.Ptr(true),
+				SSH: &armcompute.SSHConfiguration{
+					PublicKeys: []*armcompute.SSHPublicKey{{
+						Path:    to.Ptr("/home/" + sshUser + "/.ssh/authorized_keys"),
+						KeyData: to.Ptr(loginKey.authorizedKey()),
+					}},
+				},
+			},
+		},
+		NetworkProfile: &armcompute.NetworkProfile{
+			NetworkAPIVersion:              to.Ptr(armcompute.NetworkAPIVersionTwoThousandTwenty1101),
+			NetworkInterfaceConfigurations: []*armcompute.VirtualMachineNetworkInterfaceConfiguration{nic},
+		},
+	}
+
+	return vm, nil
+}
+
+// azureTags returns tags as ARM resource tags.
+func azureTags(tags Tags) map[string]*string {
+	m := map[string]*string{}
+	for k, v := range tags.Map() {
+		m[k] = to.Ptr(v)
+	}
+	return m
+}
+
+func (p *azureProvider) Attach(ctx context.Context, name string) (Device, error) {
+	vm, err := p.client.GetVirtualMachine(ctx, p.config.Service.Azure.ResourceGroup, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if state := azurePowerState(vm); state != "running" {
+		return nil, fmt.Errorf("Azure VM %s is not running (state: %s)", name, state)
+	}
+
+	device := p.newVM(ctx, vm)
+	if device.ip == "" {
+		return nil, fmt.Errorf("Azure VM %s has no public IP address", name)
+	}
+
+	Log("Attached to Azure VM %s at IP %s", name, device.ip)
+	return device, nil
+}
+
+// List returns the VMs of the resource group tagged with the configured
+// project.
+func (p *azureProvider) List(ctx context.Context) ([]Device, error) {
+	vms, err := p.client.ListVirtualMachines(ctx, p.config.Service.Azure.ResourceGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []Device
+	for _, vm := range vms {
+		if deref(vm.Tags[tagProject]) != p.config.Project.Name {
+			continue
+		}
+		devices = append(devices, p.newVM(ctx, vm))
+	}
+
+	return devices, nil
+}
+
+func (p *azureProvider) Delete(ctx context.Context, name string) error {
+	return p.client.DeleteVirtualMachine(ctx, p.config.Service.Azure.ResourceGroup, name)
+}
+
+// azureInstanceMetadata is the part of the IMDS instance metadata spt reads.
+type azureInstanceMetadata struct {
+	Compute struct {
+		Name              string `json:"name"`
+		Location          string `json:"location"`
+		ResourceGroupName string `json:"resourceGroupName"`
+		SubscriptionID    string `json:"subscriptionId"`
+		VMSize            string `json:"vmSize"`
+	} `json:"compute"`
+}
+
+func (p *azureProvider) Self(ctx context.Context) (Device, error) {
+	body, err := fetchAzureMetadata(ctx, "instance?api-version=2021-02-01")
+	if err == errNotAzure {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata azureInstanceMetadata
+	if err := json.Unmarshal(body, &metadata); err != nil {
+		return nil, fmt.Errorf("parsing Azure instance metadata: %w", err)
+	}
+	// Metadata servers of other clouds may answer with something else.
+	if metadata.Compute.SubscriptionID == "" {
+		return nil, nil
+	}
+	compute := metadata.Compute
+
+	Log("Detected Azure VM: %s", compute.Name)
+
+	// The VM deletes itself with the token of its managed identity.
+	cred, err := azidentity.NewManagedIdentityCredential(nil)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newARMClient("", compute.SubscriptionID, cred)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AzureVM{
+		name:          compute.Name,
+		resourceGroup: compute.ResourceGroupName,
+		location:      compute.Location,
+		vmSize:        compute.VMSize,
+		client:        client,
+	}, nil
+}
+
+// endpoint returns the ARM URL the VM calls to delete itself.
+func (p *azureProvider) endpoint() string {
+	if endpoint := p.config.Service.Azure.Endpoint; endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/")
+	}
+	return DefaultAzureEndpoint
+}
+
+// newVM returns the device for a VM resource, looking up its public IP
+// address.
+func (p *azureProvider) newVM(ctx context.Context, vm *armcompute.VirtualMachine) *AzureVM {
+	resourceGroup := p.config.Service.Azure.ResourceGroup
+	name := deref(vm.Name)
+	ip, err := p.client.GetPublicIPAddress(ctx, resourceGroup, azurePublicIPName(name))
+	if err != nil && !isAzureNotFound(err) {
+		Log("Error looking up the IP address of VM %s: %v", name, err)
+	}
+
+	m := map[string]string{}
+	for k, v := range vm.Tags {
+		m[k] = deref(v)
+	}
+	tags, _ := parseTags(m)
+
+	var vmSize string
+	state := azurePowerState(vm)
+	if props := vm.Properties; props != nil {
+		if state == "" {
+			state = deref(props.ProvisioningState)
+		}
+		if props.HardwareProfile != nil {
+			vmSize = string(deref(props.HardwareProfile.VMSize))
+		}
+	}
+
+	return &AzureVM{
+		name:          name,
+		resourceGroup: resourceGroup,
+		location:      deref(vm.Location),
+		ip:            ip,
+		vmSize:        vmSize,
+		state:         state,
+		tags:          tags,
+		client:        p.client,
+		config:        p.config,
+	}
+}
+
+// azurePublicIPName returns the name of the public IP address of a VM.
+func azurePublicIPName(vm string) string {
+	return vm + "-ip"
+}
+
+// azureVMPath returns the ARM path of a VM below its subscription.
+func azureVMPath(resourceGroup, name string) string {
+	return "resourceGroups/" + resourceGroup + "/providers/Microsoft.Compute/virtualMachines/" + name
+}
+
+// azureTTLScript deletes the VM with its managed identity once ttl expires.
+// Powering off would leave a stopped Spot VM that is still billed.
+func azureTTLScript(endpoint, subscription, resourceGroup, name string, ttl time.Duration) string {
+	vmURL := endpoint + "/subscriptions/" + subscription + "/" + azureVMPath(resourceGroup, name) + "?api-version=" + azureComputeAPIVersion
+	return fmt.Sprintf(`
+# Delete the VM when the time-to-live expires
+mkdir -p /opt/spt
+cat > /opt/spt/ttl << 'EOL'
+#!/bin/sh
+token=$(curl -sf -H Metadata:true '%sidentity/oauth2/token?api-version=2018-02-01&resource=%s' | sed 's/.*"access_token":"\([^"]*\)".*/\1/')
+curl -sf -X DELETE -H "Authorization: Bearer $token" '%s'
+EOL
+chmod 700 /opt/spt/ttl
+systemd-run --unit=spt-ttl --on-active=%ds /opt/spt/ttl
+`, azureIMDSURL, azureResource, vmURL, int(ttl.Seconds()))
+}
+
+// Azure implementation
+type AzureVM struct {
+	name          string
+	resourceGroup string
+	location      string
+	ip            string
+	vmSize        string
+	state         string
+	tags          Tags
+	client        AzureAPI
+	config        Config
+}
+
+// ID returns the VM name.
+func (c *AzureVM) ID() string {
+	return c.name
+}
+
+func (c *AzureVM) IP() string {
+	return c.ip
+}
+
+// Location returns the region of the VM.
+func (c *AzureVM) Location() string {
+	return c.location
+}
+
+// InstanceType returns the VM size.
+func (c *AzureVM) InstanceType() string {
+	return c.vmSize
+}
+
+// State returns the power state of the VM, or its provisioning state when
+// the power state is not known.
+func (c *AzureVM) State() string {
+	return c.state
+}
+
+func (c *AzureVM) Tags() Tags {
+	return c.tags
+}
+
+// azurePreemptScript prints the time of a scheduled eviction of the VM.
+// Querying scheduled events also enables them for the VM.
+const azurePreemptScript = `curl -sf -H Metadata:true 'http://169.254.169.254/metadata/scheduledevents?api-version=2020-07-01'`
+
+// InterruptionNotice checks the VM's scheduled events for an eviction. Azure
+// gives at least 30 seconds of notice.
+func (c *AzureVM) InterruptionNotice(ctx context.Context, output func(cmd string) ([]byte, error)) (time.Time, bool, error) {
+	out, err := output(azurePreemptScript)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	var scheduled struct {
+		Events []struct {
+			EventType string `json:"EventType"`
+			NotBefore string `json:"NotBefore"`
+		} `json:"Events"`
+	}
+	if err := json.Unmarshal(out, &scheduled); err != nil {
+		return time.Time{}, false, err
+	}
+	for _, event := range scheduled.Events {
+		if event.EventType != "Preempt" {
+			continue
+		}
+		at, err := time.Parse(time.RFC1123, event.NotBefore)
+		if err != nil {
+			at = time.Now().Add(30 * time.Second)
+		}
+		return at, true, nil
+	}
+
+	return time.Time{}, false, nil
+}
+
+func (c *AzureVM) Run(ctx context.Context, detach bool, args []string) (RunResult, error) {
+	return runAndDelete(ctx, "azure", c, c.config, detach, args)
+}
+
+func (c *AzureVM) Delete(ctx context.Context) error {
+	Log("Deleting the Azure Spot VM")
+	return c.client.DeleteVirtualMachine(ctx, c.resourceGroup, c.name)
+}
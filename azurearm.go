@@ -0,0 +1,206 @@
+package spt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v4"
+)
+
+// DefaultAzureEndpoint is the Azure Resource Manager API.
+const DefaultAzureEndpoint = "https://management.azure.com"
+
+// azureComputeAPIVersion is the API version the TTL script deletes the VM
+// with.
+const azureComputeAPIVersion = "2024-07-01"
+
+// AzureAPI is the part of the Azure Resource Manager API spt uses, scoped
+// to one subscription.
+type AzureAPI interface {
+	// CreateVirtualMachine starts creating the VM. The VM's provisioning
+	// state tells when it is done.
+	CreateVirtualMachine(ctx context.Context, resourceGroup, name string, vm armcompute.VirtualMachine) error
+	// GetVirtualMachine returns the VM with its instance view.
+	GetVirtualMachine(ctx context.Context, resourceGroup, name string) (*armcompute.VirtualMachine, error)
+	ListVirtualMachines(ctx context.Context, resourceGroup string) ([]*armcompute.VirtualMachine, error)
+	// DeleteVirtualMachine starts deleting the VM.
+	DeleteVirtualMachine(ctx context.Context, resourceGroup, name string) error
+	// GetPublicIPAddress returns the address of a public IP resource.
+	GetPublicIPAddress(ctx context.Context, resourceGroup, name string) (string, error)
+}
+
+// azurePowerState returns the power state in the instance view of a VM,
+// e.g. running or deallocated, or "" if it is unknown.
+func azurePowerState(vm *armcompute.VirtualMachine) string {
+	if vm.Properties == nil || vm.Properties.InstanceView == nil {
+		return ""
+	}
+	for _, s := range vm.Properties.InstanceView.Statuses {
+		if state, ok := strings.CutPrefix(deref(s.Code), "PowerState/"); ok {
+			return state
+		}
+	}
+	return ""
+}
+
+// deref returns the value p points to, or the zero value if p is nil. The
+// Azure SDK models every optional field as a pointer.
+func deref[T any](p *T) T {
+	var v T
+	if p != nil {
+		v = *p
+	}
+	return v
+}
+
+// isAzureNotFound reports whether err is the API's not found error.
+func isAzureNotFound(err error) bool {
+	var respErr *azcore.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound
+}
+
+// azureErrorCode returns the ARM error code of err, or "" if err is not an
+// API error.
+func azureErrorCode(err error) string {
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) {
+		return ""
+	}
+	return respErr.ErrorCode
+}
+
+// armClient calls the Azure Resource Manager API of one subscription with
+// the Azure SDK.
+type armClient struct {
+	vms *armcompute.VirtualMachinesClient
+	ips *armnetwork.PublicIPAddressesClient
+}
+
+var _ AzureAPI = (*armClient)(nil)
+
+func newARMClient(endpoint, subscription string, cred azcore.TokenCredential) (*armClient, error) {
+	opts := &arm.ClientOptions{}
+	if endpoint != "" {
+		opts.Cloud = cloud.Configuration{
+			ActiveDirectoryAuthorityHost: cloud.AzurePublic.ActiveDirectoryAuthorityHost,
+			Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+				cloud.ResourceManager: {Endpoint: endpoint, Audience: azureResource},
+			},
+		}
+		// Fake APIs are served over plain HTTP.
+		opts.InsecureAllowCredentialWithHTTP = strings.HasPrefix(endpoint, "http://")
+	}
+
+	vms, err := armcompute.NewVirtualMachinesClient(subscription, cred, opts)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := armnetwork.NewPublicIPAddressesClient(subscription, cred, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &armClient{vms: vms, ips: ips}, nil
+}
+
+func (c *armClient) CreateVirtualMachine(ctx context.Context, resourceGroup, name string, vm armcompute.VirtualMachine) error {
+	_, err := c.vms.BeginCreateOrUpdate(ctx, resourceGroup, name, vm, nil)
+	return err
+}
+
+func (c *armClient) GetVirtualMachine(ctx context.Context, resourceGroup, name string) (*armcompute.VirtualMachine, error) {
+	resp, err := c.vms.Get(ctx, resourceGroup, name, &armcompute.VirtualMachinesClientGetOptions{
+		Expand: to.Ptr(armcompute.InstanceViewTypesInstanceView),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp.VirtualMachine, nil
+}
+
+func (c *armClient) ListVirtualMachines(ctx context.Context, resourceGroup string) ([]*armcompute.VirtualMachine, error) {
+	var vms []*armcompute.VirtualMachine
+	pager := c.vms.NewListPager(resourceGroup, nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		vms = append(vms, page.Value...)
+	}
+	return vms, nil
+}
+
+func (c *armClient) DeleteVirtualMachine(ctx context.Context, resourceGroup, name string) error {
+	_, err := c.vms.BeginDelete(ctx, resourceGroup, name, nil)
+	return err
+}
+
+func (c *armClient) GetPublicIPAddress(ctx context.Context, resourceGroup, name string) (string, error) {
+	resp, err := c.ips.Get(ctx, resourceGroup, name, nil)
+	if err != nil {
+		return "", err
+	}
+	if resp.Properties == nil {
+		return "", nil
+	}
+	return deref(resp.Properties.IPAddress), nil
+}
+
+// azureIMDSURL is the base URL of the Azure Instance Metadata Service.
+const azureIMDSURL = "http://169.254.169.254/metadata/"
+
+// azureResource is the resource spt requests tokens for.
+const azureResource = "https://management.azure.com/"
+
+// newAzureCredential returns the credential of a service principal, or
+// without a client secret the default credential chain, which includes the
+// managed identity of the current VM and the Azure CLI login.
+func newAzureCredential(tenantID, clientID, clientSecret string) (azcore.TokenCredential, error) {
+	if clientSecret == "" {
+		return azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{TenantID: tenantID})
+	}
+	return azidentity.NewClientSecretCredential(tenantID, clientID, clientSecret, nil)
+}
+
+// errNotAzure is returned by fetchAzureMetadata off Azure.
+var errNotAzure = errors.New("not running on Azure")
+
+// fetchAzureMetadata returns the IMDS response at path.
+func fetchAzureMetadata(ctx context.Context, path string) ([]byte, error) {
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", azureIMDSURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errNotAzure
+	}
+	defer resp.Body.Close()
+
+	// Metadata servers of other clouds on the link-local address do not
+	// have the path.
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNotAzure
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("metadata %s: %s", path, resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
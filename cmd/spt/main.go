@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/joho/godotenv"
@@ -14,22 +21,36 @@ import (
 const help = `spt(1)
 
 Usage:
-  spt provision
-  spt run [--detach]
+  spt provision [--ttl]
+  spt run [--detach] [--ttl]
   spt self [--delete]
   spt validate
   spt attach --id
+  spt ls
+  spt status <id>
+  spt destroy <id>
+  spt gc [--max-age] [--apply]
+  spt prices
 
 Options:
   -h, --help  Show this screen.
   -c, --config  Configuration file [default: spt.toml]
-  -i, --id  Device ID (Equinix Metal device ID or AWS EC2 instance ID)
+  -i, --id  Device ID (Equinix Metal device ID, AWS EC2 instance ID, GCE or Azure VM name, Hetzner Cloud server ID, local VM name)
   -d, --detach  Detach local client
+  --ttl  Delete the device after this long [default: run.max_duration]
   --delete  Deprovision device
+  --max-age  Age after which gc considers a device leaked [default: gc.max_age or 24h]
+  --apply  Terminate the devices gc lists instead of only listing them, and
+           revoke orphaned Equinix Metal device API keys
+  --log-format  Log format, text or json (JSON lines on stderr) [default: text]
+  --output  Output format, text or json; with json, logs go to stderr [default: text]
 
 Providers:
-  Supports both Equinix Metal and AWS EC2 Spot instances.
-  Configure in spt.toml under [service.equinix] or [service.aws].
+  Supports Equinix Metal, AWS EC2, GCE and Azure Spot instances, Hetzner
+  Cloud servers and local QEMU VMs for offline development.
+  Configure in spt.toml under [service.equinix], [service.aws],
+  [service.gce], [service.azure], [service.hetzner] or [service.local].
+  Set provider under [service] to choose one explicitly.
 `
 
 func readConfig(name string) (spt.Config, error) {
@@ -40,12 +61,8 @@ func readConfig(name string) (spt.Config, error) {
 	}
 	spt.Log("Using configuration file: spt.toml")
 
-	undecoded := md.Undecoded()
-	if len(undecoded) > 0 {
-		fmt.Printf("Following keys were not recognized:\n")
-		for _, u := range undecoded {
-			fmt.Printf("  %s\n", u.String())
-		}
+	for _, u := range md.Undecoded() {
+		spt.Log("Key not recognized: %s", u.String())
 	}
 
 	// Process Equinix Config
@@ -62,12 +79,156 @@ func readConfig(name string) (spt.Config, error) {
 		config.Service.AWS.SecretKey = os.Getenv(config.Service.AWS.SecretKey)
 	}
 
+	// Process Azure Config
+	if config.Service.Azure.SubscriptionID != "" {
+		spt.Log("Service: azure")
+		config.Service.Azure.ClientSecret = os.Getenv(config.Service.Azure.ClientSecret)
+	}
+
+	// Process Hetzner Config
+	if config.Service.Hetzner.ServerType != "" {
+		spt.Log("Service: hetzner")
+		config.Service.Hetzner.Token = os.Getenv(config.Service.Hetzner.Token)
+	}
+
+	// Process local Config, which needs no settings
+	if config.Service.Provider == "" && md.IsDefined("service", "local") {
+		config.Service.Provider = "local"
+	}
+	if config.Service.Provider == "local" {
+		spt.Log("Service: local")
+	}
+
 	return config, nil
 }
 
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// revokeOrphanedKeys reports the device API keys that outlived their
+// device and, with apply, revokes them. It returns false if a key could not
+// be revoked.
+func revokeOrphanedKeys(ctx context.Context, client *spt.Client, apply bool) bool {
+	keys, err := client.OrphanedKeys(ctx)
+	if err != nil {
+		spt.Log("Error listing device API keys: %v", err)
+		return false
+	}
+	if len(keys) == 0 {
+		return true
+	}
+
+	if !apply {
+		spt.Log("Dry run: %d orphaned device API key(s) found, re-run with --apply to revoke them", len(keys))
+		return true
+	}
+
+	ok := true
+	for _, id := range keys {
+		if err := client.RevokeKey(ctx, id); err != nil {
+			spt.Log("Error revoking device API key %s: %v", id, err)
+			ok = false
+			continue
+		}
+		spt.Log("Device API key %s revoked", id)
+	}
+	return ok
+}
+
+// describeRecord returns the description of the recorded device, including
+// its state and price, or the record's own with the state "unavailable"
+// when the device cannot be attached.
+func describeRecord(ctx context.Context, config spt.Config, record spt.DeviceRecord) spt.DeviceInfo {
+	info := record.Info()
+	info.State = "unavailable"
+
+	client, err := spt.NewClient(spt.ConfigFor(config, record))
+	if err != nil {
+		return info
+	}
+	device, err := client.Lookup(ctx, record.ID)
+	if err != nil {
+		return info
+	}
+	return client.Describe(ctx, device)
+}
+
+// exitSkippedCleanup is the exit status used when a second signal aborts
+// the cleanup of a device, as a shell reports a process killed by SIGINT.
+const exitSkippedCleanup = 130
+
+// trapSignals returns a context that is canceled with an *spt.SignalError on
+// the first SIGINT or SIGTERM, which deletes a half-provisioned device, or
+// forwards the signal to the container of a run and then deletes the
+// device. A second signal exits immediately and leaves the device running.
+// stop restores the default signal handling.
+func trapSignals(parent context.Context) (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+
+	// The device to name when its cleanup is skipped.
+	var mu sync.Mutex
+	var device string
+	unsubscribe := spt.Subscribe(func(e spt.Event) {
+		if e.DeviceID == "" {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if e.Type != spt.EventDeleted {
+			device = e.DeviceID
+		} else if e.DeviceID == device {
+			device = ""
+		}
+	})
+
+	ch := make(chan os.Signal, 2)
+	done := make(chan struct{})
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-ch:
+			spt.Log("Received %s, stopping and cleaning up (press Ctrl-C again to skip cleanup)", sig)
+			cancel(&spt.SignalError{Signal: sig})
+		case <-done:
+			return
+		}
+
+		select {
+		case <-ch:
+			mu.Lock()
+			id := device
+			mu.Unlock()
+			if id != "" {
+				spt.Log("Skipping cleanup, device %s is still running", id)
+				spt.Log("Delete it with: spt destroy %s", id)
+			}
+			os.Exit(exitSkippedCleanup)
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(ch)
+		close(done)
+		unsubscribe()
+		cancel(nil)
+	}
+}
+
+// fail prints the error to stderr and exits.
+func fail(args ...interface{}) {
+	fmt.Fprintln(os.Stderr, args...)
+	os.Exit(1)
+}
+
 func main() {
 	flag.Usage = func() {
-		fmt.Println(help)
+		fmt.Print(help)
 	}
 
 	if len(os.Args) < 2 {
@@ -85,13 +246,28 @@ func main() {
 	selfCmd := flag.NewFlagSet("self", flag.ExitOnError)
 	validateCmd := flag.NewFlagSet("validate", flag.ExitOnError)
 	attachCmd := flag.NewFlagSet("attach", flag.ExitOnError)
+	lsCmd := flag.NewFlagSet("ls", flag.ExitOnError)
+	statusCmd := flag.NewFlagSet("status", flag.ExitOnError)
+	destroyCmd := flag.NewFlagSet("destroy", flag.ExitOnError)
+	gcCmd := flag.NewFlagSet("gc", flag.ExitOnError)
+	pricesCmd := flag.NewFlagSet("prices", flag.ExitOnError)
 
 	detach := runCmd.Bool("d", false, "Detach local client")
+	runTTL := runCmd.Duration("ttl", 0, "Delete the device after this long")
+	provisionTTL := provisionCmd.Duration("ttl", 0, "Delete the device after this long")
 	delete := selfCmd.Bool("delete", false, "Deprovision device")
 	attachId := attachCmd.String("id", "", "Device ID")
+	maxAge := gcCmd.Duration("max-age", 0, "Age after which a device is considered leaked")
+	apply := gcCmd.Bool("apply", false, "Terminate leaked devices")
 
 	configFile := flag.String("config", "spt.toml", "Configuration file")
 
+	var logFormat, output string
+	for _, cmd := range []*flag.FlagSet{provisionCmd, runCmd, selfCmd, validateCmd, attachCmd, lsCmd, statusCmd, destroyCmd, gcCmd, pricesCmd} {
+		cmd.StringVar(&logFormat, "log-format", "text", "Log format: text or json")
+		cmd.StringVar(&output, "output", "text", "Output format: text or json")
+	}
+
 	switch os.Args[1] {
 	case "provision":
 		provisionCmd.Parse(os.Args[2:])
@@ -103,8 +279,18 @@ func main() {
 		validateCmd.Parse(os.Args[2:])
 	case "attach":
 		attachCmd.Parse(os.Args[2:])
+	case "ls":
+		lsCmd.Parse(os.Args[2:])
+	case "status":
+		statusCmd.Parse(os.Args[2:])
+	case "destroy":
+		destroyCmd.Parse(os.Args[2:])
+	case "gc":
+		gcCmd.Parse(os.Args[2:])
+	case "prices":
+		pricesCmd.Parse(os.Args[2:])
 	default:
-		fmt.Println("Unrecognized command:", os.Args[1])
+		fmt.Fprintln(os.Stderr, "Unrecognized command:", os.Args[1])
 		flag.Usage()
 		os.Exit(1)
 	}
@@ -113,55 +299,304 @@ func main() {
 		rest = attachCmd.Args()
 	}
 
+	if output != "text" && output != "json" {
+		fail("Unknown output format:", output)
+	}
+	jsonOutput := output == "json"
+
+	switch logFormat {
+	case "text":
+		// Keep stdout for the JSON document.
+		if jsonOutput {
+			spt.SetLogger(spt.TextLogger(os.Stderr))
+		}
+	case "json":
+		spt.SetLogger(spt.JSONLogger(os.Stderr))
+	default:
+		fail("Unknown log format:", logFormat)
+	}
+	if jsonOutput {
+		// The build and container output follow the JSON document of
+		// `attach` and `run`.
+		spt.SetOutput(os.Stderr)
+	}
+
 	godotenv.Load()
 
+	ctx := context.Background()
+
 	var device spt.Device
 	if selfCmd.Parsed() {
-		device = spt.NewSelfDevice()
+		device, err := spt.NewSelfDevice(ctx)
+		if err != nil {
+			fail(err)
+		}
 		if *delete {
-			device.Delete()
+			if err := device.Delete(ctx); err != nil {
+				fail(err)
+			}
 		}
 
 		return
 	}
 
-	config, err := readConfig(*configFile)
+	state, err := spt.LoadState()
 	if err != nil {
-		fmt.Println(err)
+		fail("Error loading state:", err)
+	}
+
+	if lsCmd.Parsed() {
+		if jsonOutput {
+			// The state and price are looked up from the provider.
+			config, err := readConfig(*configFile)
+			if err != nil {
+				spt.Log("Error reading config, device states are unknown: %v", err)
+			}
+
+			infos := []spt.DeviceInfo{}
+			for _, d := range state.Devices {
+				if err != nil {
+					info := d.Info()
+					info.State = "unavailable"
+					infos = append(infos, info)
+					continue
+				}
+				infos = append(infos, describeRecord(ctx, config, d))
+			}
+			printJSON(infos)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tPROVIDER\tIP\tPROJECT\tAGE")
+		for _, d := range state.Devices {
+			age := time.Since(d.CreatedAt).Round(time.Second)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d.ID, d.Provider, d.IP, d.Project, age)
+		}
+		w.Flush()
 		return
 	}
 
+	var record spt.DeviceRecord
+	if statusCmd.Parsed() || destroyCmd.Parsed() {
+		args := statusCmd.Args()
+		if destroyCmd.Parsed() {
+			args = destroyCmd.Args()
+		}
+		if len(args) != 1 {
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		var ok bool
+		record, ok = state.Find(args[0])
+		if !ok {
+			fail("Unknown device:", args[0])
+		}
+	}
+
+	config, err := readConfig(*configFile)
+	if err != nil {
+		fail(err)
+	}
+
+	if *runTTL > 0 {
+		config.Run.MaxDuration = *runTTL
+	}
+	if *provisionTTL > 0 {
+		config.Run.MaxDuration = *provisionTTL
+	}
+
+	configHash := spt.ConfigHash(config)
+	config = spt.ConfigFor(config, record)
+
 	if validateCmd.Parsed() {
+		if jsonOutput {
+			provider, err := spt.NewProvider(config)
+			if err != nil {
+				printJSON(map[string]interface{}{"valid": false, "error": err.Error()})
+				os.Exit(1)
+			}
+			printJSON(map[string]interface{}{"valid": true, "provider": provider.Name(), "config_hash": configHash})
+			return
+		}
+
 		spt.Log("OK")
 		return
 	}
 
-	var client spt.Client
+	client, err := spt.NewClient(config)
+	if err != nil {
+		fail("Error creating client:", err)
+	}
+
+	if statusCmd.Parsed() {
+		if jsonOutput {
+			device, err := client.Lookup(ctx, record.ID)
+			if err != nil {
+				info := record.Info()
+				info.State = "unavailable"
+				printJSON(info)
+				os.Exit(1)
+			}
+			printJSON(client.Describe(ctx, device))
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+		fmt.Fprintf(w, "ID:\t%s\n", record.ID)
+		fmt.Fprintf(w, "Provider:\t%s\n", record.Provider)
+		fmt.Fprintf(w, "IP:\t%s\n", record.IP)
+		if record.SpotRequestID != "" {
+			fmt.Fprintf(w, "Spot request:\t%s\n", record.SpotRequestID)
+		}
+		fmt.Fprintf(w, "Project:\t%s\n", record.Project)
+		fmt.Fprintf(w, "Created:\t%s\n", record.CreatedAt.Format(time.RFC3339))
+		fmt.Fprintf(w, "Config hash:\t%s\n", record.ConfigHash)
+		if configHash != record.ConfigHash {
+			fmt.Fprintf(w, "\t(spt.toml has changed since the device was created)\n")
+		}
+
+		_, err := client.Lookup(ctx, record.ID)
+		if err != nil {
+			fmt.Fprintf(w, "State:\tunavailable (%v)\n", err)
+		} else {
+			fmt.Fprintf(w, "State:\trunning\n")
+		}
+		w.Flush()
 
-	if config.Service.AWS.Region != "" {
-		// AWS client
-		clientPtr, err := spt.NewAWSClient(config)
 		if err != nil {
-			fmt.Println("Error creating AWS client:", err)
 			os.Exit(1)
 		}
-		client = *clientPtr
-	} else {
-		// Equinix client
-		client = spt.NewClient(config)
+		return
 	}
 
+	if pricesCmd.Parsed() {
+		prices, err := client.Prices(ctx)
+		if err != nil {
+			fail(err)
+		}
+		if jsonOutput {
+			printJSON(prices)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "LOCATION\tTYPE\tPRICE")
+		for _, p := range prices {
+			fmt.Fprintf(w, "%s\t%s\t$%.4f/h\n", p.Location, p.InstanceType, p.Price)
+		}
+		w.Flush()
+		return
+	}
+
+	if gcCmd.Parsed() {
+		age := *maxAge
+		if age == 0 {
+			age = config.GC.MaxAge
+		}
+		if age == 0 {
+			age = spt.DefaultMaxAge
+		}
+
+		stale, err := client.Stale(ctx, age)
+		if err != nil {
+			fail(err)
+		}
+
+		if jsonOutput {
+			infos := []spt.DeviceInfo{}
+			failed := false
+			for _, d := range stale {
+				info := client.Describe(ctx, d)
+				if *apply {
+					if err := client.Delete(ctx, d.ID()); err != nil {
+						spt.Log("Error deleting %s: %v", d.ID(), err)
+						failed = true
+					} else {
+						info.State = "deleted"
+					}
+				}
+				infos = append(infos, info)
+			}
+			printJSON(infos)
+			if !revokeOrphanedKeys(ctx, client, *apply) {
+				failed = true
+			}
+			if failed {
+				os.Exit(1)
+			}
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tIP\tOWNER\tAGE")
+		for _, d := range stale {
+			tags := d.Tags()
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", d.ID(), d.IP(), tags.Owner, time.Since(tags.CreatedAt).Round(time.Second))
+		}
+		w.Flush()
+
+		if !*apply {
+			spt.Log("Dry run: %d leaked device(s) found, re-run with --apply to terminate them", len(stale))
+			revokeOrphanedKeys(ctx, client, false)
+			return
+		}
+
+		failed := false
+		for _, d := range stale {
+			if err := client.Delete(ctx, d.ID()); err != nil {
+				fmt.Fprintf(os.Stderr, "Error deleting %s: %v\n", d.ID(), err)
+				failed = true
+				continue
+			}
+			spt.Log("Device %s destroyed", d.ID())
+		}
+		if !revokeOrphanedKeys(ctx, client, true) {
+			failed = true
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if destroyCmd.Parsed() {
+		if err := client.Delete(ctx, record.ID); err != nil {
+			fail(err)
+		}
+		if jsonOutput {
+			info := record.Info()
+			info.State = "deleted"
+			printJSON(info)
+			return
+		}
+		spt.Log("Device %s destroyed", record.ID)
+		return
+	}
+
+	ctx, stop := trapSignals(ctx)
+	defer stop()
+
 	if attachCmd.Parsed() {
-		device, err = client.Attach(*attachId)
+		device, err = client.Attach(ctx, *attachId)
 	} else {
-		device, err = client.Provision()
+		device, err = client.Provision(ctx)
 	}
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		fail(err)
+	}
+
+	if jsonOutput && (provisionCmd.Parsed() || attachCmd.Parsed()) {
+		printJSON(client.Describe(ctx, device))
 	}
 
 	if runCmd.Parsed() || attachCmd.Parsed() {
-		device.Run(*detach, rest)
+		result, err := client.Run(ctx, device, *detach, rest)
+		if err != nil {
+			fail(err)
+		}
+
+		os.Exit(result.ExitCode)
 	}
 }
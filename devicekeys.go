@@ -0,0 +1,115 @@
+package spt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// deviceKey is an SSH key pair generated for a single device. Its public key
+// is authorized on the device at creation and its private key is kept next
+// to the state file until the device is deleted.
+type deviceKey struct {
+	private []byte
+	public  ssh.PublicKey
+}
+
+func newDeviceKey() (*deviceKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := ssh.MarshalPrivateKey(priv, "spt")
+	if err != nil {
+		return nil, err
+	}
+
+	public, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	return &deviceKey{private: pem.EncodeToMemory(block), public: public}, nil
+}
+
+// authorizedKey returns the public key in authorized_keys format.
+func (k *deviceKey) authorizedKey() string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k.public))) + " spt"
+}
+
+// authorize returns script with the public key added to the login user's
+// authorized_keys right after the interpreter line.
+func (k *deviceKey) authorize(script string) string {
+	shebang, rest, _ := strings.Cut(script, "\n")
+	return shebang + `
+# Per-device SSH key
+mkdir -p /home/` + sshUser + `/.ssh
+echo '` + k.authorizedKey() + `' >> /home/` + sshUser + `/.ssh/authorized_keys
+chown -R ` + sshUser + `:` + sshUser + ` /home/` + sshUser + `/.ssh
+chmod 700 /home/` + sshUser + `/.ssh
+chmod 600 /home/` + sshUser + `/.ssh/authorized_keys
+` + rest
+}
+
+// deviceKeyPath returns where the private key of the device id is stored.
+func deviceKeyPath(id string) (string, error) {
+	path, err := StatePath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(path), "keys", id), nil
+}
+
+// saveDeviceKey stores the private key of the device id.
+func saveDeviceKey(id string, key *deviceKey) error {
+	path, err := deviceKeyPath(id)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, key.private, 0o600)
+}
+
+// loadDeviceKey returns a signer for the stored private key of the device
+// id, or nil when spt did not generate a key for it.
+func loadDeviceKey(id string) (ssh.Signer, error) {
+	path, err := deviceKeyPath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParsePrivateKey(data)
+}
+
+// removeDeviceKey deletes the stored private key of the device id.
+func removeDeviceKey(id string) error {
+	path, err := deviceKeyPath(id)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
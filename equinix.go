@@ -0,0 +1,806 @@
+package spt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/equinix/equinix-sdk-go/services/metalv1"
+	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
+)
+
+type DeviceCreator interface {
+	SetPlan(string)
+	SetOperatingSystem(string)
+	SetHostname(string)
+	SetUserdata(string)
+	SetTags([]string)
+	SetHardwareReservationId(string)
+	SetBillingCycle(metalv1.DeviceCreateInputBillingCycle)
+	SetSpotInstance(bool)
+	SetSpotPriceMax(float32)
+	SetTerminationTime(time.Time)
+	SetCustomdata(map[string]interface{})
+	SetSshKeys([]metalv1.SSHKeyInput)
+}
+
+type OneOfDeviceCreator interface {
+	DeviceCreator
+	GetActualInstance() interface{}
+}
+
+var _ DeviceCreator = (*metal.DeviceCreateInMetroInput)(nil)
+var _ DeviceCreator = (*metal.DeviceCreateInFacilityInput)(nil)
+
+// metalMetadataURL is the Equinix Metal metadata service.
+const metalMetadataURL = "http://metadata.platformequinix.com/metadata"
+
+func fetchMetadata(ctx context.Context) (Metadata, bool) {
+	url := metalMetadataURL
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return Metadata{}, false
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return Metadata{}, false
+	}
+
+	if resp.StatusCode != 200 {
+		return Metadata{}, false
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Metadata{}, false
+	}
+
+	var metadata Metadata
+	err = json.Unmarshal(body, &metadata)
+	if err != nil {
+		return Metadata{}, false
+	}
+
+	return metadata, true
+}
+
+type Metadata struct {
+	Customdata struct {
+		ApiKey string `json:"api_key"`
+	} `json:"customdata"`
+	Id string `json:"id"`
+}
+
+// equinixFallbacks returns the fallback candidates for cfg: each fallback
+// plan, then the same in every fallback metro, then on-demand capacity when
+// enabled.
+func equinixFallbacks(cfg Config) []Fallback {
+	primary := cfg.Service.Equinix
+
+	metros := []Config{cfg}
+	for _, metro := range primary.FallbackMetros {
+		c := cfg
+		c.Service.Equinix.Metro = metro
+		metros = append(metros, c)
+	}
+
+	var fallbacks []Fallback
+	for i, c := range metros {
+		metro := equinixMetro(c)
+		if i > 0 {
+			fallbacks = append(fallbacks, Fallback{
+				Description: fmt.Sprintf("%s in %s", c.Service.Equinix.Plan, metro),
+				Config:      c,
+			})
+		}
+
+		for _, plan := range primary.Fallback {
+			c := c
+			c.Service.Equinix.Plan = plan
+			fallbacks = append(fallbacks, Fallback{
+				Description: fmt.Sprintf("%s in %s", plan, metro),
+				Config:      c,
+			})
+		}
+	}
+
+	if primary.OnDemandFallback && !primary.OnDemand {
+		for _, c := range metros {
+			c.Service.Equinix.OnDemand = true
+			fallbacks = append(fallbacks, Fallback{
+				Description: fmt.Sprintf("on-demand %s in %s", c.Service.Equinix.Plan, equinixMetro(c)),
+				Config:      c,
+			})
+		}
+	}
+
+	return fallbacks
+}
+
+// equinixMetro returns the configured metro, defaulting to any metro.
+func equinixMetro(cfg Config) string {
+	if cfg.Service.Equinix.Metro != "" {
+		return cfg.Service.Equinix.Metro
+	}
+	return "any"
+}
+
+// MetalAPI is the part of the Equinix Metal API spt uses.
+type MetalAPI interface {
+	// CreateDevice wraps ErrNoCapacity or ErrPriceTooLow in its error when
+	// the plan is not available in the metro or the spot price is too low.
+	CreateDevice(ctx context.Context, projectID string, request metal.CreateDeviceRequest) (*metal.Device, error)
+	// FindDeviceById wraps errMetalNotFound in its error when the device
+	// does not exist.
+	FindDeviceById(ctx context.Context, id string) (*metal.Device, error)
+	// FindProjectDevices returns every device of the project with tag, or
+	// every device of the project when tag is empty.
+	FindProjectDevices(ctx context.Context, projectID, tag string) ([]metal.Device, error)
+	DeleteDevice(ctx context.Context, id string) error
+	CreateProjectAPIKey(ctx context.Context, projectID string, input metal.AuthTokenInput) (*metal.AuthToken, error)
+	FindProjectAPIKeys(ctx context.Context, projectID string) ([]metal.AuthToken, error)
+	DeleteAPIKey(ctx context.Context, id string) error
+	// SpotPrices returns the current spot price of plan in every metro.
+	SpotPrices(ctx context.Context, plan string) ([]Price, error)
+}
+
+// metalClient implements MetalAPI with the Metal SDK.
+type metalClient struct {
+	api *metal.APIClient
+}
+
+var _ MetalAPI = (*metalClient)(nil)
+
+// newMetalClient returns a client for the Metal API at endpoint, or the
+// default API when endpoint is empty.
+func newMetalClient(apiKey, endpoint string) MetalAPI {
+	config := metal.NewConfiguration()
+	config.AddDefaultHeader("X-Auth-Token", apiKey)
+	if endpoint != "" {
+		config.Servers = metal.ServerConfigurations{{URL: endpoint}}
+	}
+
+	return &metalClient{api: metal.NewAPIClient(config)}
+}
+
+func (c *metalClient) CreateDevice(ctx context.Context, projectID string, request metal.CreateDeviceRequest) (*metal.Device, error) {
+	device, resp, err := c.api.DevicesApi.CreateDevice(ctx, projectID).CreateDeviceRequest(request).Execute()
+	if err != nil && resp != nil {
+		var body string
+		var apiErr *metal.GenericOpenAPIError
+		if errors.As(err, &apiErr) {
+			body = string(apiErr.Body())
+		}
+		message := strings.ToLower(err.Error() + " " + body)
+		switch {
+		case strings.Contains(message, "spot price"):
+			err = fmt.Errorf("%w: %w", ErrPriceTooLow, err)
+		case resp.StatusCode == http.StatusServiceUnavailable || strings.Contains(message, "not available"):
+			err = fmt.Errorf("%w: %w", ErrNoCapacity, err)
+		}
+	}
+	return device, err
+}
+
+// errMetalNotFound is wrapped by MetalAPI errors for missing resources.
+var errMetalNotFound = errors.New("not found")
+
+func (c *metalClient) FindDeviceById(ctx context.Context, id string) (*metal.Device, error) {
+	device, resp, err := c.api.DevicesApi.FindDeviceById(ctx, id).Execute()
+	if err != nil && resp != nil && resp.StatusCode == http.StatusNotFound {
+		err = fmt.Errorf("%w: %w", errMetalNotFound, err)
+	}
+	return device, err
+}
+
+func (c *metalClient) FindProjectDevices(ctx context.Context, projectID, tag string) ([]metal.Device, error) {
+	request := c.api.DevicesApi.FindProjectDevices(ctx, projectID)
+	if tag != "" {
+		request = request.Tag(tag)
+	}
+	list, err := request.ExecuteWithPagination()
+	if err != nil {
+		return nil, err
+	}
+	return list.GetDevices(), nil
+}
+
+func (c *metalClient) DeleteDevice(ctx context.Context, id string) error {
+	_, err := c.api.DevicesApi.DeleteDevice(ctx, id).Execute()
+	return err
+}
+
+func (c *metalClient) CreateProjectAPIKey(ctx context.Context, projectID string, input metal.AuthTokenInput) (*metal.AuthToken, error) {
+	key, _, err := c.api.AuthenticationApi.CreateProjectAPIKey(ctx, projectID).AuthTokenInput(input).Execute()
+	return key, err
+}
+
+func (c *metalClient) FindProjectAPIKeys(ctx context.Context, projectID string) ([]metal.AuthToken, error) {
+	list, _, err := c.api.AuthenticationApi.FindProjectAPIKeys(ctx, projectID).Execute()
+	if err != nil {
+		return nil, err
+	}
+	return list.GetApiKeys(), nil
+}
+
+func (c *metalClient) DeleteAPIKey(ctx context.Context, id string) error {
+	_, err := c.api.AuthenticationApi.DeleteAPIKey(ctx, id).Execute()
+	return err
+}
+
+// Equinix Metal provider
+type equinixProvider struct {
+	client MetalAPI
+	config Config
+	// opts are kept for the providers of fallback configurations.
+	opts []EquinixOption
+}
+
+// EquinixOption customizes the Equinix Metal provider.
+type EquinixOption func(*equinixProvider)
+
+// WithMetalClient makes the Equinix Metal provider use client instead of a
+// Metal client created from the configuration.
+func WithMetalClient(client MetalAPI) EquinixOption {
+	return func(p *equinixProvider) {
+		p.client = client
+	}
+}
+
+func NewEquinixProvider(cfg Config, opts ...EquinixOption) (Provider, error) {
+	p := &equinixProvider{config: cfg, opts: opts}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.client == nil {
+		p.client = newMetalClient(cfg.Service.Equinix.ApiKey, cfg.Service.Equinix.Endpoint)
+	}
+	return p, nil
+}
+
+func (p *equinixProvider) Name() string {
+	return "equinix"
+}
+
+func (p *equinixProvider) withConfig(cfg Config) (Provider, error) {
+	return NewEquinixProvider(cfg, p.opts...)
+}
+
+func (p *equinixProvider) hostname() string {
+	return p.config.Project.Name + "-spt-instance"
+}
+
+func (p *equinixProvider) Provision(ctx context.Context) (Device, error) {
+	if p.config.Service.Equinix.Metro == AutoLocation {
+		price, err := cheapestPrice(ctx, p, p.config.Service.Equinix.SpotPriceMax)
+		if err != nil {
+			return nil, err
+		}
+
+		Log("Cheapest metro is %s with %s at $%.4f/h", price.Location, price.InstanceType, price.Price)
+		resolved := *p
+		resolved.config.Service.Equinix.Metro = price.Location
+		resolved.config.Service.Equinix.Plan = price.InstanceType
+		return resolved.Provision(ctx)
+	}
+
+	config := p.config
+	client := p.client
+
+	var dc DeviceCreator
+	var createRequest metal.CreateDeviceRequest
+
+	metro := equinixMetro(config)
+
+	dc = &metal.DeviceCreateInMetroInput{
+		Metro: metro,
+	}
+	createRequest = metal.CreateDeviceRequest{DeviceCreateInMetroInput: dc.(*metal.DeviceCreateInMetroInput)}
+
+	dc.SetSpotInstance(!config.Service.Equinix.OnDemand)
+	dc.SetHostname(p.hostname())
+	dc.SetTags(newTags(config).List())
+
+	hostKey, err := newHostKey()
+	if err != nil {
+		return nil, err
+	}
+	loginKey, err := newDeviceKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// The device only gets a project key of its own, used by
+	// `spt self --delete` and revoked together with the device.
+	deviceKey, err := p.createDeviceKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error creating device API key: %w", err)
+	}
+	dc.SetCustomdata(map[string]interface{}{
+		"api_key":    deviceKey.GetToken(),
+		"api_key_id": deviceKey.GetId(),
+	})
+
+	dc.SetUserdata(loginKey.authorize(hostKey.install(p.userScript())))
+	dc.SetSshKeys([]metal.SSHKeyInput{{
+		Key:   metal.PtrString(loginKey.authorizedKey()),
+		Label: metal.PtrString(p.hostname()),
+	}})
+
+	if ttl := config.Run.MaxDuration; ttl > 0 {
+		dc.SetTerminationTime(time.Now().Add(ttl))
+		Log("Device will be terminated after %s", ttl)
+	}
+	if config.Service.Equinix.SpotPriceMax != 0 && !config.Service.Equinix.OnDemand {
+		dc.SetSpotPriceMax(config.Service.Equinix.SpotPriceMax)
+	}
+	if config.Service.Equinix.Plan != "" {
+		dc.SetPlan(config.Service.Equinix.Plan)
+	}
+	if config.Service.Equinix.OperatingSystem != "" {
+		dc.SetOperatingSystem(config.Service.Equinix.OperatingSystem)
+	}
+
+	message := fmt.Sprintf("Provisioning Equinix Metal spot instance in %s", metro)
+	if config.Service.Equinix.OnDemand {
+		message = fmt.Sprintf("Provisioning Equinix Metal on-demand instance in %s", metro)
+	}
+	emit(Event{
+		Type:         EventProvisionRequested,
+		Provider:     p.Name(),
+		Location:     metro,
+		InstanceType: config.Service.Equinix.Plan,
+		Message:      message,
+	})
+
+	projectID := config.Service.Equinix.Project
+	newDevice, err := client.CreateDevice(ctx, projectID, createRequest)
+	if err != nil {
+		if revokeErr := revokeDeviceKey(context.WithoutCancel(ctx), client, deviceKey.GetId()); revokeErr != nil {
+			Log("Error revoking device API key: %v", revokeErr)
+		}
+		return nil, err
+	}
+
+	emit(Event{
+		Type:     EventSpotRequestCreated,
+		Provider: p.Name(),
+		DeviceID: newDevice.GetId(),
+		Message:  fmt.Sprintf("Device %s is being provisioned", newDevice.GetId()),
+	})
+
+	deviceID := newDevice.GetId()
+	return finishProvisioning(ctx, deviceID,
+		func(ctx context.Context) (Device, error) { return p.waitActive(ctx, deviceID) },
+		func(ctx context.Context) error { return deleteMetalDevice(ctx, client, newDevice) },
+		hostKey, loginKey, config)
+}
+
+// userScript returns the user-data script of a new device. Metal
+// terminates the device at its termination time but leaves its API key,
+// so with a time-to-live the device revokes the key itself shortly before.
+func (p *equinixProvider) userScript() string {
+	ttl := p.config.Run.MaxDuration
+	if ttl <= 0 {
+		return userScript + readyScript
+	}
+	endpoint := p.config.Service.Equinix.Endpoint
+	if endpoint == "" {
+		endpoint = metal.NewConfiguration().Servers[0].URL
+	}
+	return armTTL(userScript, metalTTLScript(endpoint, ttl)) + readyScript
+}
+
+// metalKeyRevokeLead is how long before the termination time the device
+// revokes its API key.
+const metalKeyRevokeLead = time.Minute
+
+// metalTTLScript revokes the device's API key, read from the customdata,
+// once ttl is about to expire. The key is project-wide and does not expire
+// on its own.
+func metalTTLScript(endpoint string, ttl time.Duration) string {
+	revokeAt := ttl - metalKeyRevokeLead
+	if revokeAt < 0 {
+		revokeAt = 0
+	}
+	return fmt.Sprintf(`
+# Revoke the device API key before the time-to-live expires
+mkdir -p /opt/spt
+cat > /opt/spt/ttl << 'EOL'
+#!/bin/sh
+curl -sf %[1]s | python3 -c '
+import json, sys
+customdata = json.load(sys.stdin)["customdata"]
+print(customdata["api_key"], customdata["api_key_id"])
+' | {
+	read -r token id
+	curl -sf -X DELETE -H "X-Auth-Token: $token" "%[2]s/api-keys/$id"
+}
+EOL
+chmod 700 /opt/spt/ttl
+systemd-run --unit=spt-ttl --on-active=%[3]ds /opt/spt/ttl
+`, metalMetadataURL, strings.TrimSuffix(endpoint, "/"), int(revokeAt.Seconds()))
+}
+
+// waitActive waits until the new device is active with a public IPv4
+// address.
+func (p *equinixProvider) waitActive(ctx context.Context, deviceID string) (Device, error) {
+	config := p.config
+
+	Log("Waiting for Provisioning...")
+	stage := float32(0)
+	for {
+		device, err := p.client.FindDeviceById(ctx, deviceID)
+		if err != nil {
+			return nil, reclaimedMetalDevice(config, deviceID, err)
+		}
+		if device.GetState() == metal.DEVICESTATE_PROVISIONING && stage != device.GetProvisioningPercentage() {
+			stage = device.GetProvisioningPercentage()
+			emit(Event{
+				Type:     EventProvisioningProgress,
+				Provider: p.Name(),
+				DeviceID: deviceID,
+				Percent:  stage,
+				Message:  fmt.Sprintf("Provisioning %v%% complete", stage),
+			})
+		}
+		if device.GetState() == metal.DEVICESTATE_ACTIVE {
+			ipAddr := metalPublicIPv4(device)
+			if ipAddr == "" {
+				return nil, fmt.Errorf("device %s is active without a public IPv4 address", deviceID)
+			}
+			Log("IP %s", ipAddr)
+
+			deviceMetro := device.GetMetro()
+			emit(Event{
+				Type:         EventInstanceRunning,
+				Provider:     p.Name(),
+				DeviceID:     deviceID,
+				IP:           ipAddr,
+				Location:     deviceMetro.GetCode(),
+				InstanceType: config.Service.Equinix.Plan,
+				Message:      fmt.Sprintf("Device State: %s", device.GetState()),
+			})
+			return &MetalDevice{device: device, ipAddr: ipAddr, client: p.client, config: config}, nil
+		}
+		if device.GetState() == metal.DEVICESTATE_FAILED {
+			return nil, fmt.Errorf("device %s failed to provision", deviceID)
+		}
+		// Metal servers take longer to deploy than VMs to start.
+		if err := sleep(ctx, 2*runningPollInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *equinixProvider) Attach(ctx context.Context, id string) (Device, error) {
+	device, err := p.client.FindDeviceById(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	ipAddr := metalPublicIPv4(device)
+
+	Log("Attached to Equinix Metal device %s at IP %s", id, ipAddr)
+	metalDevice := &MetalDevice{device: device, ipAddr: ipAddr, client: p.client, config: p.config}
+	return metalDevice, nil
+}
+
+func (p *equinixProvider) List(ctx context.Context) ([]Device, error) {
+	projectID := p.config.Service.Equinix.Project
+	list, err := p.client.FindProjectDevices(ctx, projectID, tagProject+"="+p.config.Project.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []Device
+	for i := range list {
+		device := &list[i]
+		devices = append(devices, &MetalDevice{
+			device: device,
+			ipAddr: metalPublicIPv4(device),
+			client: p.client,
+			config: p.config,
+		})
+	}
+
+	return devices, nil
+}
+
+func (p *equinixProvider) Delete(ctx context.Context, id string) error {
+	device, err := p.client.FindDeviceById(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	return deleteMetalDevice(ctx, p.client, device)
+}
+
+// Prices returns the current spot price of the configured plan and its
+// fallbacks in every metro.
+func (p *equinixProvider) Prices(ctx context.Context) ([]Price, error) {
+	plans := append([]string{p.config.Service.Equinix.Plan}, p.config.Service.Equinix.Fallback...)
+
+	var prices []Price
+	for _, plan := range plans {
+		if plan == "" {
+			continue
+		}
+
+		planPrices, err := p.client.SpotPrices(ctx, plan)
+		if err != nil {
+			return nil, err
+		}
+		prices = append(prices, planPrices...)
+	}
+
+	return prices, nil
+}
+
+// SpotPrices returns the current spot price of plan in every metro.
+func (c *metalClient) SpotPrices(ctx context.Context, plan string) ([]Price, error) {
+	config := c.api.GetConfig()
+	baseURL, err := config.ServerURL(0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	// The generated client only knows a fixed set of metros and plans, so
+	// the response is decoded by hand.
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+"/market/spot/prices/metros?plan="+url.QueryEscape(plan), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range config.DefaultHeader {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var body struct {
+		SpotMarketPrices map[string]map[string]struct {
+			Price float64 `json:"price"`
+		} `json:"spot_market_prices"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("fetching spot prices for %s: %s", plan, resp.Status)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var prices []Price
+	for metro, plans := range body.SpotMarketPrices {
+		if price, ok := plans[plan]; ok {
+			prices = append(prices, Price{Location: metro, InstanceType: plan, Price: price.Price})
+		}
+	}
+
+	return prices, nil
+}
+
+// deviceKeyDescription prefixes the description of the project API keys
+// minted for devices.
+const deviceKeyDescription = "spt device key for "
+
+// deviceKeyGrace is how old a device key without a device must be before
+// `spt gc` revokes it. Keys are minted just before their device is created.
+const deviceKeyGrace = 15 * time.Minute
+
+// reclaimedMetalDevice returns err, the error of looking up a device being
+// provisioned, as ErrNoCapacity when Metal reclaimed the spot device.
+func reclaimedMetalDevice(config Config, id string, err error) error {
+	if config.Service.Equinix.OnDemand || !errors.Is(err, errMetalNotFound) {
+		return err
+	}
+	return fmt.Errorf("%w: device %s was reclaimed while provisioning", ErrNoCapacity, id)
+}
+
+// createDeviceKey mints a project API key for a single device. Metal API
+// keys do not expire; keys of devices deleted at their termination time are
+// revoked by `spt gc`.
+func (p *equinixProvider) createDeviceKey(ctx context.Context) (*metal.AuthToken, error) {
+	input := metal.NewAuthTokenInput()
+	input.SetDescription(fmt.Sprintf("%s%s (%s)", deviceKeyDescription, p.hostname(), time.Now().UTC().Format(time.RFC3339)))
+
+	projectID := p.config.Service.Equinix.Project
+	return p.client.CreateProjectAPIKey(ctx, projectID, *input)
+}
+
+// revokeDeviceKey deletes the API key minted for a device.
+func revokeDeviceKey(ctx context.Context, client MetalAPI, keyID string) error {
+	if keyID == "" {
+		return nil
+	}
+
+	return client.DeleteAPIKey(ctx, keyID)
+}
+
+// deleteMetalDevice deletes device and then revokes the API key minted for
+// it, which may be the key client itself authenticates with.
+func deleteMetalDevice(ctx context.Context, client MetalAPI, device *metal.Device) error {
+	err := client.DeleteDevice(ctx, device.GetId())
+	if err != nil {
+		return err
+	}
+
+	keyID, _ := device.GetCustomdata()["api_key_id"].(string)
+	if err := revokeDeviceKey(ctx, client, keyID); err != nil {
+		return fmt.Errorf("error revoking device API key: %w", err)
+	}
+
+	return nil
+}
+
+// OrphanedKeys returns the device keys of the project whose device no longer
+// exists, such as those of devices deleted at their termination time.
+func (p *equinixProvider) OrphanedKeys(ctx context.Context) ([]string, error) {
+	projectID := p.config.Service.Equinix.Project
+	keys, err := p.client.FindProjectAPIKeys(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	// Devices of every spt project may use keys of the Metal project.
+	devices, err := p.client.FindProjectDevices(ctx, projectID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	inUse := make(map[string]bool)
+	for _, device := range devices {
+		if keyID, ok := device.GetCustomdata()["api_key_id"].(string); ok {
+			inUse[keyID] = true
+		}
+	}
+
+	var orphaned []string
+	for _, key := range keys {
+		if !strings.HasPrefix(key.GetDescription(), deviceKeyDescription) || inUse[key.GetId()] {
+			continue
+		}
+		if time.Since(key.GetCreatedAt()) < deviceKeyGrace {
+			continue
+		}
+		orphaned = append(orphaned, key.GetId())
+	}
+
+	return orphaned, nil
+}
+
+// RevokeKey deletes the device key with the given ID.
+func (p *equinixProvider) RevokeKey(ctx context.Context, id string) error {
+	return revokeDeviceKey(ctx, p.client, id)
+}
+
+func (p *equinixProvider) Self(ctx context.Context) (Device, error) {
+	metadata, ok := fetchMetadata(ctx)
+	if !ok {
+		return nil, nil
+	}
+
+	client := newMetalClient(metadata.Customdata.ApiKey, "")
+	device, err := client.FindDeviceById(ctx, metadata.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MetalDevice{device: device, ipAddr: metalPublicIPv4(device), client: client}, nil
+}
+
+func metalPublicIPv4(device *metal.Device) string {
+	var ipAddr string
+	for _, ip := range device.GetIpAddresses() {
+		if ip.GetPublic() && ip.GetAddressFamily() == 4 {
+			ipAddr = ip.GetAddress()
+		}
+	}
+	return ipAddr
+}
+
+// Equinix Metal implementation
+type MetalDevice struct {
+	device *metal.Device
+	client MetalAPI
+	config Config
+	ipAddr string
+}
+
+func (c *MetalDevice) ID() string {
+	return c.device.GetId()
+}
+
+// InterruptionNotice reports a spot reclaim, which Equinix Metal announces
+// by setting or moving the device's termination time. A termination time
+// spt set itself for the TTL is not a notice.
+func (c *MetalDevice) InterruptionNotice(ctx context.Context, output func(cmd string) ([]byte, error)) (time.Time, bool, error) {
+	device, err := c.client.FindDeviceById(ctx, c.device.GetId())
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	at, ok := device.GetTerminationTimeOk()
+	if !ok || at == nil {
+		return time.Time{}, false, nil
+	}
+	if ttl, ok := c.device.GetTerminationTimeOk(); ok && ttl != nil && ttl.Equal(*at) {
+		return time.Time{}, false, nil
+	}
+
+	return *at, true, nil
+}
+
+func (c *MetalDevice) Run(ctx context.Context, detach bool, args []string) (RunResult, error) {
+	return runAndDelete(ctx, "equinix", c, c.config, detach, args)
+}
+
+func (c *MetalDevice) IP() string {
+	return c.ipAddr
+}
+
+// Location returns the metro the device runs in.
+func (c *MetalDevice) Location() string {
+	metro := c.device.GetMetro()
+	return metro.GetCode()
+}
+
+// InstanceType returns the plan of the device.
+func (c *MetalDevice) InstanceType() string {
+	plan := c.device.GetPlan()
+	return plan.GetSlug()
+}
+
+// State returns the device state.
+func (c *MetalDevice) State() string {
+	return string(c.device.GetState())
+}
+
+// Price returns the current spot price of the device's plan in its metro.
+// On-demand devices report zero.
+func (c *MetalDevice) Price(ctx context.Context) (float64, error) {
+	if !c.device.GetSpotInstance() {
+		return 0, nil
+	}
+
+	prices, err := c.client.SpotPrices(ctx, c.InstanceType())
+	if err != nil {
+		return 0, err
+	}
+
+	for _, price := range prices {
+		if price.Location == c.Location() {
+			return price.Price, nil
+		}
+	}
+	return 0, nil
+}
+
+func (c *MetalDevice) Tags() Tags {
+	tags, _ := parseTagList(c.device.GetTags())
+	return tags
+}
+
+func (c *MetalDevice) Delete(ctx context.Context) error {
+	Log("De-provisioning the Equinix Metal spot instance")
+	return deleteMetalDevice(ctx, c.client, c.device)
+}
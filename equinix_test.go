@@ -0,0 +1,215 @@
+package spt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
+)
+
+// mockMetal creates devices with createErr, or else devices that are
+// found as device, or with findErr.
+type mockMetal struct {
+	MetalAPI
+	createErr error
+	device    metal.Device
+	findErr   error
+
+	created int
+	deleted int
+	revoked int
+}
+
+func (m *mockMetal) CreateProjectAPIKey(ctx context.Context, projectID string, input metal.AuthTokenInput) (*metal.AuthToken, error) {
+	key := metal.NewAuthToken()
+	key.SetId(fmt.Sprintf("key-%d", m.created))
+	key.SetToken("token")
+	return key, nil
+}
+
+func (m *mockMetal) DeleteAPIKey(ctx context.Context, id string) error {
+	m.revoked++
+	return nil
+}
+
+func (m *mockMetal) CreateDevice(ctx context.Context, projectID string, request metal.CreateDeviceRequest) (*metal.Device, error) {
+	if m.createErr != nil {
+		return nil, m.createErr
+	}
+	m.created++
+	device := m.device
+	device.SetId("device-mock")
+	device.SetCustomdata(request.DeviceCreateInMetroInput.GetCustomdata())
+	return &device, nil
+}
+
+func (m *mockMetal) FindDeviceById(ctx context.Context, id string) (*metal.Device, error) {
+	if m.findErr != nil {
+		return nil, m.findErr
+	}
+	device := m.device
+	device.SetId(id)
+	return &device, nil
+}
+
+func (m *mockMetal) DeleteDevice(ctx context.Context, id string) error {
+	m.deleted++
+	return nil
+}
+
+func metalDevice(state metal.DeviceState, ips ...string) metal.Device {
+	device := metal.NewDevice()
+	device.SetState(state)
+	var addresses []metal.IPAssignment
+	for _, ip := range ips {
+		address := metal.NewIPAssignment()
+		address.SetAddress(ip)
+		address.SetAddressFamily(4)
+		address.SetPublic(true)
+		addresses = append(addresses, *address)
+	}
+	device.SetIpAddresses(addresses)
+	return *device
+}
+
+func TestEquinixProvision(t *testing.T) {
+	t.Setenv("SPT_STATE_FILE", filepath.Join(t.TempDir(), "state.json"))
+
+	tests := []struct {
+		name        string
+		createErr   error
+		device      metal.Device
+		findErr     error
+		wantErr     error
+		wantCreated int
+		wantDeleted int
+		wantRevoked int
+	}{
+		{
+			name:        "no capacity",
+			createErr:   fmt.Errorf("%w: plan is not available", ErrNoCapacity),
+			wantErr:     ErrNoCapacity,
+			wantRevoked: 2,
+		},
+		{
+			name:        "spot price too low",
+			createErr:   fmt.Errorf("%w: above the spot price max", ErrPriceTooLow),
+			wantErr:     ErrPriceTooLow,
+			wantRevoked: 2,
+		},
+		{
+			name:        "configuration error",
+			createErr:   errors.New("422 Unprocessable Entity"),
+			wantRevoked: 1,
+		},
+		{
+			name:        "reclaimed before running",
+			device:      metalDevice(metal.DEVICESTATE_QUEUED),
+			findErr:     fmt.Errorf("%w: 404 Not Found", errMetalNotFound),
+			wantErr:     ErrNoCapacity,
+			wantCreated: 2,
+			wantDeleted: 2,
+			wantRevoked: 2,
+		},
+		{
+			name:        "failed before running",
+			device:      metalDevice(metal.DEVICESTATE_FAILED),
+			wantCreated: 1,
+			wantDeleted: 1,
+			wantRevoked: 1,
+		},
+		{
+			name:        "failed after getting an IP",
+			device:      metalDevice(metal.DEVICESTATE_FAILED, "203.0.113.1"),
+			wantCreated: 1,
+			wantDeleted: 1,
+			wantRevoked: 1,
+		},
+		{
+			name:        "missing public IP",
+			device:      metalDevice(metal.DEVICESTATE_ACTIVE),
+			wantCreated: 1,
+			wantDeleted: 1,
+			wantRevoked: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg Config
+			cfg.Project.Name = "spt-test"
+			cfg.Service.Equinix.Project = "project-mock"
+			cfg.Service.Equinix.Plan = "m3.small.x86"
+			cfg.Service.Equinix.Metro = "da"
+			cfg.Service.Equinix.Fallback = []string{"m3.large.x86"}
+
+			mock := &mockMetal{createErr: tt.createErr, device: tt.device, findErr: tt.findErr}
+			provider, err := NewEquinixProvider(cfg, WithMetalClient(mock))
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := NewClient(cfg, WithProvider(provider))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = client.Provision(context.Background())
+			if err == nil {
+				t.Fatal("Provision() succeeded, want an error")
+			}
+			for _, sentinel := range []error{ErrNoCapacity, ErrPriceTooLow} {
+				if got, want := errors.Is(err, sentinel), sentinel == tt.wantErr; got != want {
+					t.Errorf("Provision() = %v, errors.Is(err, %q) = %v, want %v", err, sentinel, got, want)
+				}
+			}
+			// Fallbacks use the injected client too.
+			if mock.created != tt.wantCreated {
+				t.Errorf("CreateDevice created %d devices, want %d", mock.created, tt.wantCreated)
+			}
+			if mock.deleted != tt.wantDeleted {
+				t.Errorf("DeleteDevice called %d times, want %d", mock.deleted, tt.wantDeleted)
+			}
+			if mock.revoked != tt.wantRevoked {
+				t.Errorf("DeleteAPIKey called %d times, want %d", mock.revoked, tt.wantRevoked)
+			}
+		})
+	}
+}
+
+func TestEquinixUserScript(t *testing.T) {
+	tests := []struct {
+		name       string
+		ttl        time.Duration
+		wantRevoke string
+	}{
+		{"default", 0, ""},
+		{"ttl", time.Hour, "--on-active=3540s"},
+		{"ttl below the lead", 30 * time.Second, "--on-active=0s"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg Config
+			cfg.Service.Equinix.Endpoint = "http://metal.test/metal/v1/"
+			cfg.Run.MaxDuration = tt.ttl
+			p := &equinixProvider{config: cfg}
+
+			script := p.userScript()
+			if !strings.HasPrefix(script, "#!") {
+				t.Errorf("script does not start with the interpreter line:\n%s", script)
+			}
+			hasRevoke := strings.Contains(script, `"http://metal.test/metal/v1/api-keys/$id"`)
+			if hasRevoke != (tt.wantRevoke != "") {
+				t.Errorf("script revokes the device key = %v, want %v:\n%s", hasRevoke, tt.wantRevoke != "", script)
+			}
+			if tt.wantRevoke != "" && !strings.Contains(script, tt.wantRevoke) {
+				t.Errorf("script does not arm the watchdog with %s:\n%s", tt.wantRevoke, script)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package spt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// EventType identifies what an Event reports.
+type EventType string
+
+const (
+	// EventLog is a free-form message without a more specific type.
+	EventLog EventType = "log"
+	// EventProvisionRequested is emitted when a provider starts
+	// provisioning a device.
+	EventProvisionRequested EventType = "provision_requested"
+	// EventSpotRequestCreated is emitted once the provider accepted the
+	// request and assigned the device an ID.
+	EventSpotRequestCreated EventType = "spot_request_created"
+	// EventInstanceRunning is emitted when the device is running and has
+	// a public IP address.
+	EventInstanceRunning EventType = "instance_running"
+	// EventProvisioningProgress reports the provider's provisioning
+	// progress in percent.
+	EventProvisioningProgress EventType = "provisioning_progress"
+	// EventDeviceReady is emitted when the device finished its setup.
+	EventDeviceReady EventType = "device_ready"
+	// EventBuildStarted is emitted when the image build starts.
+	EventBuildStarted EventType = "build_started"
+	// EventRunStarted is emitted when the container is started.
+	EventRunStarted EventType = "run_started"
+	// EventRunExited is emitted when the container exited.
+	EventRunExited EventType = "run_exited"
+	// EventInterruptionNotice is emitted when the provider announced that
+	// it will reclaim the device.
+	EventInterruptionNotice EventType = "interruption_notice"
+	// EventDeleted is emitted when a device was deleted.
+	EventDeleted EventType = "deleted"
+)
+
+// Event is a step of provisioning, running or deleting a device.
+type Event struct {
+	Type     EventType `json:"type"`
+	Time     time.Time `json:"time"`
+	Provider string    `json:"provider,omitempty"`
+	DeviceID string    `json:"device_id,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	// Location is the region, availability zone or metro.
+	Location     string  `json:"location,omitempty"`
+	InstanceType string  `json:"instance_type,omitempty"`
+	Percent      float32 `json:"percent,omitempty"`
+	// ExitCode is set for EventRunExited.
+	ExitCode *int `json:"exit_code,omitempty"`
+	// Message is a human readable description of the event.
+	Message string `json:"message"`
+}
+
+var (
+	eventsMu    sync.RWMutex
+	logger      = TextLogger(os.Stdout)
+	subscribers = map[int]func(Event){}
+	nextSubID   int
+)
+
+// Subscribe calls fn with every event until the returned function is called.
+// fn is called synchronously and must not block.
+func Subscribe(fn func(Event)) (unsubscribe func()) {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+
+	id := nextSubID
+	nextSubID++
+	subscribers[id] = fn
+
+	return func() {
+		eventsMu.Lock()
+		defer eventsMu.Unlock()
+		delete(subscribers, id)
+	}
+}
+
+// SetLogger replaces the function that prints events, TextLogger(os.Stdout)
+// by default. A nil logger discards them.
+func SetLogger(fn func(Event)) {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+
+	if fn == nil {
+		fn = func(Event) {}
+	}
+	logger = fn
+}
+
+// TextLogger prints the message of every event to w, prefixed with "-- ".
+func TextLogger(w io.Writer) func(Event) {
+	var mu sync.Mutex
+	return func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, "-- %s\n", e.Message)
+	}
+}
+
+// JSONLogger prints every event to w as a line of JSON.
+func JSONLogger(w io.Writer) func(Event) {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(e)
+	}
+}
+
+// emit stamps e with the current time and hands it to the logger and every
+// subscriber.
+func emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	eventsMu.RLock()
+	defer eventsMu.RUnlock()
+
+	logger(e)
+	for _, fn := range subscribers {
+		fn(e)
+	}
+}
+
+// Log emits a free-form EventLog message.
+func Log(format string, args ...interface{}) {
+	emit(Event{Type: EventLog, Message: fmt.Sprintf(format, args...)})
+}
@@ -0,0 +1,26 @@
+package spt
+
+import "time"
+
+// SetPollIntervals makes every wait of spt poll every d, for tests against
+// the fake backends. The returned function restores the intervals.
+func SetPollIntervals(d time.Duration) (restore func()) {
+	intervals := []*time.Duration{
+		&readyPollInterval,
+		&runningPollInterval,
+		&sshRetryInterval,
+		&interruptionPollInterval,
+		&computeOperationPollInterval,
+	}
+	saved := make([]time.Duration, len(intervals))
+	for i, interval := range intervals {
+		saved[i] = *interval
+		*interval = d
+	}
+
+	return func() {
+		for i, interval := range intervals {
+			*interval = saved[i]
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package spt_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+
+	spt "github.com/littledivy/spt"
+	"github.com/littledivy/spt/internal/fake"
+)
+
+// fakeBackend is a fake provider API and the configuration pointing spt at
+// it.
+type fakeBackend struct {
+	name  string
+	start func(target fake.Target) (config func(*spt.Config), setFailure func(fake.Failure), stop func())
+	// noReclaim is set for providers whose devices are not spot instances
+	// and never reclaimed.
+	noReclaim bool
+	// unreachable is set for providers whose API client parses device
+	// addresses as IPs, dropping the port of the target, so devices never
+	// become ready.
+	unreachable bool
+}
+
+// fakeBackends are the providers with a fake API. The local provider has
+// no API to fake, it boots VMs under QEMU on this machine.
+var fakeBackends = []fakeBackend{
+	{
+		name: "aws",
+		start: func(target fake.Target) (func(*spt.Config), func(fake.Failure), func()) {
+			api := fake.NewEC2(target)
+			return func(cfg *spt.Config) {
+				cfg.Service.AWS.Region = "us-east-1"
+				cfg.Service.AWS.AccessKey = "AKIAFAKE"
+				cfg.Service.AWS.SecretKey = "fake"
+				cfg.Service.AWS.InstanceType = "c6i.metal"
+				cfg.Service.AWS.AMI = "ami-fake"
+				cfg.Service.AWS.Endpoint = api.URL
+			}, api.SetFailure, api.Close
+		},
+	},
+	{
+		name: "equinix",
+		start: func(target fake.Target) (func(*spt.Config), func(fake.Failure), func()) {
+			api := fake.NewMetal(target)
+			return func(cfg *spt.Config) {
+				cfg.Service.Equinix.Project = "fake-project"
+				cfg.Service.Equinix.ApiKey = "fake"
+				cfg.Service.Equinix.Plan = "m3.small.x86"
+				cfg.Service.Equinix.Metro = "da"
+				cfg.Service.Equinix.SpotPriceMax = 1
+				cfg.Service.Equinix.Endpoint = api.URL
+			}, api.SetFailure, api.Close
+		},
+	},
+	{
+		name: "gce",
+		start: func(target fake.Target) (func(*spt.Config), func(fake.Failure), func()) {
+			api := fake.NewGCE(target)
+			return func(cfg *spt.Config) {
+				cfg.Service.GCE.Project = "fake-project"
+				cfg.Service.GCE.Zone = "us-central1-a"
+				cfg.Service.GCE.MachineType = "c3-standard-4"
+				cfg.Service.GCE.Endpoint = api.URL
+			}, api.SetFailure, api.Close
+		},
+	},
+	{
+		name: "azure",
+		start: func(target fake.Target) (func(*spt.Config), func(fake.Failure), func()) {
+			api := fake.NewAzure(target)
+			return func(cfg *spt.Config) {
+				cfg.Service.Azure.SubscriptionID = "00000000-0000-0000-0000-000000000000"
+				cfg.Service.Azure.ResourceGroup = "spt-test"
+				cfg.Service.Azure.Location = "eastus"
+				cfg.Service.Azure.VMSize = "Standard_D4s_v5"
+				cfg.Service.Azure.Subnet = "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/spt-test/providers/Microsoft.Network/virtualNetworks/spt/subnets/default"
+				cfg.Service.Azure.Endpoint = api.URL
+			}, api.SetFailure, api.Close
+		},
+	},
+	{
+		name: "hetzner",
+		start: func(target fake.Target) (func(*spt.Config), func(fake.Failure), func()) {
+			api := fake.NewHetzner(target)
+			return func(cfg *spt.Config) {
+				cfg.Service.Hetzner.Token = "fake"
+				cfg.Service.Hetzner.ServerType = "ccx33"
+				cfg.Service.Hetzner.Location = "fsn1"
+				cfg.Service.Hetzner.Endpoint = api.URL
+			}, api.SetFailure, api.Close
+		},
+		noReclaim:   true,
+		unreachable: true,
+	},
+}
+
+// newFakeClient returns a client for the backend and a function that makes
+// its following spot requests fail. The state file lives in a temporary
+// directory, and spt polls the fakes every few milliseconds.
+func newFakeClient(t *testing.T, backend fakeBackend, target fake.Target) (*spt.Client, func(fake.Failure)) {
+	t.Setenv("SPT_STATE_FILE", filepath.Join(t.TempDir(), "state.json"))
+	t.Cleanup(spt.SetPollIntervals(10 * time.Millisecond))
+	// The fakes accept any token.
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "fake")
+	bin := t.TempDir()
+	if err := fake.WriteAzureCLI(bin); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	for _, env := range []string{"AZURE_CLIENT_ID", "AZURE_CLIENT_SECRET", "AZURE_TENANT_ID"} {
+		t.Setenv(env, "")
+	}
+
+	configure, setFailure, stop := backend.start(target)
+	t.Cleanup(stop)
+
+	var cfg spt.Config
+	cfg.Project.Name = "spt-test"
+	cfg.Service.ReadyTimeout = 2 * time.Minute
+	configure(&cfg)
+
+	client, err := spt.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, setFailure
+}
+
+func TestProvisionFailures(t *testing.T) {
+	tests := []struct {
+		failure      fake.Failure
+		name         string
+		wantCapacity bool
+	}{
+		{fake.NoCapacity, "no capacity", true},
+		{fake.Reclaimed, "reclaimed", true},
+		{fake.ProvisionFailed, "provision failed", false},
+	}
+
+	for _, backend := range fakeBackends {
+		for _, tt := range tests {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				if tt.failure == fake.Reclaimed && backend.noReclaim {
+					t.Skip("devices are not reclaimed")
+				}
+				client, setFailure := newFakeClient(t, backend, nil)
+				setFailure(tt.failure)
+
+				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				defer cancel()
+
+				device, err := client.Provision(ctx)
+				if err == nil {
+					t.Fatalf("Provision() = %s, want an error", device.ID())
+				}
+				if got := errors.Is(err, spt.ErrNoCapacity); got != tt.wantCapacity {
+					t.Errorf("Provision() = %v, errors.Is(err, ErrNoCapacity) = %v, want %v", err, got, tt.wantCapacity)
+				}
+
+				// Nothing is left running.
+				devices, err := client.List(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(devices) != 0 {
+					t.Errorf("List() = %d devices, want none", len(devices))
+				}
+			})
+		}
+	}
+}
+
+func TestProvisionListDelete(t *testing.T) {
+	for _, backend := range fakeBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			if backend.unreachable {
+				t.Skip("devices are unreachable on a fake target")
+			}
+			target, err := fake.StartSSHTarget()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer target.Close()
+
+			client, _ := newFakeClient(t, backend, target)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+
+			device, err := client.Provision(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if device.IP() != target.Addr() {
+				t.Errorf("Provision() IP = %s, want %s", device.IP(), target.Addr())
+			}
+
+			devices, err := client.List(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(devices) != 1 || devices[0].ID() != device.ID() {
+				t.Fatalf("List() = %v, want device %s", devices, device.ID())
+			}
+
+			if err := client.Delete(ctx, device.ID()); err != nil {
+				t.Fatal(err)
+			}
+			if devices, err := client.List(ctx); err != nil || len(devices) != 0 {
+				t.Errorf("List() after Delete = %v, %v, want none", devices, err)
+			}
+			state, err := spt.LoadState()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := state.Find(device.ID()); ok {
+				t.Errorf("device %s is still recorded after Delete", device.ID())
+			}
+		})
+	}
+}
+
+func TestProvisionRunDelete(t *testing.T) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker is not installed")
+	}
+	if err := exec.Command("docker", "info").Run(); err != nil {
+		t.Skip("docker is not running")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	target, err := fake.StartDockerTarget(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	chdir(t, newProject(t))
+	startSSHAgent(t)
+
+	for _, backend := range fakeBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			if backend.unreachable {
+				t.Skip("devices are unreachable on a fake target")
+			}
+			client, _ := newFakeClient(t, backend, target)
+
+			device, err := client.Provision(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := client.Run(ctx, device, false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.ExitCode != 3 {
+				t.Errorf("Run() exit code = %d, want 3", result.ExitCode)
+			}
+
+			devices, err := client.List(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(devices) != 0 {
+				t.Errorf("List() = %d devices after the run, want none", len(devices))
+			}
+		})
+	}
+}
+
+// newProject returns a directory with a Dockerfile whose image builds
+// without network access and exits with status 3.
+func newProject(t *testing.T) string {
+	dir := t.TempDir()
+
+	main := filepath.Join(dir, "main.go")
+	if err := os.WriteFile(main, []byte("package main\n\nimport \"os\"\n\nfunc main() { os.Exit(3) }\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	build := exec.Command(filepath.Join(runtime.GOROOT(), "bin", "go"), "build", "-o", filepath.Join(dir, "exit3"), main)
+	build.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS=linux", "GOARCH="+runtime.GOARCH, "GO111MODULE=off")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("building test binary: %v\n%s", err, out)
+	}
+
+	dockerfile := "FROM scratch\nCOPY exit3 /exit3\nENTRYPOINT [\"/exit3\"]\n"
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dockerfile), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// chdir changes the working directory to dir for the duration of the test.
+func chdir(t *testing.T, dir string) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// startSSHAgent serves an agent with a throwaway key for `docker build
+// --ssh default`.
+func startSSHAgent(t *testing.T) {
+	keyring := agent.NewKeyring()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	t.Setenv("SSH_AUTH_SOCK", socket)
+}
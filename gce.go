@@ -0,0 +1,426 @@
+package spt
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/oauth2/google"
+)
+
+// DefaultGCEImage is the boot image of GCE Spot VMs when `image` is not
+// set.
+const DefaultGCEImage = "projects/ubuntu-os-cloud/global/images/family/ubuntu-2204-lts"
+
+// gceLabelProject is the label by which spt finds the VMs of a project.
+// Labels only allow lowercase keys and values, the exact tags are kept in
+// the instance metadata.
+const gceLabelProject = "spt-project"
+
+// Google Compute Engine provider
+type gceProvider struct {
+	client *computeClient
+	config Config
+}
+
+func NewGCEProvider(cfg Config) (Provider, error) {
+	gce := cfg.Service.GCE
+	tokens := &lazyGCETokenSource{credentialsFile: gce.CredentialsFile}
+	return &gceProvider{client: newComputeClient(gce.Endpoint, gce.Project, tokens), config: cfg}, nil
+}
+
+func (p *gceProvider) Name() string {
+	return "gce"
+}
+
+func (p *gceProvider) Provision(ctx context.Context) (Device, error) {
+	config := p.config
+	gce := config.Service.GCE
+	name := newDeviceName(config.Project.Name)
+
+	emit(Event{
+		Type:         EventProvisionRequested,
+		Provider:     p.Name(),
+		Location:     gce.Zone,
+		InstanceType: gce.MachineType,
+		Message:      fmt.Sprintf("Provisioning GCE Spot VM in %s", gce.Zone),
+	})
+
+	hostKey, err := newHostKey()
+	if err != nil {
+		return nil, err
+	}
+	loginKey, err := newDeviceKey()
+	if err != nil {
+		return nil, err
+	}
+
+	tags := newTags(config)
+	instance := p.newComputeInstance(name, loginKey.authorize(hostKey.install(userScript+readyScript)), tags)
+	if ttl := config.Run.MaxDuration; ttl > 0 {
+		// GCE deletes the VM once the duration expires.
+		instance.Scheduling.MaxRunDuration = &computeDuration{Seconds: int64(ttl.Seconds())}
+		Log("VM will be deleted after %s", ttl)
+	}
+
+	op, err := p.client.insertInstance(ctx, gce.Zone, instance)
+	if err != nil {
+		return nil, err
+	}
+
+	emit(Event{
+		Type:     EventSpotRequestCreated,
+		Provider: p.Name(),
+		DeviceID: name,
+		Message:  fmt.Sprintf("VM %s requested, waiting for it to be ready", name),
+	})
+
+	return finishProvisioning(ctx, name,
+		func(ctx context.Context) (Device, error) { return p.waitRunning(ctx, op, name) },
+		func(ctx context.Context) error {
+			if err := deleteGCEInstance(ctx, p.client, gce.Zone, name); err != nil && !isComputeNotFound(err) {
+				return err
+			}
+			return nil
+		},
+		hostKey, loginKey, config)
+}
+
+// waitRunning waits until the insert operation op finished and the new VM
+// is running with an external IP address.
+func (p *gceProvider) waitRunning(ctx context.Context, op *computeOperation, name string) (Device, error) {
+	zone := p.config.Service.GCE.Zone
+
+	// Spot capacity errors such as ZONE_RESOURCE_POOL_EXHAUSTED are
+	// reported by the insert operation.
+	if err := p.client.wait(ctx, op); err != nil {
+		return nil, err
+	}
+
+	for {
+		running, err := p.client.getInstance(ctx, zone, name)
+		if isComputeNotFound(err) {
+			return nil, fmt.Errorf("%w: VM %s was preempted while starting", ErrNoCapacity, name)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if running.Status == "RUNNING" && gceExternalIP(running) != "" {
+			vm := p.newInstance(running)
+			emit(Event{
+				Type:         EventInstanceRunning,
+				Provider:     p.Name(),
+				DeviceID:     name,
+				IP:           vm.ip,
+				Location:     vm.zone,
+				InstanceType: vm.machineType,
+				Message:      fmt.Sprintf("VM is running at IP %s", vm.ip),
+			})
+			return vm, nil
+		}
+		if running.Status == "STOPPING" || running.Status == "TERMINATED" {
+			return nil, fmt.Errorf("VM %s stopped while starting (status: %s)", name, running.Status)
+		}
+
+		if err := sleep(ctx, runningPollInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// newComputeInstance returns the Spot VM resource to insert.
+func (p *gceProvider) newComputeInstance(name, script string, tags Tags) *computeInstance {
+	gce := p.config.Service.GCE
+
+	image := gce.Image
+	if image == "" {
+		image = DefaultGCEImage
+	}
+	network := gce.Network
+	if network == "" {
+		network = "global/networks/default"
+	}
+	serviceAccount := gce.ServiceAccount
+	if serviceAccount == "" {
+		serviceAccount = "default"
+	}
+
+	// The script is handed to cloud-init as user-data rather than run by
+	// the guest agent as startup-script, so that readiness can be judged
+	// by cloud-init like on the other providers.
+	items := []computeMetadataItem{{Key: "user-data", Value: script}}
+	for k, v := range tags.Map() {
+		items = append(items, computeMetadataItem{Key: gceMetadataKey(k), Value: v})
+	}
+
+	automaticRestart := false
+	return &computeInstance{
+		Name:        name,
+		MachineType: "zones/" + gce.Zone + "/machineTypes/" + gce.MachineType,
+		Labels:      map[string]string{gceLabelProject: gceLabelValue(tags.Project)},
+		Metadata:    &computeMetadata{Items: items},
+		Scheduling: &computeScheduling{
+			ProvisioningModel:         "SPOT",
+			InstanceTerminationAction: "DELETE",
+			OnHostMaintenance:         "TERMINATE",
+			AutomaticRestart:          &automaticRestart,
+		},
+		Disks: []computeAttachedDisk{{
+			Boot:       true,
+			AutoDelete: true,
+			InitializeParams: &computeDiskInitializer{
+				SourceImage: image,
+				DiskSizeGb:  gce.DiskSize,
+			},
+		}},
+		NetworkInterfaces: []computeNetworkInterface{{
+			Network:       network,
+			AccessConfigs: []computeAccessConfig{{Type: "ONE_TO_ONE_NAT", Name: "External NAT"}},
+		}},
+		// The VM deletes itself with its service account's token.
+		ServiceAccounts: []computeServiceAccount{{Email: serviceAccount, Scopes: []string{gceScope}}},
+	}
+}
+
+func (p *gceProvider) Attach(ctx context.Context, name string) (Device, error) {
+	instance, err := p.client.getInstance(ctx, p.config.Service.GCE.Zone, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if instance.Status != "RUNNING" {
+		return nil, fmt.Errorf("GCE VM %s is not running (status: %s)", name, instance.Status)
+	}
+
+	vm := p.newInstance(instance)
+	if vm.ip == "" {
+		return nil, fmt.Errorf("GCE VM %s has no external IP address", name)
+	}
+
+	Log("Attached to GCE VM %s at IP %s", name, vm.ip)
+	return vm, nil
+}
+
+// List returns the VMs labeled with the configured project in every zone.
+func (p *gceProvider) List(ctx context.Context) ([]Device, error) {
+	filter := fmt.Sprintf("labels.%s = %q", gceLabelProject, gceLabelValue(p.config.Project.Name))
+	instances, err := p.client.listInstances(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []Device
+	for i := range instances {
+		devices = append(devices, p.newInstance(&instances[i]))
+	}
+
+	return devices, nil
+}
+
+// Delete deletes the VM in whichever zone it is in, as List finds VMs in
+// every zone.
+func (p *gceProvider) Delete(ctx context.Context, name string) error {
+	instances, err := p.client.listInstances(ctx, fmt.Sprintf("name = %q", name))
+	if err != nil {
+		return err
+	}
+	for _, instance := range instances {
+		if instance.Name == name {
+			return deleteGCEInstance(ctx, p.client, path.Base(instance.Zone), name)
+		}
+	}
+	return &computeError{Code: http.StatusNotFound, Message: fmt.Sprintf("VM %s not found", name)}
+}
+
+func (p *gceProvider) Self(ctx context.Context) (Device, error) {
+	if !metadata.OnGCE() {
+		return nil, nil
+	}
+
+	name, err := metadata.GetWithContext(ctx, "instance/name")
+	if err != nil {
+		return nil, err
+	}
+
+	Log("Detected GCE VM: %s", name)
+
+	zone, err := metadata.GetWithContext(ctx, "instance/zone")
+	if err != nil {
+		return nil, err
+	}
+	project, err := metadata.GetWithContext(ctx, "project/project-id")
+	if err != nil {
+		return nil, err
+	}
+	ip, _ := metadata.GetWithContext(ctx, "instance/network-interfaces/0/access-configs/0/external-ip")
+
+	// The VM deletes itself with the token of its service account.
+	tokens := google.ComputeTokenSource("", gceScope)
+	return &GCEInstance{
+		name:   name,
+		zone:   path.Base(zone),
+		ip:     ip,
+		client: newComputeClient("", project, tokens),
+		self:   true,
+	}, nil
+}
+
+// deleteGCEInstance deletes the VM and waits for the deletion to finish.
+func deleteGCEInstance(ctx context.Context, client *computeClient, zone, name string) error {
+	op, err := client.deleteInstance(ctx, zone, name)
+	if err != nil {
+		return err
+	}
+	return client.wait(ctx, op)
+}
+
+// newInstance returns the device for a VM resource.
+func (p *gceProvider) newInstance(instance *computeInstance) *GCEInstance {
+	m := make(map[string]string)
+	if instance.Metadata != nil {
+		for _, item := range instance.Metadata.Items {
+			for _, k := range []string{tagProject, tagOwner, tagCreatedAt} {
+				if item.Key == gceMetadataKey(k) {
+					m[k] = item.Value
+				}
+			}
+		}
+	}
+	tags, _ := parseTags(m)
+
+	return &GCEInstance{
+		name:        instance.Name,
+		zone:        path.Base(instance.Zone),
+		ip:          gceExternalIP(instance),
+		machineType: path.Base(instance.MachineType),
+		status:      instance.Status,
+		tags:        tags,
+		client:      p.client,
+		config:      p.config,
+	}
+}
+
+// gceExternalIP returns the external IP address of instance, if any.
+func gceExternalIP(instance *computeInstance) string {
+	for _, nic := range instance.NetworkInterfaces {
+		for _, ac := range nic.AccessConfigs {
+			if ac.NatIP != "" {
+				return ac.NatIP
+			}
+		}
+	}
+	return ""
+}
+
+// gceInvalid matches what is not allowed in VM names and label values.
+var gceInvalid = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// gceLabelValue returns v as a valid label value.
+func gceLabelValue(v string) string {
+	v = gceInvalid.ReplaceAllString(strings.ToLower(v), "-")
+	if len(v) > 63 {
+		v = v[:63]
+	}
+	return v
+}
+
+// newDeviceName returns a unique VM name for project. Names start with a
+// letter and are at most 63 lowercase letters, digits and hyphens, which
+// GCE and Azure both accept.
+func newDeviceName(project string) string {
+	prefix := strings.Trim(gceLabelValue(project), "-")
+	if len(prefix) > 40 {
+		prefix = prefix[:40]
+	}
+	return "spt-" + prefix + "-" + strings.ToLower(fmt.Sprintf("%x", time.Now().UnixNano()))
+}
+
+// gceMetadataKey returns the metadata key a tag is stored under.
+func gceMetadataKey(tag string) string {
+	return strings.ReplaceAll(tag, ":", "-")
+}
+
+// GCE implementation
+type GCEInstance struct {
+	name        string
+	zone        string
+	ip          string
+	machineType string
+	status      string
+	tags        Tags
+	client      *computeClient
+	config      Config
+	// self is set for the VM spt runs on, which goes away before the
+	// deletion finishes.
+	self bool
+}
+
+// ID returns the VM name.
+func (c *GCEInstance) ID() string {
+	return c.name
+}
+
+func (c *GCEInstance) IP() string {
+	return c.ip
+}
+
+// Location returns the zone of the VM.
+func (c *GCEInstance) Location() string {
+	return c.zone
+}
+
+// InstanceType returns the machine type of the VM.
+func (c *GCEInstance) InstanceType() string {
+	return c.machineType
+}
+
+// State returns the VM status.
+func (c *GCEInstance) State() string {
+	return c.status
+}
+
+func (c *GCEInstance) Tags() Tags {
+	return c.tags
+}
+
+// gcePreemptedScript prints TRUE once GCE is preempting the VM.
+const gcePreemptedScript = `curl -sf -H "Metadata-Flavor: Google" http://metadata.google.internal/computeMetadata/v1/instance/preempted`
+
+// InterruptionNotice checks the VM's metadata for a preemption. GCE gives
+// 30 seconds of notice.
+func (c *GCEInstance) InterruptionNotice(ctx context.Context, output func(cmd string) ([]byte, error)) (time.Time, bool, error) {
+	out, err := output(gcePreemptedScript)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if strings.TrimSpace(string(out)) != "TRUE" {
+		return time.Time{}, false, nil
+	}
+
+	return time.Now().Add(30 * time.Second), true, nil
+}
+
+func (c *GCEInstance) Run(ctx context.Context, detach bool, args []string) (RunResult, error) {
+	return runAndDelete(ctx, "gce", c, c.config, detach, args)
+}
+
+func (c *GCEInstance) Delete(ctx context.Context) error {
+	Log("Deleting the GCE Spot VM")
+
+	if c.self {
+		Log("Self-deleting GCE VM %s", c.name)
+		if _, err := c.client.deleteInstance(ctx, c.zone, c.name); err != nil {
+			return fmt.Errorf("error deleting VM: %w", err)
+		}
+		Log("VM deletion initiated")
+		return nil
+	}
+
+	return deleteGCEInstance(ctx, c.client, c.zone, c.name)
+}
@@ -0,0 +1,50 @@
+package spt
+
+import (
+	"context"
+	"testing"
+
+	"golang.org/x/oauth2"
+
+	"github.com/littledivy/spt/internal/fake"
+)
+
+func TestGCEDeleteInOtherZone(t *testing.T) {
+	api := fake.NewGCE(nil)
+	defer api.Close()
+
+	var cfg Config
+	cfg.Project.Name = "spt-test"
+	cfg.Service.GCE.Project = "fake-project"
+	cfg.Service.GCE.Zone = "us-central1-a"
+	cfg.Service.GCE.MachineType = "c3-standard-4"
+	cfg.Service.GCE.Endpoint = api.URL
+
+	client := newComputeClient(api.URL, cfg.Service.GCE.Project, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "fake"}))
+	p := &gceProvider{client: client, config: cfg}
+
+	// A VM of the project in a zone other than the configured one.
+	ctx := context.Background()
+	name := newDeviceName(cfg.Project.Name)
+	if _, err := client.insertInstance(ctx, "europe-west1-b", p.newComputeInstance(name, "", newTags(cfg))); err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := p.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].(*GCEInstance).zone != "europe-west1-b" {
+		t.Fatalf("List() = %v, want the VM in europe-west1-b", devices)
+	}
+
+	if err := p.Delete(ctx, name); err != nil {
+		t.Fatalf("Delete() = %v", err)
+	}
+	if devices, err = p.List(ctx); err != nil || len(devices) != 0 {
+		t.Errorf("List() after Delete() = %v, %v, want no VMs", devices, err)
+	}
+	if err := p.Delete(ctx, name); !isComputeNotFound(err) {
+		t.Errorf("Delete() of a deleted VM = %v, want not found", err)
+	}
+}
@@ -0,0 +1,65 @@
+package spt
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// gceScope is the OAuth2 scope spt requests for the Compute Engine API.
+const gceScope = "https://www.googleapis.com/auth/compute"
+
+// newGCETokenSource returns the token source for credentialsFile, falling
+// back to GOOGLE_APPLICATION_CREDENTIALS, a GOOGLE_OAUTH_ACCESS_TOKEN and
+// the application default credentials, such as those of gcloud or the
+// metadata server, in that order.
+func newGCETokenSource(ctx context.Context, credentialsFile string) (oauth2.TokenSource, error) {
+	if credentialsFile == "" {
+		credentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+
+	switch {
+	case credentialsFile != "":
+		data, err := os.ReadFile(credentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		creds, err := google.CredentialsFromJSON(ctx, data, gceScope)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", credentialsFile, err)
+		}
+		return creds.TokenSource, nil
+	case os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN") != "":
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")}), nil
+	default:
+		return google.DefaultTokenSource(ctx, gceScope)
+	}
+}
+
+// lazyGCETokenSource resolves the credentials with newGCETokenSource on the
+// first API call, so that creating the provider works on machines without
+// any, e.g. to detect the current machine in NewSelfDevice.
+type lazyGCETokenSource struct {
+	credentialsFile string
+
+	mu     sync.Mutex
+	tokens oauth2.TokenSource
+}
+
+func (s *lazyGCETokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tokens == nil {
+		tokens, err := newGCETokenSource(context.Background(), s.credentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("GCE credentials: %w", err)
+		}
+		s.tokens = tokens
+	}
+	return s.tokens.Token()
+}
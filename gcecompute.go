@@ -0,0 +1,266 @@
+package spt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// DefaultGCEEndpoint is the Compute Engine API.
+const DefaultGCEEndpoint = "https://compute.googleapis.com"
+
+// computeInstance is a Compute Engine instance resource, limited to the
+// fields spt reads or sets.
+type computeInstance struct {
+	ID                string                    `json:"id,omitempty"`
+	Name              string                    `json:"name"`
+	Zone              string                    `json:"zone,omitempty"`
+	MachineType       string                    `json:"machineType"`
+	Status            string                    `json:"status,omitempty"`
+	CreationTimestamp string                    `json:"creationTimestamp,omitempty"`
+	Labels            map[string]string         `json:"labels,omitempty"`
+	Metadata          *computeMetadata          `json:"metadata,omitempty"`
+	Scheduling        *computeScheduling        `json:"scheduling,omitempty"`
+	Disks             []computeAttachedDisk     `json:"disks,omitempty"`
+	NetworkInterfaces []computeNetworkInterface `json:"networkInterfaces,omitempty"`
+	ServiceAccounts   []computeServiceAccount   `json:"serviceAccounts,omitempty"`
+}
+
+type computeMetadata struct {
+	Items []computeMetadataItem `json:"items,omitempty"`
+}
+
+type computeMetadataItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type computeScheduling struct {
+	ProvisioningModel         string           `json:"provisioningModel,omitempty"`
+	InstanceTerminationAction string           `json:"instanceTerminationAction,omitempty"`
+	OnHostMaintenance         string           `json:"onHostMaintenance,omitempty"`
+	AutomaticRestart          *bool            `json:"automaticRestart,omitempty"`
+	MaxRunDuration            *computeDuration `json:"maxRunDuration,omitempty"`
+}
+
+type computeDuration struct {
+	Seconds int64 `json:"seconds,string"`
+}
+
+type computeAttachedDisk struct {
+	Boot             bool                    `json:"boot"`
+	AutoDelete       bool                    `json:"autoDelete"`
+	InitializeParams *computeDiskInitializer `json:"initializeParams,omitempty"`
+}
+
+type computeDiskInitializer struct {
+	SourceImage string `json:"sourceImage"`
+	DiskSizeGb  int    `json:"diskSizeGb,string,omitempty"`
+}
+
+type computeNetworkInterface struct {
+	Network       string                `json:"network,omitempty"`
+	AccessConfigs []computeAccessConfig `json:"accessConfigs,omitempty"`
+}
+
+type computeAccessConfig struct {
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	NatIP string `json:"natIP,omitempty"`
+}
+
+type computeServiceAccount struct {
+	Email  string   `json:"email"`
+	Scopes []string `json:"scopes"`
+}
+
+// computeOperation is a long-running Compute Engine operation.
+type computeOperation struct {
+	Name   string `json:"name"`
+	Zone   string `json:"zone"`
+	Status string `json:"status"`
+	Error  *struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"error,omitempty"`
+}
+
+// err returns the error of a finished operation. It wraps ErrNoCapacity
+// when the zone ran out of resources.
+func (op *computeOperation) err() error {
+	if op.Error == nil || len(op.Error.Errors) == 0 {
+		return nil
+	}
+
+	var errs []error
+	exhausted := true
+	for _, e := range op.Error.Errors {
+		errs = append(errs, fmt.Errorf("%s: %s", e.Code, e.Message))
+		if !strings.HasPrefix(e.Code, "ZONE_RESOURCE_POOL_EXHAUSTED") {
+			exhausted = false
+		}
+	}
+	err := errors.Join(errs...)
+	if exhausted {
+		return fmt.Errorf("%w: %w", ErrNoCapacity, err)
+	}
+	return err
+}
+
+// computeError is an error response of the Compute Engine API.
+type computeError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *computeError) Error() string {
+	return fmt.Sprintf("compute API: %d %s", e.Code, e.Message)
+}
+
+// isComputeNotFound reports whether err is the API's not found error.
+func isComputeNotFound(err error) bool {
+	var apiErr *computeError
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// computeClient calls the Compute Engine REST API of one project.
+type computeClient struct {
+	endpoint string
+	project  string
+	// http authorizes requests with the tokens of the client's token
+	// source.
+	http *http.Client
+}
+
+func newComputeClient(endpoint, project string, tokens oauth2.TokenSource) *computeClient {
+	if endpoint == "" {
+		endpoint = DefaultGCEEndpoint
+	}
+	return &computeClient{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		project:  project,
+		http:     oauth2.NewClient(context.Background(), tokens),
+	}
+}
+
+// do sends a request for the project resource at resourcePath and decodes
+// the response into out.
+func (c *computeClient) do(ctx context.Context, method, resourcePath string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+"/compute/v1/projects/"+c.project+"/"+resourcePath, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var errResp struct {
+			Error computeError `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error.Code == 0 {
+			return &computeError{Code: resp.StatusCode, Message: resp.Status}
+		}
+		return &errResp.Error
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *computeClient) insertInstance(ctx context.Context, zone string, instance *computeInstance) (*computeOperation, error) {
+	var op computeOperation
+	err := c.do(ctx, "POST", "zones/"+zone+"/instances", instance, &op)
+	return &op, err
+}
+
+func (c *computeClient) getInstance(ctx context.Context, zone, name string) (*computeInstance, error) {
+	var instance computeInstance
+	err := c.do(ctx, "GET", "zones/"+zone+"/instances/"+name, nil, &instance)
+	return &instance, err
+}
+
+func (c *computeClient) deleteInstance(ctx context.Context, zone, name string) (*computeOperation, error) {
+	var op computeOperation
+	err := c.do(ctx, "DELETE", "zones/"+zone+"/instances/"+name, nil, &op)
+	return &op, err
+}
+
+// listInstances returns the instances matching filter in every zone.
+func (c *computeClient) listInstances(ctx context.Context, filter string) ([]computeInstance, error) {
+	var instances []computeInstance
+	pageToken := ""
+	for {
+		query := url.Values{"filter": {filter}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+
+		var page struct {
+			Items map[string]struct {
+				Instances []computeInstance `json:"instances"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := c.do(ctx, "GET", "aggregated/instances?"+query.Encode(), nil, &page); err != nil {
+			return nil, err
+		}
+
+		for _, scoped := range page.Items {
+			instances = append(instances, scoped.Instances...)
+		}
+		if page.NextPageToken == "" {
+			return instances, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// computeOperationPollInterval is how often a pending operation is checked.
+var computeOperationPollInterval = 2 * time.Second
+
+// wait polls the zonal operation op until it is done and returns its error.
+func (c *computeClient) wait(ctx context.Context, op *computeOperation) error {
+	zone := path.Base(op.Zone)
+	for op.Status != "DONE" {
+		if err := sleep(ctx, computeOperationPollInterval); err != nil {
+			return err
+		}
+
+		next := &computeOperation{}
+		if err := c.do(ctx, "GET", "zones/"+zone+"/operations/"+op.Name, nil, next); err != nil {
+			return err
+		}
+		op = next
+	}
+
+	return op.err()
+}
@@ -0,0 +1,89 @@
+package spt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// DefaultHetznerEndpoint is the Hetzner Cloud API.
+const DefaultHetznerEndpoint = hcloud.Endpoint
+
+// newHcloudClient returns a client of the Hetzner Cloud API of the project
+// token belongs to.
+func newHcloudClient(endpoint, token string) *hcloud.Client {
+	if endpoint == "" {
+		endpoint = DefaultHetznerEndpoint
+	}
+	return hcloud.NewClient(
+		hcloud.WithEndpoint(strings.TrimSuffix(endpoint, "/")),
+		hcloud.WithToken(token),
+		hcloud.WithApplication("spt", ""),
+	)
+}
+
+// isHetznerNotFound reports whether err is the API's not found error.
+func isHetznerNotFound(err error) bool {
+	return hcloud.IsError(err, hcloud.ErrorCodeNotFound)
+}
+
+// hcloudServerIP returns the public IPv4 address of the server, if any.
+func hcloudServerIP(server *hcloud.Server) string {
+	if server.PublicNet.IPv4.IsUnspecified() {
+		return ""
+	}
+	return server.PublicNet.IPv4.IP.String()
+}
+
+// hcloudSSHKeys looks up the SSH keys of the project by name.
+func hcloudSSHKeys(ctx context.Context, client *hcloud.Client, names []string) ([]*hcloud.SSHKey, error) {
+	var keys []*hcloud.SSHKey
+	for _, name := range names {
+		key, _, err := client.SSHKey.GetByName(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			return nil, fmt.Errorf("Hetzner Cloud SSH key %q not found", name)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// hetznerMetadataURL is the base URL of the Hetzner Cloud metadata service.
+const hetznerMetadataURL = "http://169.254.169.254/hetzner/v1/metadata/"
+
+// errNotHetzner is returned by fetchHetznerMetadata off Hetzner Cloud.
+var errNotHetzner = errors.New("not running on Hetzner Cloud")
+
+// fetchHetznerMetadata returns the metadata value at path.
+func fetchHetznerMetadata(ctx context.Context, path string) (string, error) {
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", hetznerMetadataURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errNotHetzner
+	}
+	defer resp.Body.Close()
+
+	// Other clouds answer on the link-local address too.
+	if resp.StatusCode != 200 {
+		return "", errNotHetzner
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	return strings.TrimSpace(string(body)), err
+}
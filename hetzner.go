@@ -0,0 +1,454 @@
+package spt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// DefaultHetznerImage is the image of Hetzner Cloud servers when `image` is
+// not set.
+const DefaultHetznerImage = "ubuntu-22.04"
+
+// Label keys of Hetzner Cloud servers. Label values are restricted to
+// letters, digits and -_., so the project and owner are sanitized and the
+// creation time is taken from the server itself.
+const (
+	hetznerLabelProject = "spt-project"
+	hetznerLabelOwner   = "spt-owner"
+)
+
+// Hetzner Cloud provider
+type hetznerProvider struct {
+	client *hcloud.Client
+	config Config
+}
+
+func NewHetznerProvider(cfg Config) (Provider, error) {
+	hetzner := cfg.Service.Hetzner
+	return &hetznerProvider{client: newHcloudClient(hetzner.Endpoint, hetzner.Token), config: cfg}, nil
+}
+
+// endpoint returns the API URL servers delete themselves with.
+func (p *hetznerProvider) endpoint() string {
+	if endpoint := p.config.Service.Hetzner.Endpoint; endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/")
+	}
+	return DefaultHetznerEndpoint
+}
+
+func (p *hetznerProvider) Name() string {
+	return "hetzner"
+}
+
+func (p *hetznerProvider) Provision(ctx context.Context) (Device, error) {
+	config := p.config
+	hetzner := config.Service.Hetzner
+
+	emit(Event{
+		Type:         EventProvisionRequested,
+		Provider:     p.Name(),
+		Location:     hetzner.Location,
+		InstanceType: hetzner.ServerType,
+		Message:      fmt.Sprintf("Provisioning Hetzner Cloud server in %s", hetzner.Location),
+	})
+
+	hostKey, err := newHostKey()
+	if err != nil {
+		return nil, err
+	}
+	loginKey, err := newDeviceKey()
+	if err != nil {
+		return nil, err
+	}
+
+	script := hetznerLoginUser(loginKey.authorize(hostKey.install(p.userScript())))
+
+	sshKeys, err := hcloudSSHKeys(ctx, p.client, hetzner.SSHKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	image := hetzner.Image
+	if image == "" {
+		image = DefaultHetznerImage
+	}
+	tags := newTags(config)
+	opts := hcloud.ServerCreateOpts{
+		Name:       newDeviceName(config.Project.Name),
+		ServerType: &hcloud.ServerType{Name: hetzner.ServerType},
+		Image:      &hcloud.Image{Name: image},
+		UserData:   script,
+		Labels: map[string]string{
+			hetznerLabelProject: hetznerLabelValue(tags.Project),
+			hetznerLabelOwner:   hetznerLabelValue(tags.Owner),
+		},
+		SSHKeys: sshKeys,
+	}
+	if hetzner.Location != "" {
+		opts.Location = &hcloud.Location{Name: hetzner.Location}
+	}
+	result, _, err := p.client.Server.Create(ctx, opts)
+	if hcloud.IsError(err, hcloud.ErrorCodeResourceUnavailable) {
+		// The server type is sold out in the location.
+		return nil, fmt.Errorf("%w: %w", ErrNoCapacity, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	server := result.Server
+	id := strconv.FormatInt(server.ID, 10)
+
+	emit(Event{
+		Type:     EventSpotRequestCreated,
+		Provider: p.Name(),
+		DeviceID: id,
+		Message:  fmt.Sprintf("Server %s created, waiting for it to be ready", id),
+	})
+
+	return finishProvisioning(ctx, id,
+		func(ctx context.Context) (Device, error) { return p.waitRunning(ctx, server) },
+		func(ctx context.Context) error {
+			if _, _, err := p.client.Server.DeleteWithResult(ctx, server); err != nil && !isHetznerNotFound(err) {
+				return err
+			}
+			return nil
+		},
+		hostKey, loginKey, config)
+}
+
+// userScript returns the user-data script of a new server. The API token is
+// only written to the server with self_delete, as Hetzner Cloud has no
+// instance credentials.
+func (p *hetznerProvider) userScript() string {
+	hetzner := p.config.Service.Hetzner
+	ttl := p.config.Run.MaxDuration
+
+	script := userScript
+	switch {
+	case hetzner.SelfDelete:
+		Log("Warning: self_delete is enabled, embedding the API token in user-data for self-deletion")
+		credentials := hetznerCredentialsScript(p.endpoint(), hetzner.Token)
+		if ttl > 0 {
+			// The watchdog reads the credentials when it fires.
+			script = armTTL(script, credentials+hetznerTTLScript(ttl))
+			Log("Server will be deleted after %s", ttl)
+		} else {
+			script += credentials
+		}
+	case ttl > 0:
+		Log("Warning: self_delete is disabled, the server cannot delete itself after %s", ttl)
+	default:
+		Log("Warning: self_delete is disabled, `spt self --delete` will not work on the server")
+	}
+
+	return script + readyScript
+}
+
+// waitRunning waits until the new server is running with a public IPv4
+// address.
+func (p *hetznerProvider) waitRunning(ctx context.Context, server *hcloud.Server) (Device, error) {
+	id := strconv.FormatInt(server.ID, 10)
+
+	for server.Status != hcloud.ServerStatusRunning || hcloudServerIP(server) == "" {
+		if err := sleep(ctx, runningPollInterval); err != nil {
+			return nil, err
+		}
+
+		var err error
+		server, _, err = p.client.Server.GetByID(ctx, server.ID)
+		if err != nil {
+			return nil, err
+		}
+		if server == nil {
+			return nil, fmt.Errorf("server %s was deleted while starting", id)
+		}
+		if server.Status == hcloud.ServerStatusOff {
+			return nil, fmt.Errorf("server %s stopped while starting", id)
+		}
+	}
+
+	device := p.newServer(server)
+	emit(Event{
+		Type:         EventInstanceRunning,
+		Provider:     p.Name(),
+		DeviceID:     id,
+		IP:           device.ip,
+		Location:     device.location,
+		InstanceType: device.serverType,
+		Message:      fmt.Sprintf("Server is running at IP %s", device.ip),
+	})
+	return device, nil
+}
+
+func (p *hetznerProvider) Attach(ctx context.Context, id string) (Device, error) {
+	serverID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Hetzner Cloud server ID %q", id)
+	}
+
+	server, _, err := p.client.Server.GetByID(ctx, serverID)
+	if err != nil {
+		return nil, err
+	}
+	if server == nil {
+		return nil, fmt.Errorf("Hetzner Cloud server %s not found", id)
+	}
+
+	if server.Status != hcloud.ServerStatusRunning {
+		return nil, fmt.Errorf("Hetzner Cloud server %s is not running (status: %s)", id, server.Status)
+	}
+	ip := hcloudServerIP(server)
+	if ip == "" {
+		return nil, fmt.Errorf("Hetzner Cloud server %s has no public IPv4 address", id)
+	}
+
+	Log("Attached to Hetzner Cloud server %s at IP %s", id, ip)
+	return p.newServer(server), nil
+}
+
+// List returns the servers labeled with the configured project.
+func (p *hetznerProvider) List(ctx context.Context) ([]Device, error) {
+	servers, err := p.client.Server.AllWithOpts(ctx, hcloud.ServerListOpts{
+		ListOpts: hcloud.ListOpts{LabelSelector: hetznerLabelProject + "==" + hetznerLabelValue(p.config.Project.Name)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []Device
+	for _, server := range servers {
+		devices = append(devices, p.newServer(server))
+	}
+
+	return devices, nil
+}
+
+func (p *hetznerProvider) Delete(ctx context.Context, id string) error {
+	serverID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid Hetzner Cloud server ID %q", id)
+	}
+	return deleteHcloudServer(ctx, p.client, serverID)
+}
+
+// deleteHcloudServer deletes the server with the given ID.
+func deleteHcloudServer(ctx context.Context, client *hcloud.Client, id int64) error {
+	_, _, err := client.Server.DeleteWithResult(ctx, &hcloud.Server{ID: id})
+	return err
+}
+
+func (p *hetznerProvider) Self(ctx context.Context) (Device, error) {
+	id, err := fetchHetznerMetadata(ctx, "instance-id")
+	if err != nil {
+		return nil, nil
+	}
+	serverID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+
+	Log("Detected Hetzner Cloud server: %s", id)
+
+	ip, _ := fetchHetznerMetadata(ctx, "public-ipv4")
+	// The availability zone is the datacenter, e.g. fsn1-dc14.
+	zone, _ := fetchHetznerMetadata(ctx, "availability-zone")
+	location, _, _ := strings.Cut(zone, "-")
+
+	return &HetznerServer{
+		id:       serverID,
+		ip:       ip,
+		location: location,
+		self:     true,
+	}, nil
+}
+
+// newServer returns the device for a server.
+func (p *hetznerProvider) newServer(server *hcloud.Server) *HetznerServer {
+	tags := Tags{
+		Project:   server.Labels[hetznerLabelProject],
+		Owner:     server.Labels[hetznerLabelOwner],
+		CreatedAt: server.Created,
+	}
+	// Restore what sanitizing the labels took away where possible.
+	if tags.Project == hetznerLabelValue(p.config.Project.Name) {
+		tags.Project = p.config.Project.Name
+	}
+	if owner := Owner(p.config); tags.Owner == hetznerLabelValue(owner) {
+		tags.Owner = owner
+	}
+
+	var location, serverType string
+	if server.Datacenter != nil && server.Datacenter.Location != nil {
+		location = server.Datacenter.Location.Name
+	}
+	if server.ServerType != nil {
+		serverType = server.ServerType.Name
+	}
+
+	return &HetznerServer{
+		id:         server.ID,
+		ip:         hcloudServerIP(server),
+		location:   location,
+		serverType: serverType,
+		status:     string(server.Status),
+		tags:       tags,
+		client:     p.client,
+		config:     p.config,
+	}
+}
+
+// hetznerInvalid matches what is not allowed in label values.
+var hetznerInvalid = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// hetznerLabelValue returns v as a valid label value: at most 63 letters,
+// digits and -_. starting and ending with a letter or digit.
+func hetznerLabelValue(v string) string {
+	v = hetznerInvalid.ReplaceAllString(v, "-")
+	if len(v) > 63 {
+		v = v[:63]
+	}
+	return strings.Trim(v, "-_.")
+}
+
+// hetznerLoginUser returns script with the login user created right after
+// the interpreter line. Hetzner's images only have root.
+func hetznerLoginUser(script string) string {
+	shebang, rest, _ := strings.Cut(script, "\n")
+	return shebang + `
+# Login user
+id -u ` + sshUser + ` >/dev/null 2>&1 || useradd -m -s /bin/bash -G sudo ` + sshUser + `
+echo '` + sshUser + ` ALL=(ALL) NOPASSWD:ALL' > /etc/sudoers.d/90-spt
+chmod 440 /etc/sudoers.d/90-spt
+` + rest
+}
+
+// hetznerCredentialsScript writes the API token for self-deletion to
+// hetznerCredentialsFile.
+func hetznerCredentialsScript(endpoint, token string) string {
+	return `
+# Hetzner Cloud credentials for self-deletion
+mkdir -p /opt/spt
+cat > ` + hetznerCredentialsFile + ` << 'EOL'
+{
+  "endpoint": "` + endpoint + `",
+  "token": "` + token + `"
+}
+EOL
+chmod 600 ` + hetznerCredentialsFile + `
+`
+}
+
+// hetznerTTLScript deletes the server once ttl expires. Powering off would
+// leave a server that is still billed.
+func hetznerTTLScript(ttl time.Duration) string {
+	return fmt.Sprintf(`
+# Delete the server when the time-to-live expires
+cat > /opt/spt/ttl << 'EOL'
+#!/bin/sh
+endpoint=$(sed -n 's/.*"endpoint": "\(.*\)".*/\1/p' %[1]s)
+token=$(sed -n 's/.*"token": "\(.*\)".*/\1/p' %[1]s)
+id=$(curl -sf %[2]sinstance-id)
+curl -sf -X DELETE -H "Authorization: Bearer $token" "$endpoint/servers/$id"
+EOL
+chmod 700 /opt/spt/ttl
+systemd-run --unit=spt-ttl --on-active=%[3]ds /opt/spt/ttl
+`, hetznerCredentialsFile, hetznerMetadataURL, int(ttl.Seconds()))
+}
+
+// hetznerCredentialsFile is where servers keep the API token used for
+// self-deletion. Hetzner Cloud has no instance credentials.
+const hetznerCredentialsFile = "/opt/spt/hetzner-credentials.json"
+
+// selfHetznerClient returns an API client for use from inside a server.
+func selfHetznerClient() (*hcloud.Client, error) {
+	data, err := os.ReadFile(hetznerCredentialsFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		Log("If running in Docker, make sure to mount /opt/spt from host")
+		return nil, fmt.Errorf("no Hetzner Cloud credentials on the server, provision it with self_delete = true: %w", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading Hetzner Cloud credentials: %w", err)
+	}
+
+	var creds struct {
+		Endpoint string `json:"endpoint"`
+		Token    string `json:"token"`
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("error parsing Hetzner Cloud credentials: %w", err)
+	}
+
+	return newHcloudClient(creds.Endpoint, creds.Token), nil
+}
+
+// Hetzner Cloud implementation
+type HetznerServer struct {
+	id         int64
+	ip         string
+	location   string
+	serverType string
+	status     string
+	tags       Tags
+	client     *hcloud.Client
+	config     Config
+	// self is set for the server spt runs on, which reads its API token
+	// from hetznerCredentialsFile.
+	self bool
+}
+
+// ID returns the server ID.
+func (c *HetznerServer) ID() string {
+	return strconv.FormatInt(c.id, 10)
+}
+
+func (c *HetznerServer) IP() string {
+	return c.ip
+}
+
+// Location returns the location of the server, e.g. fsn1.
+func (c *HetznerServer) Location() string {
+	return c.location
+}
+
+// InstanceType returns the server type.
+func (c *HetznerServer) InstanceType() string {
+	return c.serverType
+}
+
+// State returns the server status.
+func (c *HetznerServer) State() string {
+	return c.status
+}
+
+func (c *HetznerServer) Tags() Tags {
+	return c.tags
+}
+
+func (c *HetznerServer) Run(ctx context.Context, detach bool, args []string) (RunResult, error) {
+	return runAndDelete(ctx, "hetzner", c, c.config, detach, args)
+}
+
+func (c *HetznerServer) Delete(ctx context.Context) error {
+	Log("Deleting the Hetzner Cloud server")
+
+	client := c.client
+	if c.self {
+		Log("Self-deleting Hetzner Cloud server %d", c.id)
+		var err error
+		if client, err = selfHetznerClient(); err != nil {
+			return err
+		}
+	}
+
+	return deleteHcloudServer(ctx, client, c.id)
+}
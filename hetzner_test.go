@@ -0,0 +1,105 @@
+package spt
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+
+	"github.com/littledivy/spt/internal/fake"
+)
+
+func TestHetznerUserScript(t *testing.T) {
+	tests := []struct {
+		name         string
+		selfDelete   bool
+		ttl          time.Duration
+		wantToken    bool
+		wantWatchdog bool
+	}{
+		{"default", false, 0, false, false},
+		{"default with ttl", false, time.Hour, false, false},
+		{"self_delete", true, 0, true, false},
+		{"self_delete with ttl", true, time.Hour, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg Config
+			cfg.Service.Hetzner.Token = "hcloud-secret-token"
+			cfg.Service.Hetzner.SelfDelete = tt.selfDelete
+			cfg.Run.MaxDuration = tt.ttl
+			p := &hetznerProvider{config: cfg}
+
+			script := p.userScript()
+			if got := strings.Contains(script, cfg.Service.Hetzner.Token); got != tt.wantToken {
+				t.Errorf("script contains the token = %v, want %v:\n%s", got, tt.wantToken, script)
+			}
+			if got := strings.Contains(script, "systemd-run --unit=spt-ttl"); got != tt.wantWatchdog {
+				t.Errorf("script has a watchdog = %v, want %v:\n%s", got, tt.wantWatchdog, script)
+			}
+		})
+	}
+}
+
+func TestHetznerListAttachDelete(t *testing.T) {
+	api := fake.NewHetzner(nil)
+	defer api.Close()
+
+	var cfg Config
+	cfg.Project.Name = "spt-test"
+	cfg.Service.Hetzner.Token = "fake"
+	cfg.Service.Hetzner.ServerType = "ccx33"
+	cfg.Service.Hetzner.Location = "fsn1"
+	cfg.Service.Hetzner.Endpoint = api.URL
+	provider, err := NewHetznerProvider(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := provider.(*hetznerProvider)
+
+	ctx := context.Background()
+	result, _, err := p.client.Server.Create(ctx, hcloud.ServerCreateOpts{
+		Name:       newDeviceName(cfg.Project.Name),
+		ServerType: &hcloud.ServerType{Name: cfg.Service.Hetzner.ServerType},
+		Image:      &hcloud.Image{Name: DefaultHetznerImage},
+		Location:   &hcloud.Location{Name: cfg.Service.Hetzner.Location},
+		Labels:     map[string]string{hetznerLabelProject: hetznerLabelValue(cfg.Project.Name)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := p.newServer(result.Server).ID()
+
+	// The fake server moves on by one status per request.
+	var device Device
+	for i := 0; i < 3 && device == nil; i++ {
+		device, err = p.Attach(ctx, id)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.IP() == "" || device.(*HetznerServer).location != "fsn1" {
+		t.Errorf("Attach() = %+v, want a server in fsn1 with an IP address", device)
+	}
+
+	devices, err := p.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].ID() != id {
+		t.Fatalf("List() = %v, want server %s", devices, id)
+	}
+
+	if err := p.Delete(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if devices, err := p.List(ctx); err != nil || len(devices) != 0 {
+		t.Errorf("List() after Delete = %v, %v, want none", devices, err)
+	}
+	if err := p.Delete(ctx, id); !isHetznerNotFound(err) {
+		t.Errorf("second Delete() = %v, want not found", err)
+	}
+}
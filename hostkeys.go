@@ -0,0 +1,152 @@
+package spt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// hostKey is an SSH host key generated locally and installed on a device
+// through its user-data, so that the device can be authenticated on first
+// connect without trusting the network.
+type hostKey struct {
+	private []byte
+	public  ssh.PublicKey
+}
+
+func newHostKey() (*hostKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		return nil, err
+	}
+
+	public, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hostKey{private: pem.EncodeToMemory(block), public: public}, nil
+}
+
+// install returns script with the host key installed right after the
+// interpreter line, before the slower setup steps run. Other host keys are
+// removed so that sshd only offers the pinned one.
+func (k *hostKey) install(script string) string {
+	shebang, rest, _ := strings.Cut(script, "\n")
+	return shebang + `
+# Pinned SSH host key
+rm -f /etc/ssh/ssh_host_*
+cat > /etc/ssh/ssh_host_ed25519_key << 'EOL'
+` + string(k.private) + `EOL
+chmod 600 /etc/ssh/ssh_host_ed25519_key
+echo '` + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k.public))) + `' > /etc/ssh/ssh_host_ed25519_key.pub
+systemctl restart ssh
+` + rest
+}
+
+// KnownHostsPath returns the known_hosts file in which spt pins the host keys
+// of its devices. It lives next to the state file.
+func KnownHostsPath() (string, error) {
+	path, err := StatePath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(path), "known_hosts"), nil
+}
+
+// pinHostKey records key as the only accepted host key of the device id at
+// ipAddr, replacing entries left behind for the same device or address.
+func pinHostKey(id, ipAddr string, key ssh.PublicKey) error {
+	host := knownhosts.Normalize(ipAddr)
+	line := knownhosts.Line([]string{host}, key) + " " + id
+	return updateKnownHosts(func(fields []string) bool {
+		return fields[0] == host || fields[len(fields)-1] == id
+	}, line)
+}
+
+// unpinHostKey removes the host key entries of the device id.
+func unpinHostKey(id string) error {
+	return updateKnownHosts(func(fields []string) bool {
+		return fields[len(fields)-1] == id
+	}, "")
+}
+
+// updateKnownHosts rewrites spt's known_hosts file without the entries for
+// which drop returns true, and with line appended when it is not empty.
+func updateKnownHosts(drop func(fields []string) bool, line string) error {
+	path, err := KnownHostsPath()
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && drop(fields) {
+			continue
+		}
+		out.WriteString(scanner.Text() + "\n")
+	}
+	if line != "" {
+		out.WriteString(line + "\n")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, out.Bytes(), 0o600)
+}
+
+// hostKeyCallback verifies devices against spt's known_hosts file.
+func hostKeyCallback() (ssh.HostKeyCallback, error) {
+	path, err := KnownHostsPath()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return &knownhosts.KeyError{}
+		}, nil
+	}
+
+	return knownhosts.New(path)
+}
+
+// unknownHost reports whether err is a connection failure because no host
+// key is pinned for the device, as opposed to a mismatching key.
+func unknownHost(err error) bool {
+	var keyErr *knownhosts.KeyError
+	return errors.As(err, &keyErr) && len(keyErr.Want) == 0
+}
+
+// hostKeyError describes a failed host key verification.
+func hostKeyError(ipAddr string, err error) error {
+	if unknownHost(err) {
+		return fmt.Errorf("no host key pinned for %s, the device was not provisioned from this machine: %w", ipAddr, err)
+	}
+	return fmt.Errorf("host key verification failed for %s: %w", ipAddr, err)
+}
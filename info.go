@@ -0,0 +1,62 @@
+package spt
+
+import (
+	"context"
+)
+
+// DeviceInfo is the machine-readable description of a device printed by
+// `--output json`. Fields that are unknown are left empty.
+type DeviceInfo struct {
+	ID       string `json:"id"`
+	Provider string `json:"provider"`
+	IP       string `json:"ip"`
+	// Location is the region or metro of the device.
+	Location     string `json:"location"`
+	InstanceType string `json:"instance_type"`
+	// Price is the current hourly spot price, zero for on-demand devices.
+	Price float64 `json:"price"`
+	State string  `json:"state"`
+}
+
+// Describe returns the description of device, a device managed by c. The
+// price is looked up from the provider and left zero when that fails.
+func (c *Client) Describe(ctx context.Context, device Device) DeviceInfo {
+	if t, ok := device.(*trackedDevice); ok {
+		device = t.Device
+	}
+
+	info := DeviceInfo{
+		ID:       device.ID(),
+		Provider: c.provider.Name(),
+		IP:       device.IP(),
+	}
+	if d, ok := device.(interface{ Location() string }); ok {
+		info.Location = d.Location()
+	}
+	if d, ok := device.(interface{ InstanceType() string }); ok {
+		info.InstanceType = d.InstanceType()
+	}
+	if d, ok := device.(interface{ State() string }); ok {
+		info.State = d.State()
+	}
+	if d, ok := device.(interface {
+		Price(context.Context) (float64, error)
+	}); ok {
+		if price, err := d.Price(ctx); err == nil {
+			info.Price = price
+		}
+	}
+
+	return info
+}
+
+// Info returns the description of the recorded device as known locally,
+// without its price and state.
+func (r DeviceRecord) Info() DeviceInfo {
+	return DeviceInfo{
+		ID:       r.ID,
+		Provider: r.Provider,
+		IP:       r.IP,
+		Location: r.Location,
+	}
+}
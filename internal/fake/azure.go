@@ -0,0 +1,340 @@
+package fake
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Azure is a fake Azure Resource Manager API. It serves the virtual machine
+// and public IP address endpoints spt uses and accepts any bearer token.
+// Point spt at it with `service.azure.endpoint`, without a client secret and
+// with the `az` of WriteAzureCLI on PATH.
+type Azure struct {
+	// URL is the endpoint to configure as `service.azure.endpoint`.
+	URL string
+
+	server *httptest.Server
+	target Target
+
+	mu      sync.Mutex
+	failure Failure
+	vms     map[string]*azureVM
+}
+
+type azureVM struct {
+	subscription  string
+	resourceGroup string
+	// resource is the VM as created, with the properties spt sets.
+	resource map[string]interface{}
+	spot     bool
+	state    string
+	ip       string
+}
+
+// NewAzure starts a fake Azure API whose VMs are backed by target, which may
+// be nil.
+func NewAzure(target Target) *Azure {
+	f := &Azure{
+		target: target,
+		vms:    map[string]*azureVM{},
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	f.URL = f.server.URL
+	return f
+}
+
+// Close shuts the API down.
+func (f *Azure) Close() {
+	f.server.Close()
+}
+
+// SetFailure makes the following Spot VM requests fail with failure.
+func (f *Azure) SetFailure(failure Failure) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failure = failure
+}
+
+// Reclaim evicts the VM, which is deleted as its eviction policy is Delete.
+func (f *Azure) Reclaim(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.vms, name)
+}
+
+func (f *Azure) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		azureError(w, http.StatusUnauthorized, "AuthenticationFailed", "Authentication failed. The 'Authorization' header is missing.")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// /subscriptions/{subscription}/resourceGroups/{group}/providers/{namespace}/{type}[/{name}]
+	if len(parts) < 7 || parts[0] != "subscriptions" || parts[2] != "resourceGroups" || parts[4] != "providers" {
+		azureError(w, http.StatusNotFound, "NotFound", "Not found")
+		return
+	}
+	subscription, group, resource := parts[1], parts[3], strings.Join(parts[5:7], "/")
+
+	switch {
+	case resource == "Microsoft.Compute/virtualMachines" && len(parts) == 7 && r.Method == "GET":
+		f.listVMs(w, subscription, group)
+	case resource == "Microsoft.Compute/virtualMachines" && len(parts) == 8 && r.Method == "PUT":
+		f.createVM(w, r, subscription, group, parts[7])
+	case resource == "Microsoft.Compute/virtualMachines" && len(parts) == 8 && r.Method == "GET":
+		f.getVM(w, subscription, group, parts[7])
+	case resource == "Microsoft.Compute/virtualMachines" && len(parts) == 8 && r.Method == "DELETE":
+		f.deleteVM(w, subscription, group, parts[7])
+	case resource == "Microsoft.Network/publicIPAddresses" && len(parts) == 8 && r.Method == "GET":
+		f.getPublicIP(w, subscription, group, parts[7])
+	default:
+		azureError(w, http.StatusNotFound, "NotFound", "Not found")
+	}
+}
+
+// WriteAzureCLI writes an `az` to dir that hands out access tokens for the
+// fake, standing in for the Azure CLI login spt's default credential uses.
+func WriteAzureCLI(dir string) error {
+	expiry := time.Now().Add(time.Hour)
+	token, err := json.Marshal(map[string]interface{}{
+		"accessToken": randomID(16),
+		"tokenType":   "Bearer",
+		"expiresOn":   expiry.Format("2006-01-02 15:04:05.000000"),
+		"expires_on":  expiry.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	script := fmt.Sprintf("#!/bin/sh\ncat << 'EOF'\n%s\nEOF\n", token)
+	return os.WriteFile(filepath.Join(dir, "az"), []byte(script), 0o755)
+}
+
+func (f *Azure) createVM(w http.ResponseWriter, r *http.Request, subscription, group, name string) {
+	var resource map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&resource); err != nil {
+		azureError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+		return
+	}
+	if _, ok := f.vms[name]; ok {
+		azureError(w, http.StatusConflict, "PropertyChangeNotAllowed", "Updating VMs is not supported by the fake")
+		return
+	}
+
+	properties, _ := resource["properties"].(map[string]interface{})
+	spot := properties["priority"] == "Spot"
+	failure := f.failure
+	if !spot {
+		failure = NoFailure
+	}
+
+	location, _ := resource["location"].(string)
+	switch failure {
+	case NoCapacity:
+		azureError(w, http.StatusConflict, "SkuNotAvailable", fmt.Sprintf("The requested VM size is currently not available in location '%s' for Spot VMs.", location))
+		return
+	case PriceTooLow:
+		azureError(w, http.StatusConflict, "OperationNotAllowed", "Unable to perform operation as the maximum price is lower than the current Spot price.")
+		return
+	}
+
+	if f.target != nil && failure == NoFailure {
+		osProfile, _ := properties["osProfile"].(map[string]interface{})
+		customData, _ := osProfile["customData"].(string)
+		userData, err := base64.StdEncoding.DecodeString(customData)
+		if err != nil {
+			azureError(w, http.StatusBadRequest, "InvalidParameter", "customData is not base64 encoded")
+			return
+		}
+		if err := f.target.Boot(r.Context(), string(userData)); err != nil {
+			azureError(w, http.StatusInternalServerError, "InternalServerError", err.Error())
+			return
+		}
+	}
+
+	resource["id"] = "/subscriptions/" + subscription + "/resourceGroups/" + group + "/providers/Microsoft.Compute/virtualMachines/" + name
+	resource["name"] = name
+	properties["timeCreated"] = time.Now().UTC().Format(time.RFC3339)
+	// ARM never returns the custom data of a VM.
+	if osProfile, ok := properties["osProfile"].(map[string]interface{}); ok {
+		delete(osProfile, "customData")
+	}
+
+	vm := &azureVM{subscription: subscription, resourceGroup: group, resource: resource, spot: spot, state: "Creating"}
+	f.vms[name] = vm
+	azureReply(w, http.StatusCreated, vm.view(false))
+}
+
+func (f *Azure) getVM(w http.ResponseWriter, subscription, group, name string) {
+	vm, ok := f.vm(subscription, group, name)
+	if !ok {
+		azureNotFound(w, "Microsoft.Compute/virtualMachines", name, group)
+		return
+	}
+
+	if !f.advance(vm) {
+		delete(f.vms, name)
+		azureNotFound(w, "Microsoft.Compute/virtualMachines", name, group)
+		return
+	}
+
+	azureReply(w, http.StatusOK, vm.view(true))
+}
+
+// advance moves a new VM on by one state per call, from creating to
+// succeeded, or as the configured failure dictates for a Spot VM. It
+// reports false when the VM was evicted.
+func (f *Azure) advance(vm *azureVM) bool {
+	failure := f.failure
+	if !vm.spot {
+		failure = NoFailure
+	}
+
+	if vm.state == "Creating" {
+		switch failure {
+		case Reclaimed:
+			return false
+		case ProvisionFailed:
+			vm.state = "Failed"
+		default:
+			vm.state = "Succeeded"
+			vm.ip = deviceAddr(f.target)
+		}
+	}
+
+	return true
+}
+
+func (f *Azure) listVMs(w http.ResponseWriter, subscription, group string) {
+	vms := []map[string]interface{}{}
+	for _, vm := range f.vms {
+		if vm.subscription == subscription && strings.EqualFold(vm.resourceGroup, group) {
+			vms = append(vms, vm.view(false))
+		}
+	}
+	azureReply(w, http.StatusOK, map[string]interface{}{"value": vms})
+}
+
+func (f *Azure) deleteVM(w http.ResponseWriter, subscription, group, name string) {
+	if _, ok := f.vm(subscription, group, name); !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	// The VM is gone at once, so there is no operation to poll.
+	delete(f.vms, name)
+	w.WriteHeader(http.StatusOK)
+}
+
+// getPublicIP serves the public IP address created with a VM, named after
+// the public IP configuration of its network interface.
+func (f *Azure) getPublicIP(w http.ResponseWriter, subscription, group, name string) {
+	for _, vm := range f.vms {
+		if vm.subscription != subscription || !strings.EqualFold(vm.resourceGroup, group) || vm.publicIPName() != name {
+			continue
+		}
+		properties := map[string]interface{}{"publicIPAllocationMethod": "Static", "provisioningState": vm.state}
+		if vm.ip != "" {
+			properties["ipAddress"] = vm.ip
+		}
+		azureReply(w, http.StatusOK, map[string]interface{}{"name": name, "properties": properties})
+		return
+	}
+	azureNotFound(w, "Microsoft.Network/publicIPAddresses", name, group)
+}
+
+// vm returns the VM name in the resource group of subscription.
+func (f *Azure) vm(subscription, group, name string) (*azureVM, bool) {
+	vm, ok := f.vms[name]
+	if !ok || vm.subscription != subscription || !strings.EqualFold(vm.resourceGroup, group) {
+		return nil, false
+	}
+	return vm, true
+}
+
+// view returns the VM resource as the API returns it, with the instance
+// view if requested.
+func (vm *azureVM) view(instanceView bool) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for k, v := range vm.resource["properties"].(map[string]interface{}) {
+		properties[k] = v
+	}
+	properties["provisioningState"] = vm.state
+	if instanceView {
+		power := "PowerState/starting"
+		if vm.state == "Succeeded" {
+			power = "PowerState/running"
+		}
+		properties["instanceView"] = map[string]interface{}{
+			"statuses": []map[string]string{
+				{"code": "ProvisioningState/" + strings.ToLower(vm.state)},
+				{"code": power},
+			},
+		}
+	}
+
+	resource := map[string]interface{}{}
+	for k, v := range vm.resource {
+		resource[k] = v
+	}
+	resource["properties"] = properties
+	return resource
+}
+
+// publicIPName returns the name of the VM's public IP address.
+func (vm *azureVM) publicIPName() string {
+	var profile struct {
+		Properties struct {
+			NetworkProfile struct {
+				NetworkInterfaceConfigurations []struct {
+					Properties struct {
+						IPConfigurations []struct {
+							Properties struct {
+								PublicIPAddressConfiguration struct {
+									Name string `json:"name"`
+								} `json:"publicIPAddressConfiguration"`
+							} `json:"properties"`
+						} `json:"ipConfigurations"`
+					} `json:"properties"`
+				} `json:"networkInterfaceConfigurations"`
+			} `json:"networkProfile"`
+		} `json:"properties"`
+	}
+	data, _ := json.Marshal(vm.resource)
+	json.Unmarshal(data, &profile)
+
+	for _, nic := range profile.Properties.NetworkProfile.NetworkInterfaceConfigurations {
+		for _, ipConfig := range nic.Properties.IPConfigurations {
+			if name := ipConfig.Properties.PublicIPAddressConfiguration.Name; name != "" {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+func azureReply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func azureError(w http.ResponseWriter, status int, code, message string) {
+	azureReply(w, status, map[string]interface{}{
+		"error": map[string]string{"code": code, "message": message},
+	})
+}
+
+func azureNotFound(w http.ResponseWriter, resourceType, name, group string) {
+	azureError(w, http.StatusNotFound, "ResourceNotFound", fmt.Sprintf("The Resource '%s/%s' under resource group '%s' was not found.", resourceType, name, group))
+}
@@ -0,0 +1,135 @@
+package fake
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+//go:embed target
+var targetFiles embed.FS
+
+// TargetImage is the image the Docker target runs.
+const TargetImage = "spt-fake-target"
+
+// DockerTarget is a Target running as a local Docker container with sshd and
+// a Docker daemon of its own. The image installs its packages when it is
+// built, which needs network access once; the target itself needs none. To
+// prepare a machine without network access, build the image elsewhere and
+// copy it over:
+//
+//	docker save spt-fake-target | ssh laptop docker load
+type DockerTarget struct {
+	container string
+	addr      string
+}
+
+// StartDockerTarget starts a container from the target image, building the
+// image first unless it exists, and publishes its SSH port on the loopback
+// interface. Remove the image to rebuild it after changing the target. The
+// container runs privileged for its Docker daemon.
+func StartDockerTarget(ctx context.Context) (*DockerTarget, error) {
+	if _, err := docker(ctx, nil, "image", "inspect", TargetImage); err != nil {
+		if err := buildTargetImage(ctx); err != nil {
+			return nil, fmt.Errorf("building target image: %w", err)
+		}
+	}
+
+	out, err := docker(ctx, nil, "run", "-d", "--init", "--privileged", "-p", "127.0.0.1::22", TargetImage)
+	if err != nil {
+		return nil, fmt.Errorf("starting target: %w", err)
+	}
+	t := &DockerTarget{container: strings.TrimSpace(out)}
+
+	out, err = docker(ctx, nil, "port", t.container, "22/tcp")
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("finding target SSH port: %w", err)
+	}
+	t.addr, _, _ = strings.Cut(strings.TrimSpace(out), "\n")
+
+	return t, nil
+}
+
+// Addr returns the published SSH address of the container.
+func (t *DockerTarget) Addr() string {
+	return t.addr
+}
+
+// Boot runs userData in the container.
+func (t *DockerTarget) Boot(ctx context.Context, userData string) error {
+	_, err := docker(ctx, strings.NewReader(userData), "exec", "-i", t.container, "spt-boot")
+	return err
+}
+
+// Close removes the container.
+func (t *DockerTarget) Close() error {
+	_, err := docker(context.Background(), nil, "rm", "-f", t.container)
+	return err
+}
+
+// buildTargetImage builds TargetImage from the embedded build context.
+func buildTargetImage(ctx context.Context) error {
+	dir, err := os.MkdirTemp("", "spt-fake-target-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := writeTargetFiles(dir); err != nil {
+		return err
+	}
+
+	_, err = docker(ctx, nil, "build", "-q", "-t", TargetImage, dir)
+	return err
+}
+
+// writeTargetFiles writes the build context of the target image to dir.
+func writeTargetFiles(dir string) error {
+	return fs.WalkDir(targetFiles, "target", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		dest := filepath.Join(dir, strings.TrimPrefix(path, "target"))
+		if d.IsDir() {
+			return os.MkdirAll(dest, 0o755)
+		}
+
+		data, err := targetFiles.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		// Embedded files lose their mode, everything but the Dockerfile
+		// is a script.
+		mode := fs.FileMode(0o755)
+		if d.Name() == "Dockerfile" {
+			mode = 0o644
+		}
+		return os.WriteFile(dest, data, mode)
+	})
+}
+
+// docker runs the docker CLI and returns its output.
+func docker(ctx context.Context, stdin *strings.Reader, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("docker %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+var _ Target = (*DockerTarget)(nil)
@@ -0,0 +1,590 @@
+package fake
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EC2 is a fake EC2 API. It serves the query API actions spt uses: launch
+// templates, instant fleets, instances, spot requests and spot prices.
+type EC2 struct {
+	// URL is the endpoint to configure as `service.aws.endpoint`.
+	URL string
+
+	server *httptest.Server
+	target Target
+
+	mu        sync.Mutex
+	failure   Failure
+	templates map[string]ec2Template
+	instances map[string]*ec2Instance
+	requests  map[string]*ec2SpotRequest
+	prices    []ec2SpotPrice
+}
+
+type ec2Template struct {
+	userData string
+	tags     []ec2Tag
+}
+
+type ec2Instance struct {
+	id            string
+	instanceType  string
+	zone          string
+	state         string
+	stateReason   *ec2StateReason
+	spotRequestID string
+	tags          []ec2Tag
+	launchTime    time.Time
+	// describes counts DescribeInstances calls, the instance is pending
+	// for the first.
+	describes int
+}
+
+type ec2SpotRequest struct {
+	id         string
+	state      string
+	instanceID string
+}
+
+type ec2Tag struct {
+	Key   string `xml:"key"`
+	Value string `xml:"value"`
+}
+
+type ec2SpotPrice struct {
+	Zone         string `xml:"availabilityZone"`
+	InstanceType string `xml:"instanceType"`
+	Product      string `xml:"productDescription"`
+	Price        string `xml:"spotPrice"`
+	Timestamp    string `xml:"timestamp"`
+}
+
+// ec2Namespace is the XML namespace of EC2 API responses.
+const ec2Namespace = "http://ec2.amazonaws.com/doc/2016-11-15/"
+
+// NewEC2 starts a fake EC2 API whose instances are backed by target, which
+// may be nil.
+func NewEC2(target Target) *EC2 {
+	f := &EC2{
+		target:    target,
+		templates: map[string]ec2Template{},
+		instances: map[string]*ec2Instance{},
+		requests:  map[string]*ec2SpotRequest{},
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	f.URL = f.server.URL
+	return f
+}
+
+// Close shuts the API down.
+func (f *EC2) Close() {
+	f.server.Close()
+}
+
+// SetFailure makes the following fleet requests fail with failure.
+func (f *EC2) SetFailure(failure Failure) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failure = failure
+}
+
+// SetPrice sets the spot price of instanceType in zone.
+func (f *EC2) SetPrice(zone, instanceType string, price float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sp := ec2SpotPrice{
+		Zone:         zone,
+		InstanceType: instanceType,
+		Product:      "Linux/UNIX",
+		Price:        strconv.FormatFloat(price, 'f', 6, 64),
+		Timestamp:    time.Now().UTC().Format(time.RFC3339),
+	}
+	for i, old := range f.prices {
+		if old.Zone == zone && old.InstanceType == instanceType {
+			f.prices[i] = sp
+			return
+		}
+	}
+	f.prices = append(f.prices, sp)
+}
+
+// Reclaim terminates the instance as EC2 does when it reclaims spot
+// capacity.
+func (f *EC2) Reclaim(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if instance, ok := f.instances[id]; ok {
+		instance.state = "terminated"
+		if req, ok := f.requests[instance.spotRequestID]; ok {
+			req.state = "closed"
+		}
+	}
+}
+
+func (f *EC2) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		ec2Error(w, http.StatusBadRequest, "MalformedQueryString", err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	action := r.Form.Get("Action")
+	switch action {
+	case "CreateLaunchTemplate":
+		f.createLaunchTemplate(w, r.Form)
+	case "DeleteLaunchTemplate":
+		f.deleteLaunchTemplate(w, r.Form)
+	case "CreateFleet":
+		f.createFleet(w, r)
+	case "DescribeInstances":
+		f.describeInstances(w, r.Form)
+	case "TerminateInstances":
+		f.terminateInstances(w, r.Form)
+	case "CancelSpotInstanceRequests":
+		f.cancelSpotInstanceRequests(w, r.Form)
+	case "DescribeSpotPriceHistory":
+		f.describeSpotPriceHistory(w, r.Form)
+	default:
+		ec2Error(w, http.StatusBadRequest, "InvalidAction", fmt.Sprintf("The action %s is not valid for this web service.", action))
+	}
+}
+
+func (f *EC2) createLaunchTemplate(w http.ResponseWriter, form url.Values) {
+	userData, err := base64.StdEncoding.DecodeString(form.Get("LaunchTemplateData.UserData"))
+	if err != nil {
+		ec2Error(w, http.StatusBadRequest, "InvalidUserData.Malformed", err.Error())
+		return
+	}
+
+	id := "lt-" + randomID(8)
+	f.templates[id] = ec2Template{
+		userData: string(userData),
+		tags:     ec2TagSpecification(form, "LaunchTemplateData.TagSpecification", "instance"),
+	}
+
+	ec2Reply(w, "CreateLaunchTemplate", struct {
+		ID   string `xml:"launchTemplate>launchTemplateId"`
+		Name string `xml:"launchTemplate>launchTemplateName"`
+	}{id, form.Get("LaunchTemplateName")})
+}
+
+func (f *EC2) deleteLaunchTemplate(w http.ResponseWriter, form url.Values) {
+	id := form.Get("LaunchTemplateId")
+	if _, ok := f.templates[id]; !ok {
+		ec2Error(w, http.StatusBadRequest, "InvalidLaunchTemplateId.NotFound", fmt.Sprintf("The specified launch template, with template ID %s, does not exist.", id))
+		return
+	}
+	delete(f.templates, id)
+
+	ec2Reply(w, "DeleteLaunchTemplate", struct {
+		ID string `xml:"launchTemplate>launchTemplateId"`
+	}{id})
+}
+
+type ec2FleetError struct {
+	Code      string `xml:"errorCode"`
+	Message   string `xml:"errorMessage"`
+	Lifecycle string `xml:"lifecycle"`
+}
+
+type ec2FleetInstance struct {
+	InstanceIDs  []string `xml:"instanceIds>item"`
+	InstanceType string   `xml:"instanceType"`
+	Lifecycle    string   `xml:"lifecycle"`
+}
+
+func (f *EC2) createFleet(w http.ResponseWriter, r *http.Request) {
+	form := r.Form
+	template, ok := f.templates[form.Get("LaunchTemplateConfigs.1.LaunchTemplateSpecification.LaunchTemplateId")]
+	if !ok {
+		ec2Error(w, http.StatusBadRequest, "InvalidLaunchTemplateId.NotFound", "The specified launch template does not exist.")
+		return
+	}
+
+	instanceType := form.Get("LaunchTemplateConfigs.1.Overrides.1.InstanceType")
+	zone := form.Get("LaunchTemplateConfigs.1.Overrides.1.AvailabilityZone")
+	if zone == "" {
+		zone = ec2Region(r) + "a"
+	}
+	spot := form.Get("TargetCapacitySpecification.DefaultTargetCapacityType") != "on-demand"
+	lifecycle := "on-demand"
+	if spot {
+		lifecycle = "spot"
+	}
+
+	fleet := struct {
+		FleetID   string             `xml:"fleetId"`
+		Errors    []ec2FleetError    `xml:"errorSet>item"`
+		Instances []ec2FleetInstance `xml:"fleetInstanceSet>item"`
+	}{FleetID: "fleet-" + randomID(8)}
+
+	failure := f.failure
+	if !spot {
+		failure = NoFailure
+	}
+	switch failure {
+	case NoCapacity:
+		fleet.Errors = append(fleet.Errors, ec2FleetError{
+			Code:      "InsufficientInstanceCapacity",
+			Message:   "There is no Spot capacity available that matches your request.",
+			Lifecycle: lifecycle,
+		})
+		ec2Reply(w, "CreateFleet", fleet)
+		return
+	case PriceTooLow:
+		fleet.Errors = append(fleet.Errors, ec2FleetError{
+			Code:      "SpotMaxPriceTooLow",
+			Message:   "Your Spot request price is lower than the minimum required Spot request fulfillment price.",
+			Lifecycle: lifecycle,
+		})
+		ec2Reply(w, "CreateFleet", fleet)
+		return
+	}
+
+	instance := &ec2Instance{
+		id:           "i-" + randomID(8),
+		instanceType: instanceType,
+		zone:         zone,
+		state:        "pending",
+		tags:         template.tags,
+		launchTime:   time.Now().UTC(),
+	}
+	if spot {
+		req := &ec2SpotRequest{id: "sir-" + randomID(4), state: "active", instanceID: instance.id}
+		f.requests[req.id] = req
+		instance.spotRequestID = req.id
+	}
+	f.instances[instance.id] = instance
+
+	if f.target != nil && failure == NoFailure {
+		if err := f.target.Boot(r.Context(), template.userData); err != nil {
+			ec2Error(w, http.StatusInternalServerError, "InternalError", err.Error())
+			return
+		}
+	}
+
+	fleet.Instances = append(fleet.Instances, ec2FleetInstance{
+		InstanceIDs:  []string{instance.id},
+		InstanceType: instanceType,
+		Lifecycle:    lifecycle,
+	})
+	ec2Reply(w, "CreateFleet", fleet)
+}
+
+type ec2InstanceState struct {
+	Code int    `xml:"code"`
+	Name string `xml:"name"`
+}
+
+type ec2XMLInstance struct {
+	ID            string           `xml:"instanceId"`
+	InstanceType  string           `xml:"instanceType"`
+	LaunchTime    string           `xml:"launchTime"`
+	Zone          string           `xml:"placement>availabilityZone"`
+	IP            string           `xml:"ipAddress,omitempty"`
+	Lifecycle     string           `xml:"instanceLifecycle,omitempty"`
+	SpotRequestID string           `xml:"spotInstanceRequestId,omitempty"`
+	State         ec2InstanceState `xml:"instanceState"`
+	StateReason   *ec2StateReason  `xml:"stateReason,omitempty"`
+	Tags          []ec2Tag         `xml:"tagSet>item"`
+}
+
+type ec2StateReason struct {
+	Code    string `xml:"code"`
+	Message string `xml:"message"`
+}
+
+var ec2StateCodes = map[string]int{
+	"pending":       0,
+	"running":       16,
+	"shutting-down": 32,
+	"terminated":    48,
+}
+
+func (f *EC2) describeInstances(w http.ResponseWriter, form url.Values) {
+	ids := ec2List(form, "InstanceId")
+	filters := ec2Filters(form)
+
+	var instances []ec2XMLInstance
+	for _, id := range ids {
+		if _, ok := f.instances[id]; !ok {
+			ec2Error(w, http.StatusBadRequest, "InvalidInstanceID.NotFound", fmt.Sprintf("The instance ID '%s' does not exist", id))
+			return
+		}
+	}
+	for _, instance := range f.instances {
+		if len(ids) > 0 && !contains(ids, instance.id) {
+			continue
+		}
+		f.advance(instance)
+		if !ec2Match(filters, "instance-state-name", instance.state, instance.tags) {
+			continue
+		}
+
+		xi := ec2XMLInstance{
+			ID:            instance.id,
+			InstanceType:  instance.instanceType,
+			LaunchTime:    instance.launchTime.Format(time.RFC3339),
+			Zone:          instance.zone,
+			SpotRequestID: instance.spotRequestID,
+			State:         ec2InstanceState{Code: ec2StateCodes[instance.state], Name: instance.state},
+			StateReason:   instance.stateReason,
+			Tags:          instance.tags,
+		}
+		if instance.spotRequestID != "" {
+			xi.Lifecycle = "spot"
+		}
+		if instance.state == "running" {
+			xi.IP = deviceAddr(f.target)
+		}
+		instances = append(instances, xi)
+	}
+
+	type reservation struct {
+		ID        string           `xml:"reservationId"`
+		Instances []ec2XMLInstance `xml:"instancesSet>item"`
+	}
+	var reservations []reservation
+	for _, instance := range instances {
+		reservations = append(reservations, reservation{ID: "r-" + instance.ID[2:], Instances: []ec2XMLInstance{instance}})
+	}
+
+	ec2Reply(w, "DescribeInstances", struct {
+		Reservations []reservation `xml:"reservationSet>item"`
+	}{reservations})
+}
+
+// advance moves a pending instance on: it runs from the second describe, or
+// a spot instance ends as the configured failure dictates.
+func (f *EC2) advance(instance *ec2Instance) {
+	instance.describes++
+	if instance.state != "pending" || instance.describes < 2 {
+		return
+	}
+
+	failure := f.failure
+	if instance.spotRequestID == "" {
+		failure = NoFailure
+	}
+	switch failure {
+	case Reclaimed, ProvisionFailed:
+		instance.state = "terminated"
+		instance.stateReason = &ec2StateReason{"Server.SpotInstanceTermination", "Server.SpotInstanceTermination: Spot instance termination"}
+		if failure == ProvisionFailed {
+			instance.stateReason = &ec2StateReason{"Server.InternalError", "Server.InternalError: Internal error on launch"}
+		}
+		if req, ok := f.requests[instance.spotRequestID]; ok {
+			req.state = "closed"
+		}
+	default:
+		instance.state = "running"
+	}
+}
+
+func (f *EC2) terminateInstances(w http.ResponseWriter, form url.Values) {
+	type change struct {
+		ID       string           `xml:"instanceId"`
+		Current  ec2InstanceState `xml:"currentState"`
+		Previous ec2InstanceState `xml:"previousState"`
+	}
+
+	var changes []change
+	for _, id := range ec2List(form, "InstanceId") {
+		instance, ok := f.instances[id]
+		if !ok {
+			ec2Error(w, http.StatusBadRequest, "InvalidInstanceID.NotFound", fmt.Sprintf("The instance ID '%s' does not exist", id))
+			return
+		}
+
+		previous := ec2InstanceState{Code: ec2StateCodes[instance.state], Name: instance.state}
+		instance.state = "terminated"
+		instance.stateReason = &ec2StateReason{"Client.UserInitiatedShutdown", "Client.UserInitiatedShutdown: User initiated shutdown"}
+		changes = append(changes, change{
+			ID:       id,
+			Current:  ec2InstanceState{Code: ec2StateCodes[instance.state], Name: instance.state},
+			Previous: previous,
+		})
+	}
+
+	ec2Reply(w, "TerminateInstances", struct {
+		Instances []change `xml:"instancesSet>item"`
+	}{changes})
+}
+
+func (f *EC2) cancelSpotInstanceRequests(w http.ResponseWriter, form url.Values) {
+	type canceled struct {
+		ID    string `xml:"spotInstanceRequestId"`
+		State string `xml:"state"`
+	}
+
+	var requests []canceled
+	for _, id := range ec2List(form, "SpotInstanceRequestId") {
+		req, ok := f.requests[id]
+		if !ok {
+			ec2Error(w, http.StatusBadRequest, "InvalidSpotInstanceRequestID.NotFound", fmt.Sprintf("The spot instance request ID '%s' does not exist", id))
+			return
+		}
+		req.state = "cancelled"
+		requests = append(requests, canceled{ID: id, State: req.state})
+	}
+
+	ec2Reply(w, "CancelSpotInstanceRequests", struct {
+		Requests []canceled `xml:"spotInstanceRequestSet>item"`
+	}{requests})
+}
+
+func (f *EC2) describeSpotPriceHistory(w http.ResponseWriter, form url.Values) {
+	instanceTypes := ec2List(form, "InstanceType")
+	zone := form.Get("AvailabilityZone")
+
+	var prices []ec2SpotPrice
+	for _, sp := range f.prices {
+		if len(instanceTypes) > 0 && !contains(instanceTypes, sp.InstanceType) {
+			continue
+		}
+		if zone != "" && sp.Zone != zone {
+			continue
+		}
+		prices = append(prices, sp)
+	}
+
+	ec2Reply(w, "DescribeSpotPriceHistory", struct {
+		Prices []ec2SpotPrice `xml:"spotPriceHistorySet>item"`
+	}{prices})
+}
+
+// ec2Reply writes body as the response to action.
+func ec2Reply(w http.ResponseWriter, action string, body interface{}) {
+	w.Header().Set("Content-Type", "text/xml;charset=UTF-8")
+	xml.NewEncoder(w).EncodeElement(body, xml.StartElement{
+		Name: xml.Name{Local: action + "Response"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: ec2Namespace}},
+	})
+}
+
+// ec2Error writes an EC2 error response.
+func ec2Error(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "text/xml;charset=UTF-8")
+	w.WriteHeader(status)
+
+	type ec2XMLError struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	xml.NewEncoder(w).Encode(struct {
+		XMLName   xml.Name      `xml:"Response"`
+		Errors    []ec2XMLError `xml:"Errors>Error"`
+		RequestID string        `xml:"RequestID"`
+	}{Errors: []ec2XMLError{{code, message}}, RequestID: randomID(16)})
+}
+
+// ec2List returns the values of the numbered parameters prefix.1, prefix.2
+// and so on.
+func ec2List(form url.Values, prefix string) []string {
+	var values []string
+	for i := 1; ; i++ {
+		v, ok := form[fmt.Sprintf("%s.%d", prefix, i)]
+		if !ok {
+			return values
+		}
+		values = append(values, v...)
+	}
+}
+
+// ec2TagSpecification returns the tags specified for resourceType in the
+// numbered tag specifications under prefix.
+func ec2TagSpecification(form url.Values, prefix, resourceType string) []ec2Tag {
+	var tags []ec2Tag
+	for i := 1; ; i++ {
+		spec := fmt.Sprintf("%s.%d", prefix, i)
+		rt := form.Get(spec + ".ResourceType")
+		if rt == "" {
+			return tags
+		}
+		if rt != resourceType {
+			continue
+		}
+
+		for j := 1; ; j++ {
+			tag := fmt.Sprintf("%s.Tag.%d", spec, j)
+			key := form.Get(tag + ".Key")
+			if key == "" {
+				break
+			}
+			tags = append(tags, ec2Tag{Key: key, Value: form.Get(tag + ".Value")})
+		}
+	}
+}
+
+// ec2Filters returns the numbered filters of a describe request by name.
+func ec2Filters(form url.Values) map[string][]string {
+	filters := map[string][]string{}
+	for i := 1; ; i++ {
+		filter := fmt.Sprintf("Filter.%d", i)
+		name := form.Get(filter + ".Name")
+		if name == "" {
+			return filters
+		}
+		filters[name] = ec2List(form, filter+".Value")
+	}
+}
+
+// ec2Match reports whether a resource in state with tags passes filters.
+// stateFilter is the name of the filter on the state, other supported
+// filters are on tags.
+func ec2Match(filters map[string][]string, stateFilter, state string, tags []ec2Tag) bool {
+	for name, values := range filters {
+		switch {
+		case name == stateFilter:
+			if !contains(values, state) {
+				return false
+			}
+		case strings.HasPrefix(name, "tag:"):
+			key := strings.TrimPrefix(name, "tag:")
+			matched := false
+			for _, tag := range tags {
+				if tag.Key == key && contains(values, tag.Value) {
+					matched = true
+				}
+			}
+			if !matched {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// credentialScope matches the region in a SigV4 Authorization header.
+var credentialScope = regexp.MustCompile(`Credential=[^/]+/[^/]+/([^/]+)/`)
+
+// ec2Region returns the region a request was signed for.
+func ec2Region(r *http.Request) string {
+	if m := credentialScope.FindStringSubmatch(r.Header.Get("Authorization")); m != nil {
+		return m[1]
+	}
+	return "us-east-1"
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+// Package fake implements fake provider backends for exercising spt end to
+// end without cloud credentials or network access.
+//
+// EC2, Metal, GCE, Azure and Hetzner are HTTP servers that speak enough of
+// the EC2, Equinix Metal, Compute Engine, Azure Resource Manager and Hetzner
+// Cloud APIs for spt to provision, list, attach to and delete devices. Point
+// spt at them with the `endpoint` of `service.aws`, `service.equinix`,
+// `service.gce`, `service.azure` or `service.hetzner`:
+//
+//	target, err := fake.StartDockerTarget(ctx)
+//	...
+//	defer target.Close()
+//
+//	ec2 := fake.NewEC2(target)
+//	defer ec2.Close()
+//	cfg.Service.AWS.Endpoint = ec2.URL
+//
+// Every device the fakes create is backed by the same Target, a machine that
+// runs the device's user-data script and accepts SSH connections. An
+// SSHTarget only answers spt's readiness checks, which is enough to
+// provision, list and delete devices without Docker. Without a target,
+// devices get an unreachable address and never become ready, which is
+// enough to exercise listing and spot failures.
+package fake
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// Target is a machine standing in for the devices of the fake providers.
+type Target interface {
+	// Addr returns the SSH address of the target as host:port.
+	Addr() string
+	// Boot runs the user-data script of a newly created device, in the
+	// background, as cloud-init would.
+	Boot(ctx context.Context, userData string) error
+}
+
+// Failure is a way in which a fake provider fails to deliver a spot device.
+type Failure int
+
+const (
+	// NoFailure delivers devices normally.
+	NoFailure Failure = iota
+	// NoCapacity rejects the request for lack of spot capacity.
+	NoCapacity
+	// PriceTooLow rejects the request because the maximum price is below
+	// the spot market price.
+	PriceTooLow
+	// Reclaimed reclaims the device while it is being provisioned.
+	Reclaimed
+	// ProvisionFailed lets the device fail while it is being provisioned.
+	ProvisionFailed
+)
+
+// deviceAddr returns the address handed out for a device: the target's, or
+// an unreachable documentation address without one.
+func deviceAddr(target Target) string {
+	if target == nil {
+		return "192.0.2.1"
+	}
+	return target.Addr()
+}
+
+// randomID returns n random bytes, hex encoded.
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,326 @@
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GCE is a fake Compute Engine API. It serves the instance and zone
+// operation endpoints spt uses. Point spt at it with
+// `service.gce.endpoint` and any GOOGLE_OAUTH_ACCESS_TOKEN.
+type GCE struct {
+	// URL is the endpoint to configure as `service.gce.endpoint`.
+	URL string
+
+	server *httptest.Server
+	target Target
+
+	mu        sync.Mutex
+	failure   Failure
+	instances map[string]*gceInstance
+}
+
+// gceInstance is an instance resource as the API returns it. The fields spt
+// does not read are kept as sent.
+type gceInstance struct {
+	ID                string                   `json:"id"`
+	Name              string                   `json:"name"`
+	Zone              string                   `json:"zone"`
+	MachineType       string                   `json:"machineType"`
+	Status            string                   `json:"status"`
+	CreationTimestamp string                   `json:"creationTimestamp"`
+	Labels            map[string]string        `json:"labels,omitempty"`
+	Metadata          gceMetadata              `json:"metadata"`
+	Scheduling        json.RawMessage          `json:"scheduling,omitempty"`
+	Disks             json.RawMessage          `json:"disks,omitempty"`
+	NetworkInterfaces []map[string]interface{} `json:"networkInterfaces,omitempty"`
+	ServiceAccounts   json.RawMessage          `json:"serviceAccounts,omitempty"`
+
+	project string
+	spot    bool
+}
+
+type gceMetadata struct {
+	Items []struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	} `json:"items,omitempty"`
+}
+
+// get returns the metadata value of key.
+func (m gceMetadata) get(key string) string {
+	for _, item := range m.Items {
+		if item.Key == key {
+			return item.Value
+		}
+	}
+	return ""
+}
+
+type gceOperation struct {
+	Name   string `json:"name"`
+	Zone   string `json:"zone"`
+	Status string `json:"status"`
+	Error  *struct {
+		Errors []gceOperationError `json:"errors"`
+	} `json:"error,omitempty"`
+}
+
+type gceOperationError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// NewGCE starts a fake Compute Engine API whose instances are backed by
+// target, which may be nil.
+func NewGCE(target Target) *GCE {
+	f := &GCE{
+		target:    target,
+		instances: map[string]*gceInstance{},
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	f.URL = f.server.URL
+	return f
+}
+
+// Close shuts the API down.
+func (f *GCE) Close() {
+	f.server.Close()
+}
+
+// SetFailure makes the following Spot VM requests fail with failure. Spot
+// VMs have no maximum price, PriceTooLow is ignored.
+func (f *GCE) SetFailure(failure Failure) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failure = failure
+}
+
+// Reclaim preempts the VM, which is deleted as its termination action is
+// DELETE.
+func (f *GCE) Reclaim(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.instances, name)
+}
+
+func (f *GCE) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		gceError(w, http.StatusUnauthorized, "Request is missing required authentication credential.")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// /compute/v1/projects/{project}/...
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 5 || parts[0] != "compute" || parts[1] != "v1" || parts[2] != "projects" {
+		gceError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	project, parts := parts[3], parts[4:]
+
+	switch {
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "zones" && parts[2] == "instances":
+		f.insertInstance(w, r, project, parts[1])
+	case r.Method == "GET" && len(parts) == 4 && parts[0] == "zones" && parts[2] == "instances":
+		f.getInstance(w, project, parts[1], parts[3])
+	case r.Method == "DELETE" && len(parts) == 4 && parts[0] == "zones" && parts[2] == "instances":
+		f.deleteInstance(w, project, parts[1], parts[3])
+	case r.Method == "GET" && len(parts) == 4 && parts[0] == "zones" && parts[2] == "operations":
+		// Operations finish as soon as they are created.
+		gceReply(w, http.StatusOK, gceOperation{Name: parts[3], Zone: gceZoneURL(project, parts[1]), Status: "DONE"})
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "aggregated" && parts[1] == "instances":
+		f.listInstances(w, r, project)
+	default:
+		gceError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+func (f *GCE) insertInstance(w http.ResponseWriter, r *http.Request, project, zone string) {
+	var instance gceInstance
+	if err := json.NewDecoder(r.Body).Decode(&instance); err != nil {
+		gceError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, ok := f.instances[instance.Name]; ok {
+		gceError(w, http.StatusConflict, fmt.Sprintf("The resource 'projects/%s/zones/%s/instances/%s' already exists", project, zone, instance.Name))
+		return
+	}
+
+	var scheduling struct {
+		ProvisioningModel string `json:"provisioningModel"`
+	}
+	json.Unmarshal(instance.Scheduling, &scheduling)
+	instance.spot = scheduling.ProvisioningModel == "SPOT"
+
+	failure := f.failure
+	if !instance.spot {
+		failure = NoFailure
+	}
+
+	op := gceOperation{Name: "operation-" + randomID(8), Zone: gceZoneURL(project, zone), Status: "DONE"}
+	if failure == NoCapacity {
+		// Capacity errors are reported by the finished operation.
+		op.Error = &struct {
+			Errors []gceOperationError `json:"errors"`
+		}{Errors: []gceOperationError{{
+			Code:    "ZONE_RESOURCE_POOL_EXHAUSTED",
+			Message: fmt.Sprintf("The zone '%s' does not have enough resources available to fulfill the request.", op.Zone),
+		}}}
+		gceReply(w, http.StatusOK, op)
+		return
+	}
+
+	if f.target != nil && failure == NoFailure {
+		if err := f.target.Boot(r.Context(), instance.Metadata.get("user-data")); err != nil {
+			gceError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	instance.ID = fmt.Sprint(time.Now().UnixNano())
+	instance.Zone = op.Zone
+	instance.Status = "PROVISIONING"
+	instance.CreationTimestamp = time.Now().Format(time.RFC3339)
+	instance.project = project
+	f.instances[instance.Name] = &instance
+
+	gceReply(w, http.StatusOK, op)
+}
+
+func (f *GCE) getInstance(w http.ResponseWriter, project, zone, name string) {
+	instance, ok := f.instance(project, zone, name)
+	if !ok {
+		gceNotFound(w, project, zone, name)
+		return
+	}
+
+	if !f.advance(instance) {
+		delete(f.instances, name)
+		gceNotFound(w, project, zone, name)
+		return
+	}
+
+	gceReply(w, http.StatusOK, instance)
+}
+
+// advance moves a new instance on by one status per call, from
+// provisioning through staging to running, or as the configured failure
+// dictates for a Spot VM. It reports false when the VM was preempted.
+func (f *GCE) advance(instance *gceInstance) bool {
+	failure := f.failure
+	if !instance.spot {
+		failure = NoFailure
+	}
+
+	switch instance.Status {
+	case "PROVISIONING":
+		if failure == Reclaimed {
+			return false
+		}
+		instance.Status = "STAGING"
+	case "STAGING":
+		if failure == ProvisionFailed {
+			instance.Status = "TERMINATED"
+			break
+		}
+		instance.Status = "RUNNING"
+		for _, nic := range instance.NetworkInterfaces {
+			configs, _ := nic["accessConfigs"].([]interface{})
+			for _, c := range configs {
+				if c, ok := c.(map[string]interface{}); ok {
+					c["natIP"] = deviceAddr(f.target)
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+func (f *GCE) deleteInstance(w http.ResponseWriter, project, zone, name string) {
+	if _, ok := f.instance(project, zone, name); !ok {
+		gceNotFound(w, project, zone, name)
+		return
+	}
+	delete(f.instances, name)
+
+	gceReply(w, http.StatusOK, gceOperation{Name: "operation-" + randomID(8), Zone: gceZoneURL(project, zone), Status: "DONE"})
+}
+
+// gceFilter matches the label and name filters spt lists instances with.
+var gceFilter = regexp.MustCompile(`^(labels\.[a-z0-9_-]+|name)\s*=\s*"?([^"]*)"?$`)
+
+func (f *GCE) listInstances(w http.ResponseWriter, r *http.Request, project string) {
+	filter := r.URL.Query().Get("filter")
+	var field, value string
+	if filter != "" {
+		m := gceFilter.FindStringSubmatch(filter)
+		if m == nil {
+			gceError(w, http.StatusBadRequest, fmt.Sprintf("Invalid list filter expression '%s'.", filter))
+			return
+		}
+		field, value = m[1], m[2]
+	}
+
+	type scoped struct {
+		Instances []*gceInstance `json:"instances,omitempty"`
+	}
+	items := map[string]*scoped{}
+	for _, instance := range f.instances {
+		if instance.project != project {
+			continue
+		}
+		switch {
+		case field == "name" && instance.Name != value:
+			continue
+		case strings.HasPrefix(field, "labels.") && instance.Labels[strings.TrimPrefix(field, "labels.")] != value:
+			continue
+		}
+		key := "zones/" + instance.Zone[strings.LastIndex(instance.Zone, "/")+1:]
+		if items[key] == nil {
+			items[key] = &scoped{}
+		}
+		items[key].Instances = append(items[key].Instances, instance)
+	}
+
+	gceReply(w, http.StatusOK, map[string]interface{}{"items": items})
+}
+
+// instance returns the instance name in the zone of project.
+func (f *GCE) instance(project, zone, name string) (*gceInstance, bool) {
+	instance, ok := f.instances[name]
+	if !ok || instance.project != project || instance.Zone != gceZoneURL(project, zone) {
+		return nil, false
+	}
+	return instance, true
+}
+
+// gceZoneURL returns the URL of zone, as resources refer to it.
+func gceZoneURL(project, zone string) string {
+	return "https://www.googleapis.com/compute/v1/projects/" + project + "/zones/" + zone
+}
+
+func gceReply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func gceError(w http.ResponseWriter, status int, message string) {
+	gceReply(w, status, map[string]interface{}{
+		"error": map[string]interface{}{"code": status, "message": message},
+	})
+}
+
+func gceNotFound(w http.ResponseWriter, project, zone, name string) {
+	gceError(w, http.StatusNotFound, fmt.Sprintf("The resource 'projects/%s/zones/%s/instances/%s' was not found", project, zone, name))
+}
@@ -0,0 +1,239 @@
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hetzner is a fake Hetzner Cloud API. It serves the server endpoints spt
+// uses. Hetzner Cloud servers are not spot instances, only NoCapacity and
+// ProvisionFailed apply to them.
+type Hetzner struct {
+	// URL is the endpoint to configure as `service.hetzner.endpoint`.
+	URL string
+
+	server *httptest.Server
+	target Target
+
+	mu      sync.Mutex
+	failure Failure
+	nextID  int64
+	servers map[int64]*hetznerServer
+}
+
+type hetznerServer struct {
+	ID         int64             `json:"id"`
+	Name       string            `json:"name"`
+	Status     string            `json:"status"`
+	Created    time.Time         `json:"created"`
+	Labels     map[string]string `json:"labels"`
+	PublicNet  hetznerPublicNet  `json:"public_net"`
+	ServerType struct {
+		Name string `json:"name"`
+	} `json:"server_type"`
+	Datacenter struct {
+		Location struct {
+			Name string `json:"name"`
+		} `json:"location"`
+	} `json:"datacenter"`
+}
+
+type hetznerPublicNet struct {
+	IPv4 *struct {
+		IP string `json:"ip"`
+	} `json:"ipv4"`
+}
+
+// NewHetzner starts a fake Hetzner Cloud API whose servers are backed by
+// target, which may be nil.
+func NewHetzner(target Target) *Hetzner {
+	f := &Hetzner{
+		target:  target,
+		nextID:  1000000,
+		servers: map[int64]*hetznerServer{},
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	f.URL = f.server.URL
+	return f
+}
+
+// Close shuts the API down.
+func (f *Hetzner) Close() {
+	f.server.Close()
+}
+
+// SetFailure makes the following server requests fail with failure.
+func (f *Hetzner) SetFailure(failure Failure) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failure = failure
+}
+
+func (f *Hetzner) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		hetznerError(w, http.StatusUnauthorized, "unauthorized", "unable to authenticate")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "POST" && len(parts) == 1 && parts[0] == "servers":
+		f.createServer(w, r)
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "servers":
+		f.listServers(w, r)
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "servers":
+		f.getServer(w, parts[1])
+	case r.Method == "DELETE" && len(parts) == 2 && parts[0] == "servers":
+		f.deleteServer(w, parts[1])
+	default:
+		hetznerError(w, http.StatusNotFound, "not_found", "not found")
+	}
+}
+
+func (f *Hetzner) createServer(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name       string            `json:"name"`
+		ServerType string            `json:"server_type"`
+		Location   string            `json:"location"`
+		UserData   string            `json:"user_data"`
+		Labels     map[string]string `json:"labels"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		hetznerError(w, http.StatusBadRequest, "json_error", err.Error())
+		return
+	}
+
+	if f.failure == NoCapacity {
+		hetznerError(w, http.StatusPreconditionFailed, "resource_unavailable", fmt.Sprintf("server type %s is unavailable in %s", input.ServerType, input.Location))
+		return
+	}
+
+	if f.target != nil && f.failure == NoFailure {
+		if err := f.target.Boot(r.Context(), input.UserData); err != nil {
+			hetznerError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+	}
+
+	f.nextID++
+	server := &hetznerServer{
+		ID:      f.nextID,
+		Name:    input.Name,
+		Status:  "initializing",
+		Created: time.Now().UTC().Truncate(time.Second),
+		Labels:  input.Labels,
+	}
+	server.ServerType.Name = input.ServerType
+	server.Datacenter.Location.Name = input.Location
+	f.servers[server.ID] = server
+
+	hetznerReply(w, http.StatusCreated, map[string]interface{}{
+		"server":        server,
+		"action":        map[string]interface{}{"id": f.nextID, "command": "create_server", "status": "running"},
+		"root_password": randomID(8),
+	})
+}
+
+func (f *Hetzner) getServer(w http.ResponseWriter, id string) {
+	server, ok := f.find(id)
+	if !ok {
+		hetznerError(w, http.StatusNotFound, "not_found", "server not found")
+		return
+	}
+
+	f.advance(server)
+	hetznerReply(w, http.StatusOK, map[string]interface{}{"server": server})
+}
+
+// advance moves a new server on by one status per call, from initializing
+// through starting to running, or to off when it fails to provision.
+func (f *Hetzner) advance(server *hetznerServer) {
+	switch server.Status {
+	case "initializing":
+		server.Status = "starting"
+		server.PublicNet.IPv4 = &struct {
+			IP string `json:"ip"`
+		}{deviceAddr(f.target)}
+	case "starting":
+		if f.failure == ProvisionFailed {
+			server.Status = "off"
+			break
+		}
+		server.Status = "running"
+	}
+}
+
+func (f *Hetzner) listServers(w http.ResponseWriter, r *http.Request) {
+	// Only equality selectors, as spt uses them.
+	selector := map[string]string{}
+	for _, term := range strings.Split(r.URL.Query().Get("label_selector"), ",") {
+		if k, v, ok := strings.Cut(term, "=="); ok {
+			selector[k] = v
+		} else if k, v, ok := strings.Cut(term, "="); ok {
+			selector[k] = v
+		}
+	}
+
+	servers := []*hetznerServer{}
+	for _, server := range f.servers {
+		matches := true
+		for k, v := range selector {
+			if server.Labels[k] != v {
+				matches = false
+			}
+		}
+		if matches {
+			servers = append(servers, server)
+		}
+	}
+
+	hetznerReply(w, http.StatusOK, map[string]interface{}{
+		"servers": servers,
+		"meta": map[string]interface{}{
+			"pagination": map[string]interface{}{"page": 1, "per_page": 50, "last_page": 1, "next_page": nil, "total_entries": len(servers)},
+		},
+	})
+}
+
+func (f *Hetzner) deleteServer(w http.ResponseWriter, id string) {
+	server, ok := f.find(id)
+	if !ok {
+		hetznerError(w, http.StatusNotFound, "not_found", "server not found")
+		return
+	}
+	delete(f.servers, server.ID)
+
+	hetznerReply(w, http.StatusOK, map[string]interface{}{
+		"action": map[string]interface{}{"id": server.ID, "command": "delete_server", "status": "running"},
+	})
+}
+
+func (f *Hetzner) find(id string) (*hetznerServer, bool) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	server, ok := f.servers[n]
+	return server, ok
+}
+
+func hetznerReply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func hetznerError(w http.ResponseWriter, status int, code, message string) {
+	hetznerReply(w, status, map[string]interface{}{
+		"error": map[string]string{"code": code, "message": message},
+	})
+}
@@ -0,0 +1,340 @@
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
+)
+
+// Metal is a fake Equinix Metal API. It serves the device, project API key
+// and spot market endpoints spt uses.
+type Metal struct {
+	// URL is the endpoint to configure as `service.equinix.endpoint`.
+	URL string
+
+	server *httptest.Server
+	target Target
+
+	mu      sync.Mutex
+	failure Failure
+	devices map[string]*metalDevice
+	keys    map[string]*metalKey
+	// prices holds the spot price of each plan by metro.
+	prices map[string]map[string]float64
+}
+
+type metalKey struct {
+	key     metal.AuthToken
+	project string
+}
+
+type metalDevice struct {
+	device  metal.Device
+	project string
+}
+
+// NewMetal starts a fake Metal API whose devices are backed by target, which
+// may be nil.
+func NewMetal(target Target) *Metal {
+	f := &Metal{
+		target:  target,
+		devices: map[string]*metalDevice{},
+		keys:    map[string]*metalKey{},
+		prices:  map[string]map[string]float64{},
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	f.URL = f.server.URL
+	return f
+}
+
+// Close shuts the API down.
+func (f *Metal) Close() {
+	f.server.Close()
+}
+
+// SetFailure makes the following spot device requests fail with failure.
+func (f *Metal) SetFailure(failure Failure) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failure = failure
+}
+
+// SetPrice sets the spot price of plan in metro.
+func (f *Metal) SetPrice(metro, plan string, price float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.prices[metro] == nil {
+		f.prices[metro] = map[string]float64{}
+	}
+	f.prices[metro][plan] = price
+}
+
+// Reclaim announces that the device is reclaimed in two minutes, as Metal
+// does by setting the termination time of a spot device.
+func (f *Metal) Reclaim(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if d, ok := f.devices[id]; ok {
+		d.device.SetTerminationTime(time.Now().Add(2 * time.Minute))
+	}
+}
+
+func (f *Metal) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Auth-Token") == "" {
+		metalError(w, http.StatusUnauthorized, "Invalid authentication token")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "projects" && parts[2] == "api-keys":
+		f.createAPIKey(w, r, parts[1])
+	case r.Method == "GET" && len(parts) == 3 && parts[0] == "projects" && parts[2] == "api-keys":
+		f.listAPIKeys(w, parts[1])
+	case r.Method == "DELETE" && len(parts) == 2 && parts[0] == "api-keys":
+		f.deleteAPIKey(w, parts[1])
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "projects" && parts[2] == "devices":
+		f.createDevice(w, r, parts[1])
+	case r.Method == "GET" && len(parts) == 3 && parts[0] == "projects" && parts[2] == "devices":
+		f.listDevices(w, r, parts[1])
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "devices":
+		f.getDevice(w, parts[1])
+	case r.Method == "DELETE" && len(parts) == 2 && parts[0] == "devices":
+		f.deleteDevice(w, parts[1])
+	case r.Method == "GET" && r.URL.Path == "/market/spot/prices/metros":
+		f.spotPrices(w, r)
+	default:
+		metalError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (f *Metal) createAPIKey(w http.ResponseWriter, r *http.Request, project string) {
+	var input metal.AuthTokenInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		metalError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	key := metal.NewAuthToken()
+	key.SetId(randomUUID())
+	key.SetToken(randomID(16))
+	key.SetDescription(input.GetDescription())
+	key.SetCreatedAt(time.Now().UTC())
+	f.keys[key.GetId()] = &metalKey{key: *key, project: project}
+
+	metalReply(w, http.StatusCreated, key)
+}
+
+func (f *Metal) listAPIKeys(w http.ResponseWriter, project string) {
+	keys := []metal.AuthToken{}
+	for _, k := range f.keys {
+		if k.project == project {
+			keys = append(keys, k.key)
+		}
+	}
+
+	list := metal.NewAuthTokenList()
+	list.SetApiKeys(keys)
+	metalReply(w, http.StatusOK, list)
+}
+
+func (f *Metal) deleteAPIKey(w http.ResponseWriter, id string) {
+	if _, ok := f.keys[id]; !ok {
+		metalError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	delete(f.keys, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *Metal) createDevice(w http.ResponseWriter, r *http.Request, project string) {
+	var input metal.DeviceCreateInMetroInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		metalError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	failure := f.failure
+	if !input.GetSpotInstance() {
+		failure = NoFailure
+	}
+	switch failure {
+	case NoCapacity:
+		metalError(w, http.StatusServiceUnavailable, fmt.Sprintf("Oh snap, the %s plan is not available in %s", input.Plan, input.Metro))
+		return
+	case PriceTooLow:
+		metalError(w, http.StatusUnprocessableEntity, "Spot price max is lower than the current spot market price")
+		return
+	}
+
+	device := metal.NewDevice()
+	device.SetId(randomUUID())
+	device.SetHostname(input.GetHostname())
+	device.SetState(metal.DEVICESTATE_QUEUED)
+	device.SetCreatedAt(time.Now().UTC())
+	device.SetSpotInstance(input.GetSpotInstance())
+	if input.SpotPriceMax != nil {
+		device.SetSpotPriceMax(input.GetSpotPriceMax())
+	}
+	if input.TerminationTime != nil {
+		device.SetTerminationTime(input.GetTerminationTime())
+	}
+	device.SetTags(input.Tags)
+	device.SetCustomdata(input.Customdata)
+	device.SetUserdata(input.GetUserdata())
+
+	plan := metal.NewPlan()
+	plan.SetSlug(input.Plan)
+	device.SetPlan(*plan)
+	metro := metal.NewDeviceMetro()
+	metro.SetCode(input.Metro)
+	device.SetMetro(*metro)
+
+	if f.target != nil && failure == NoFailure {
+		if err := f.target.Boot(r.Context(), input.GetUserdata()); err != nil {
+			metalError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	f.devices[device.GetId()] = &metalDevice{device: *device, project: project}
+	metalReply(w, http.StatusCreated, device)
+}
+
+func (f *Metal) listDevices(w http.ResponseWriter, r *http.Request, project string) {
+	tag := r.URL.Query().Get("tag")
+
+	devices := []metal.Device{}
+	for _, d := range f.devices {
+		if d.project != project {
+			continue
+		}
+		if tag != "" && !contains(d.device.Tags, tag) {
+			continue
+		}
+		devices = append(devices, d.device)
+	}
+
+	list := metal.NewDeviceList()
+	list.SetDevices(devices)
+	meta := metal.NewMeta()
+	meta.SetCurrentPage(1)
+	meta.SetLastPage(1)
+	meta.SetTotal(int32(len(devices)))
+	list.SetMeta(*meta)
+
+	metalReply(w, http.StatusOK, list)
+}
+
+func (f *Metal) getDevice(w http.ResponseWriter, id string) {
+	d, ok := f.devices[id]
+	if !ok {
+		metalError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	if !f.advance(d) {
+		delete(f.devices, id)
+		metalError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	metalReply(w, http.StatusOK, d.device)
+}
+
+// advance moves a new device on by one state per call, from queued through
+// provisioning to active, or as the configured failure dictates for a spot
+// device. It reports false when the device was reclaimed.
+func (f *Metal) advance(d *metalDevice) bool {
+	failure := f.failure
+	if !d.device.GetSpotInstance() {
+		failure = NoFailure
+	}
+
+	switch d.device.GetState() {
+	case metal.DEVICESTATE_QUEUED:
+		if failure == Reclaimed {
+			return false
+		}
+		d.device.SetState(metal.DEVICESTATE_PROVISIONING)
+		d.device.SetProvisioningPercentage(50)
+		d.device.SetIpAddresses([]metal.IPAssignment{metalPublicIP(deviceAddr(f.target))})
+	case metal.DEVICESTATE_PROVISIONING:
+		if failure == ProvisionFailed {
+			d.device.SetState(metal.DEVICESTATE_FAILED)
+			break
+		}
+		d.device.SetState(metal.DEVICESTATE_ACTIVE)
+		d.device.SetProvisioningPercentage(100)
+	}
+
+	return true
+}
+
+func (f *Metal) deleteDevice(w http.ResponseWriter, id string) {
+	if _, ok := f.devices[id]; !ok {
+		metalError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	delete(f.devices, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *Metal) spotPrices(w http.ResponseWriter, r *http.Request) {
+	plan := r.URL.Query().Get("plan")
+
+	type price struct {
+		Price float64 `json:"price"`
+	}
+	prices := map[string]map[string]price{}
+	for metro, plans := range f.prices {
+		for p, v := range plans {
+			if plan != "" && p != plan {
+				continue
+			}
+			if prices[metro] == nil {
+				prices[metro] = map[string]price{}
+			}
+			prices[metro][p] = price{v}
+		}
+	}
+
+	metalReply(w, http.StatusOK, map[string]interface{}{"spot_market_prices": prices})
+}
+
+// metalPublicIP returns the public IPv4 assignment of a device at addr. The
+// address keeps the port of a target.
+func metalPublicIP(addr string) metal.IPAssignment {
+	ip := metal.NewIPAssignment()
+	ip.SetAddress(addr)
+	ip.SetAddressFamily(4)
+	ip.SetPublic(true)
+	return *ip
+}
+
+func metalReply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func metalError(w http.ResponseWriter, status int, message string) {
+	metalReply(w, status, metal.Error{Errors: []string{message}})
+}
+
+// randomUUID returns a random version 4 UUID, as Metal uses for IDs.
+func randomUUID() string {
+	id := randomID(16)
+	return fmt.Sprintf("%s-%s-4%s-a%s-%s", id[0:8], id[8:12], id[13:16], id[17:20], id[20:32])
+}
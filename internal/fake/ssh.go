@@ -0,0 +1,167 @@
+package fake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHTarget is a Target served in-process. It accepts SSH connections with
+// the host key and login key of the user-data it booted last and answers
+// the readiness checks spt runs while provisioning, but runs no other
+// commands. Devices backed by it can be provisioned, listed and deleted
+// without Docker, but not run on.
+type SSHTarget struct {
+	listener net.Listener
+
+	mu         sync.Mutex
+	hostKey    ssh.Signer
+	authorized ssh.PublicKey
+}
+
+// sshTargetOutput is what the target answers to the commands spt runs to
+// wait for a device, as a device that finished its setup would.
+var sshTargetOutput = map[string]string{
+	"cat /var/lib/spt/ready":     `{"docker_version": "fake", "setup_seconds": 0}`,
+	"test -f /var/lib/spt/ready": "",
+	"cloud-init status":          "status: done\n",
+}
+
+var (
+	// userDataHostKey matches the pinned host key installed by user-data.
+	userDataHostKey = regexp.MustCompile(`(?s)cat > /etc/ssh/ssh_host_ed25519_key << 'EOL'\n(.*?)EOL\n`)
+	// userDataLoginKey matches the login key authorized by user-data.
+	userDataLoginKey = regexp.MustCompile(`echo '([^']+)' >> /home/[a-z]+/\.ssh/authorized_keys`)
+)
+
+// StartSSHTarget starts an SSHTarget on the loopback interface.
+func StartSSHTarget() (*SSHTarget, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	t := &SSHTarget{listener: l}
+	go t.serve()
+	return t, nil
+}
+
+// Addr returns the SSH address of the target.
+func (t *SSHTarget) Addr() string {
+	return t.listener.Addr().String()
+}
+
+// Boot takes the host key and the login key from userData.
+func (t *SSHTarget) Boot(ctx context.Context, userData string) error {
+	hostKey := userDataHostKey.FindStringSubmatch(userData)
+	loginKey := userDataLoginKey.FindStringSubmatch(userData)
+	if hostKey == nil || loginKey == nil {
+		return errors.New("user-data installs no host key or login key")
+	}
+
+	signer, err := ssh.ParsePrivateKey([]byte(hostKey[1]))
+	if err != nil {
+		return fmt.Errorf("parsing host key: %w", err)
+	}
+	authorized, _, _, _, err := ssh.ParseAuthorizedKey([]byte(loginKey[1]))
+	if err != nil {
+		return fmt.Errorf("parsing login key: %w", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.hostKey, t.authorized = signer, authorized
+	return nil
+}
+
+// Close stops accepting connections.
+func (t *SSHTarget) Close() error {
+	return t.listener.Close()
+}
+
+func (t *SSHTarget) serve() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		go t.handle(conn)
+	}
+}
+
+func (t *SSHTarget) handle(conn net.Conn) {
+	defer conn.Close()
+
+	t.mu.Lock()
+	hostKey, authorized := t.hostKey, t.authorized
+	t.mu.Unlock()
+	if hostKey == nil {
+		// Nothing booted yet, like a device whose sshd is not up.
+		return
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(authorized.Marshal()) {
+				return nil, fmt.Errorf("unknown key for %s", meta.User())
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go handleSession(channel, requests)
+	}
+}
+
+// handleSession answers the exec request of a session from
+// sshTargetOutput.
+func handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for req := range requests {
+		if req.Type != "exec" {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+
+		var exec struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &exec); err != nil {
+			req.Reply(false, nil)
+			return
+		}
+		req.Reply(true, nil)
+
+		status := uint32(0)
+		if out, ok := sshTargetOutput[exec.Command]; ok {
+			io.WriteString(channel, out)
+		} else {
+			fmt.Fprintf(channel.Stderr(), "%s: command not found\n", exec.Command)
+			status = 127
+		}
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		return
+	}
+}
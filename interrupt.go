@@ -0,0 +1,90 @@
+package spt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInterrupted is returned by Device.Run when the provider reclaimed the
+// spot device while the container was running.
+var ErrInterrupted = errors.New("interrupted by provider")
+
+// DefaultInterruptionSignal is sent to the container when the provider
+// announces that the device is about to be reclaimed.
+const DefaultInterruptionSignal = "SIGTERM"
+
+// interruptionPollInterval is how often a running device is checked for a
+// pending reclaim. AWS gives two minutes of notice.
+var interruptionPollInterval = 5 * time.Second
+
+// Interruptible is implemented by devices that can report a pending
+// reclaim of a spot device by the provider.
+type Interruptible interface {
+	// InterruptionNotice reports whether the provider has scheduled the
+	// device for reclaim and when. output runs a command on the device over
+	// the SSH connection of the run and returns its standard output.
+	InterruptionNotice(ctx context.Context, output func(cmd string) ([]byte, error)) (time.Time, bool, error)
+}
+
+// watchInterruption polls device until ctx is done and calls onNotice once
+// when the provider announces that the device will be reclaimed. Commands
+// run on the device with output.
+func watchInterruption(ctx context.Context, device Interruptible, output func(cmd string) ([]byte, error), onNotice func(at time.Time)) {
+	ticker := time.NewTicker(interruptionPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		at, ok, err := device.InterruptionNotice(ctx, output)
+		if err != nil {
+			continue
+		}
+		if ok {
+			onNotice(at)
+			return
+		}
+	}
+}
+
+// interruptionSignal returns the configured interruption signal.
+func interruptionSignal(config Config) string {
+	if config.Run.InterruptionSignal != "" {
+		return config.Run.InterruptionSignal
+	}
+	return DefaultInterruptionSignal
+}
+
+// signalContainer sends signal to the running container on the daemon at
+// dockerHost.
+func signalContainer(dockerHost, container, signal string) {
+	Log("Sending %s to container %s", signal, container)
+	cmd := dockerCommand(context.Background(), dockerHost, "kill", "--signal", signal, container)
+	if err := cmd.Run(); err != nil {
+		Log("Error signaling container: %v", err)
+	}
+}
+
+// Run runs on device like Device.Run. When the provider interrupts a
+// non-detached run, a replacement device is provisioned and the run is
+// retried up to `run.interruption_retries` times.
+func (c *Client) Run(ctx context.Context, device Device, detach bool, args []string) (RunResult, error) {
+	for attempt := 0; ; attempt++ {
+		result, err := device.Run(ctx, detach, args)
+		if !errors.Is(err, ErrInterrupted) || attempt >= c.config.Run.InterruptionRetries {
+			return result, err
+		}
+
+		Log("Device %s was interrupted, provisioning a replacement (retry %d of %d)", device.ID(), attempt+1, c.config.Run.InterruptionRetries)
+		device, err = c.Provision(ctx)
+		if err != nil {
+			return result, fmt.Errorf("provisioning replacement after interruption: %w", err)
+		}
+	}
+}
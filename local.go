@@ -0,0 +1,564 @@
+package spt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Defaults of local VMs.
+const (
+	DefaultLocalCPUs     = 2
+	DefaultLocalMemory   = 4096
+	DefaultLocalDiskSize = 20
+)
+
+// localImages are the cloud images local VMs boot by default, by GOARCH.
+var localImages = map[string]string{
+	"amd64": "https://cloud-images.ubuntu.com/jammy/current/jammy-server-cloudimg-amd64.img",
+	"arm64": "https://cloud-images.ubuntu.com/jammy/current/jammy-server-cloudimg-arm64.img",
+}
+
+// localProduct is the SMBIOS product name of local VMs, by which spt
+// recognizes that it runs on one.
+const localProduct = "spt-local"
+
+// Local QEMU provider
+type localProvider struct {
+	config Config
+}
+
+func NewLocalProvider(cfg Config) (Provider, error) {
+	return &localProvider{config: cfg}, nil
+}
+
+func (p *localProvider) Name() string {
+	return "local"
+}
+
+// dir returns the directory holding the images and VMs.
+func (p *localProvider) dir() (string, error) {
+	if dir := p.config.Service.Local.Dir; dir != "" {
+		return dir, nil
+	}
+	path, err := StatePath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(path), "local"), nil
+}
+
+// localVM is the record of a VM, kept in its directory.
+type localVM struct {
+	ID      string    `json:"id"`
+	Port    int       `json:"port"`
+	Accel   string    `json:"accel"`
+	CPUs    int       `json:"cpus"`
+	Memory  int       `json:"memory"`
+	Project string    `json:"project"`
+	Owner   string    `json:"owner"`
+	Created time.Time `json:"created_at"`
+}
+
+func (p *localProvider) Provision(ctx context.Context) (Device, error) {
+	config := p.config
+	local := config.Service.Local
+
+	accel, err := localAccel(local.Accel)
+	if err != nil {
+		return nil, err
+	}
+	vm := localVM{
+		ID:     newDeviceName(config.Project.Name),
+		Accel:  accel,
+		CPUs:   local.CPUs,
+		Memory: local.Memory,
+	}
+	if vm.CPUs == 0 {
+		vm.CPUs = DefaultLocalCPUs
+	}
+	if vm.Memory == 0 {
+		vm.Memory = DefaultLocalMemory
+	}
+	diskSize := local.DiskSize
+	if diskSize == 0 {
+		diskSize = DefaultLocalDiskSize
+	}
+
+	emit(Event{
+		Type:         EventProvisionRequested,
+		Provider:     p.Name(),
+		Location:     "local",
+		InstanceType: "qemu-" + accel,
+		Message:      fmt.Sprintf("Provisioning local VM with %d vCPUs and %d MiB under QEMU (%s)", vm.CPUs, vm.Memory, accel),
+	})
+	if accel == "tcg" {
+		Log("Warning: /dev/kvm is not usable, the VM is emulated and slow")
+	}
+
+	dir, err := p.dir()
+	if err != nil {
+		return nil, err
+	}
+	image, err := localImage(ctx, filepath.Join(dir, "images"), local.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKey, err := newHostKey()
+	if err != nil {
+		return nil, err
+	}
+	loginKey, err := newDeviceKey()
+	if err != nil {
+		return nil, err
+	}
+
+	script := userScript + readyScript
+	if ttl := config.Run.MaxDuration; ttl > 0 {
+		// QEMU exits when the VM powers off, which leaves its disk to
+		// `spt gc`.
+		script = armTTL(script, ttlScript(ttl))
+		Log("VM will be powered off after %s", ttl)
+	}
+	script = loginKey.authorize(hostKey.install(script))
+
+	// cloud-init fetches its NoCloud seed over HTTP from the host, which
+	// saves building a seed ISO.
+	seed, err := serveLocalSeed(vm.ID, script)
+	if err != nil {
+		return nil, err
+	}
+	defer seed.Close()
+
+	tags := newTags(config)
+	vm.Project = tags.Project
+	vm.Owner = tags.Owner
+	vm.Created = tags.CreatedAt
+	if vm.Port, err = freePort(); err != nil {
+		return nil, err
+	}
+
+	vmDir := filepath.Join(dir, "vms", vm.ID)
+	if err = os.MkdirAll(vmDir, 0o700); err != nil {
+		return nil, err
+	}
+	if err = writeLocalVM(vmDir, vm); err != nil {
+		os.RemoveAll(vmDir)
+		return nil, err
+	}
+
+	return finishProvisioning(ctx, vm.ID,
+		func(ctx context.Context) (Device, error) { return p.start(ctx, vm, vmDir, image, diskSize, seed) },
+		func(ctx context.Context) error { return p.Delete(ctx, vm.ID) },
+		hostKey, loginKey, config)
+}
+
+// start creates the disk of vm on top of image and boots it, with the
+// cloud-init seed served by seed.
+func (p *localProvider) start(ctx context.Context, vm localVM, vmDir, image string, diskSize int, seed net.Listener) (Device, error) {
+	disk := filepath.Join(vmDir, "disk.qcow2")
+	out, err := exec.CommandContext(ctx, "qemu-img", "create", "-q", "-f", "qcow2", "-F", "qcow2", "-b", image, disk, strconv.Itoa(diskSize)+"G").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("creating disk: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	args, err := p.qemuArgs(vm, vmDir, disk, seed.Addr().(*net.TCPAddr).Port)
+	if err != nil {
+		return nil, err
+	}
+	// The VM outlives spt, QEMU daemonizes once the VM is set up.
+	out, err = exec.Command(p.qemu(), args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("starting QEMU: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	device := p.newVM(vm, vmDir)
+	emit(Event{
+		Type:         EventInstanceRunning,
+		Provider:     p.Name(),
+		DeviceID:     vm.ID,
+		IP:           device.IP(),
+		Location:     "local",
+		InstanceType: device.InstanceType(),
+		Message:      fmt.Sprintf("VM is running with SSH at %s, console log at %s", device.IP(), filepath.Join(vmDir, "console.log")),
+	})
+	return device, nil
+}
+
+// qemu returns the system emulator to run.
+func (p *localProvider) qemu() string {
+	if qemu := p.config.Service.Local.QEMU; qemu != "" {
+		return qemu
+	}
+	if runtime.GOARCH == "arm64" {
+		return "qemu-system-aarch64"
+	}
+	return "qemu-system-x86_64"
+}
+
+// qemuArgs returns the QEMU command line of vm. The VM's SSH port is
+// forwarded to the loopback interface and cloud-init reads its seed from
+// seedPort on the host.
+func (p *localProvider) qemuArgs(vm localVM, vmDir, disk string, seedPort int) ([]string, error) {
+	cpu := "host"
+	if vm.Accel == "tcg" {
+		cpu = "max"
+	}
+
+	var machine []string
+	switch runtime.GOARCH {
+	case "amd64":
+		machine = []string{"-machine", "q35,accel=" + vm.Accel}
+	case "arm64":
+		firmware := p.config.Service.Local.Firmware
+		if firmware == "" {
+			firmware = "/usr/share/qemu-efi-aarch64/QEMU_EFI.fd"
+		}
+		machine = []string{"-machine", "virt,accel=" + vm.Accel, "-bios", firmware}
+	default:
+		return nil, fmt.Errorf("local VMs are not supported on %s", runtime.GOARCH)
+	}
+
+	return append(machine,
+		"-name", vm.ID,
+		"-cpu", cpu,
+		"-smp", strconv.Itoa(vm.CPUs),
+		"-m", strconv.Itoa(vm.Memory),
+		"-drive", "file="+qemuEscape(disk)+",if=virtio,format=qcow2",
+		"-netdev", fmt.Sprintf("user,id=net0,hostfwd=tcp:127.0.0.1:%d-:22", vm.Port),
+		"-device", "virtio-net-pci,netdev=net0",
+		"-smbios", fmt.Sprintf("type=1,manufacturer=spt,product=%s,serial=ds=nocloud-net;s=http://10.0.2.2:%d/", localProduct, seedPort),
+		"-display", "none",
+		"-serial", "file:"+qemuEscape(filepath.Join(vmDir, "console.log")),
+		"-pidfile", filepath.Join(vmDir, "qemu.pid"),
+		"-daemonize",
+	), nil
+}
+
+// qemuEscape escapes the commas of an option value, which QEMU otherwise
+// takes for the start of the next option.
+func qemuEscape(v string) string {
+	return strings.ReplaceAll(v, ",", ",,")
+}
+
+func (p *localProvider) Attach(ctx context.Context, id string) (Device, error) {
+	device, err := p.find(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if device.State() != "running" {
+		return nil, fmt.Errorf("local VM %s is not running", id)
+	}
+
+	Log("Attached to local VM %s at %s", id, device.IP())
+	return device, nil
+}
+
+// List returns the VMs of the configured project, running or not.
+func (p *localProvider) List(ctx context.Context) ([]Device, error) {
+	dir, err := p.dir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "vms"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []Device
+	for _, entry := range entries {
+		device, err := p.find(entry.Name())
+		if err != nil {
+			Log("Skipping local VM %s: %v", entry.Name(), err)
+			continue
+		}
+		if device.vm.Project == p.config.Project.Name {
+			devices = append(devices, device)
+		}
+	}
+
+	return devices, nil
+}
+
+func (p *localProvider) Delete(ctx context.Context, id string) error {
+	device, err := p.find(id)
+	if err != nil {
+		return err
+	}
+	return device.Delete(ctx)
+}
+
+// Self recognizes a local VM by its SMBIOS product name.
+func (p *localProvider) Self(ctx context.Context) (Device, error) {
+	product, err := os.ReadFile("/sys/class/dmi/id/product_name")
+	if err != nil || strings.TrimSpace(string(product)) != localProduct {
+		return nil, nil
+	}
+
+	hostname, _ := os.Hostname()
+	Log("Detected local VM: %s", hostname)
+
+	return &LocalVM{vm: localVM{ID: hostname}, self: true}, nil
+}
+
+// find returns the VM with the given ID.
+func (p *localProvider) find(id string) (*LocalVM, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+		return nil, fmt.Errorf("invalid local VM ID %q", id)
+	}
+
+	dir, err := p.dir()
+	if err != nil {
+		return nil, err
+	}
+	vmDir := filepath.Join(dir, "vms", id)
+
+	data, err := os.ReadFile(filepath.Join(vmDir, "vm.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("local VM %s not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var vm localVM
+	if err := json.Unmarshal(data, &vm); err != nil {
+		return nil, fmt.Errorf("reading local VM %s: %w", id, err)
+	}
+
+	return p.newVM(vm, vmDir), nil
+}
+
+func (p *localProvider) newVM(vm localVM, vmDir string) *LocalVM {
+	return &LocalVM{vm: vm, dir: vmDir, config: p.config}
+}
+
+func writeLocalVM(vmDir string, vm localVM) error {
+	data, err := json.MarshalIndent(vm, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(vmDir, "vm.json"), data, 0o600)
+}
+
+// localAccel returns the accelerator to run VMs with: accel if set, else
+// kvm when /dev/kvm can be opened and tcg otherwise.
+func localAccel(accel string) (string, error) {
+	switch accel {
+	case "kvm", "tcg":
+		return accel, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown accel %q, expected kvm or tcg", accel)
+	}
+
+	if runtime.GOOS != "linux" {
+		return "tcg", nil
+	}
+	kvm, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return "tcg", nil
+	}
+	kvm.Close()
+	return "kvm", nil
+}
+
+// localImage returns the path of the cloud image to boot, downloading it
+// into cacheDir first when image is a URL.
+func localImage(ctx context.Context, cacheDir, image string) (string, error) {
+	if image == "" {
+		image = localImages[runtime.GOARCH]
+		if image == "" {
+			return "", fmt.Errorf("no default image for %s, set image", runtime.GOARCH)
+		}
+	}
+	if !strings.HasPrefix(image, "http://") && !strings.HasPrefix(image, "https://") {
+		return filepath.Abs(image)
+	}
+
+	cached := filepath.Join(cacheDir, path.Base(image))
+	if _, err := os.Stat(cached); err == nil {
+		return cached, nil
+	}
+
+	Log("Downloading %s", image)
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", image, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("downloading %s: %s", image, resp.Status)
+	}
+
+	// Download next to the cached file so that an interrupted download is
+	// never mistaken for the image.
+	tmp, err := os.CreateTemp(cacheDir, ".download-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("downloading %s: %w", image, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	return cached, os.Rename(tmp.Name(), cached)
+}
+
+// serveLocalSeed serves the NoCloud seed of the VM id on the loopback
+// interface, which QEMU's user networking exposes to the VM as 10.0.2.2.
+func serveLocalSeed(id, userData string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]string{
+		"/meta-data":   "instance-id: " + id + "\nlocal-hostname: " + id + "\n",
+		"/user-data":   userData,
+		"/vendor-data": "",
+	}
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, content)
+	}))
+
+	return listener, nil
+}
+
+// freePort returns a TCP port on the loopback interface that is currently
+// free.
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// Local QEMU implementation
+type LocalVM struct {
+	vm     localVM
+	dir    string
+	config Config
+	// self is set for the VM spt runs on.
+	self bool
+}
+
+// ID returns the VM name.
+func (c *LocalVM) ID() string {
+	return c.vm.ID
+}
+
+// IP returns the forwarded SSH address of the VM, as host:port.
+func (c *LocalVM) IP() string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(c.vm.Port))
+}
+
+// Location returns "local".
+func (c *LocalVM) Location() string {
+	return "local"
+}
+
+// InstanceType returns the emulator and accelerator of the VM.
+func (c *LocalVM) InstanceType() string {
+	return "qemu-" + c.vm.Accel
+}
+
+// State returns "running" while QEMU runs the VM, "stopped" otherwise.
+func (c *LocalVM) State() string {
+	if c.process() == nil {
+		return "stopped"
+	}
+	return "running"
+}
+
+func (c *LocalVM) Tags() Tags {
+	return Tags{Project: c.vm.Project, Owner: c.vm.Owner, CreatedAt: c.vm.Created}
+}
+
+// process returns the QEMU process of the VM, or nil if it is not running.
+func (c *LocalVM) process() *os.Process {
+	data, err := os.ReadFile(filepath.Join(c.dir, "qemu.pid"))
+	if err != nil {
+		return nil
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil || process.Signal(syscall.Signal(0)) != nil {
+		return nil
+	}
+	return process
+}
+
+func (c *LocalVM) Run(ctx context.Context, detach bool, args []string) (RunResult, error) {
+	return runAndDelete(ctx, "local", c, c.config, detach, args)
+}
+
+// Delete stops QEMU and removes the VM's disk. On the VM itself, it powers
+// the VM off, after which QEMU exits and the disk is left for `spt gc`.
+func (c *LocalVM) Delete(ctx context.Context) error {
+	Log("Deleting the local VM")
+
+	if c.self {
+		Log("Powering off local VM %s", c.vm.ID)
+		if out, err := exec.CommandContext(ctx, "systemctl", "poweroff").CombinedOutput(); err != nil {
+			return fmt.Errorf("error powering off: %w: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+
+	if process := c.process(); process != nil {
+		if err := process.Signal(syscall.SIGTERM); err != nil {
+			return fmt.Errorf("stopping QEMU: %w", err)
+		}
+		for c.process() != nil {
+			if err := sleep(ctx, 100*time.Millisecond); err != nil {
+				return err
+			}
+		}
+	}
+
+	return os.RemoveAll(c.dir)
+}
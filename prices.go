@@ -0,0 +1,66 @@
+package spt
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// AutoLocation lets the provider pick the cheapest location whose current
+// spot price is under the configured maximum.
+const AutoLocation = "auto"
+
+// Price is the current spot price of an instance type in one location.
+type Price struct {
+	// Location is an availability zone or metro.
+	Location     string  `json:"location"`
+	InstanceType string  `json:"instance_type"`
+	Price        float64 `json:"price"`
+}
+
+// PriceLister is implemented by providers that can report current spot
+// prices for the configured instance types.
+type PriceLister interface {
+	Prices(ctx context.Context) ([]Price, error)
+}
+
+// Prices returns the current spot prices for the configured instance types,
+// cheapest first.
+func (c *Client) Prices(ctx context.Context) ([]Price, error) {
+	lister, ok := c.provider.(PriceLister)
+	if !ok {
+		return nil, fmt.Errorf("provider %s does not support price discovery", c.provider.Name())
+	}
+
+	prices, err := lister.Prices(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sortPrices(prices)
+	return prices, nil
+}
+
+func sortPrices(prices []Price) {
+	sort.SliceStable(prices, func(i, j int) bool {
+		return prices[i].Price < prices[j].Price
+	})
+}
+
+// cheapestPrice returns the cheapest price that does not exceed max. A zero
+// max accepts any price.
+func cheapestPrice(ctx context.Context, lister PriceLister, max float32) (Price, error) {
+	prices, err := lister.Prices(ctx)
+	if err != nil {
+		return Price{}, err
+	}
+
+	sortPrices(prices)
+	for _, price := range prices {
+		if max == 0 || price.Price <= float64(max) {
+			return price, nil
+		}
+	}
+
+	return Price{}, fmt.Errorf("%w: no location has a spot price under %v", ErrPriceTooLow, max)
+}
@@ -0,0 +1,172 @@
+package spt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNoCapacity is wrapped by Provision errors when the provider had no
+	// capacity for the request, including when it reclaimed the device
+	// before it was ready.
+	ErrNoCapacity = errors.New("no capacity")
+	// ErrPriceTooLow is wrapped by Provision errors when the maximum spot
+	// price is below the market price.
+	ErrPriceTooLow = errors.New("spot price too low")
+)
+
+// Provider is a backend that can provision and manage spot devices.
+type Provider interface {
+	// Name returns the name the provider was registered under.
+	Name() string
+	// Provision creates a new device and waits until it is reachable.
+	Provision(ctx context.Context) (Device, error)
+	// Attach returns a handle to an existing device.
+	Attach(ctx context.Context, id string) (Device, error)
+	// List returns the devices spt has created with this provider.
+	List(ctx context.Context) ([]Device, error)
+	// Delete deprovisions the device with the given ID.
+	Delete(ctx context.Context, id string) error
+	// Self returns the device the current process is running on, or nil if
+	// the current machine does not belong to this provider.
+	Self(ctx context.Context) (Device, error)
+}
+
+// ProviderFactory describes how to construct a registered Provider.
+type ProviderFactory struct {
+	// Configured reports whether cfg selects this provider.
+	Configured func(cfg Config) bool
+	// New creates the provider from cfg.
+	New func(cfg Config) (Provider, error)
+	// Fallbacks returns alternative configurations to provision with, in
+	// order, when provisioning with cfg fails with ErrNoCapacity or
+	// ErrPriceTooLow. Optional.
+	Fallbacks func(cfg Config) []Fallback
+	// Locate returns cfg adjusted to manage devices in location, as reported
+	// by the device's Location method. Optional.
+	Locate func(cfg Config, location string) Config
+}
+
+// Fallback is an alternative configuration for Client.Provision to try.
+type Fallback struct {
+	// Description names the candidate in logs, e.g. "c6i.metal in us-east-1".
+	Description string
+	Config      Config
+}
+
+// reconfigurable is implemented by providers that can create a provider like
+// themselves for another configuration, keeping the API clients injected
+// into them. Client.Provision uses it for fallbacks.
+type reconfigurable interface {
+	withConfig(cfg Config) (Provider, error)
+}
+
+type registeredProvider struct {
+	name    string
+	factory ProviderFactory
+}
+
+var providers []registeredProvider
+
+func init() {
+	RegisterProvider("aws", ProviderFactory{
+		Configured: func(cfg Config) bool { return cfg.Service.AWS.Region != "" },
+		New:        func(cfg Config) (Provider, error) { return NewAWSProvider(cfg) },
+		Fallbacks:  awsFallbacks,
+		Locate: func(cfg Config, region string) Config {
+			cfg.Service.AWS.Region = region
+			return cfg
+		},
+	})
+	RegisterProvider("equinix", ProviderFactory{
+		Configured: func(cfg Config) bool {
+			equinix := cfg.Service.Equinix
+			return equinix.Project != "" || equinix.ApiKey != "" || equinix.Plan != ""
+		},
+		New:       func(cfg Config) (Provider, error) { return NewEquinixProvider(cfg) },
+		Fallbacks: equinixFallbacks,
+	})
+	RegisterProvider("gce", ProviderFactory{
+		Configured: func(cfg Config) bool { return cfg.Service.GCE.Project != "" },
+		New:        NewGCEProvider,
+		Locate: func(cfg Config, zone string) Config {
+			cfg.Service.GCE.Zone = zone
+			return cfg
+		},
+	})
+	RegisterProvider("azure", ProviderFactory{
+		Configured: func(cfg Config) bool { return cfg.Service.Azure.SubscriptionID != "" },
+		New:        func(cfg Config) (Provider, error) { return NewAzureProvider(cfg) },
+		Locate: func(cfg Config, location string) Config {
+			cfg.Service.Azure.Location = location
+			return cfg
+		},
+	})
+	RegisterProvider("hetzner", ProviderFactory{
+		Configured: func(cfg Config) bool { return cfg.Service.Hetzner.ServerType != "" },
+		New:        NewHetznerProvider,
+		Locate: func(cfg Config, location string) Config {
+			cfg.Service.Hetzner.Location = location
+			return cfg
+		},
+	})
+	RegisterProvider("local", ProviderFactory{
+		Configured: func(cfg Config) bool { return cfg.Service.Local != Config{}.Service.Local },
+		New:        NewLocalProvider,
+	})
+}
+
+// RegisterProvider makes a provider available under name. Providers are
+// consulted in registration order when selecting a backend from the
+// configuration and when detecting the current machine. Registering a name
+// twice replaces the previous factory.
+func RegisterProvider(name string, factory ProviderFactory) {
+	for i, p := range providers {
+		if p.name == name {
+			providers[i].factory = factory
+			return
+		}
+	}
+
+	providers = append(providers, registeredProvider{name: name, factory: factory})
+}
+
+// Providers returns the names of all registered providers.
+func Providers() []string {
+	names := make([]string, len(providers))
+	for i, p := range providers {
+		names[i] = p.name
+	}
+	return names
+}
+
+func lookupProvider(name string) (ProviderFactory, bool) {
+	for _, p := range providers {
+		if p.name == name {
+			return p.factory, true
+		}
+	}
+	return ProviderFactory{}, false
+}
+
+// NewProvider creates the provider selected by cfg. An explicit
+// `service.provider` takes precedence, otherwise the first registered
+// provider whose section is configured is used.
+func NewProvider(cfg Config) (Provider, error) {
+	if name := cfg.Service.Provider; name != "" {
+		factory, ok := lookupProvider(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown provider: %s", name)
+		}
+		return factory.New(cfg)
+	}
+
+	for _, p := range providers {
+		if p.factory.Configured != nil && p.factory.Configured(cfg) {
+			return p.factory.New(cfg)
+		}
+	}
+
+	return nil, fmt.Errorf("no provider configured")
+}
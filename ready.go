@@ -0,0 +1,162 @@
+package spt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultReadyTimeout bounds how long spt waits for a device to finish its
+// setup when `service.ready_timeout` is not set.
+const DefaultReadyTimeout = 20 * time.Minute
+
+// readyPollInterval is how often a device is checked for the readiness
+// marker.
+var readyPollInterval = 5 * time.Second
+
+// runningPollInterval is how often a new device is checked until it runs.
+var runningPollInterval = 5 * time.Second
+
+// readyMarker is written by the user-data script once setup finished.
+const readyMarker = "/var/lib/spt/ready"
+
+// readyScript is appended to the user-data script, after every other step,
+// to record that the device is ready along with what was set up. The script
+// fails, and cloud-init reports an error, when docker is not usable.
+const readyScript = `
+# Readiness marker polled by spt
+docker_version=$(docker version --format '{{.Server.Version}}') || exit 1
+mkdir -p /var/lib/spt
+cat > ` + readyMarker + `.tmp << EOL
+{"docker_version": "$docker_version", "setup_seconds": $(( $(date +%s) - spt_started ))}
+EOL
+mv ` + readyMarker + `.tmp ` + readyMarker + `
+`
+
+// readiness is the content of the readiness marker.
+type readiness struct {
+	DockerVersion string `json:"docker_version"`
+	SetupSeconds  int    `json:"setup_seconds"`
+}
+
+// readyTimeout returns the configured readiness timeout.
+func readyTimeout(cfg Config) time.Duration {
+	if cfg.Service.ReadyTimeout > 0 {
+		return cfg.Service.ReadyTimeout
+	}
+	return DefaultReadyTimeout
+}
+
+// waitReady connects to device and waits until its user-data script wrote
+// the readiness marker. It fails early when cloud-init reports an error,
+// including the tail of the cloud-init output in the error.
+func waitReady(ctx context.Context, device Device, timeout time.Duration) (*sshClient, error) {
+	deadline := time.Now().Add(timeout)
+
+	client, err := dialDevice(ctx, device, deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		if out, err := client.Output("cat " + readyMarker); err == nil {
+			var ready readiness
+			if err := json.Unmarshal(out, &ready); err != nil {
+				client.Close()
+				return nil, fmt.Errorf("reading readiness marker: %w", err)
+			}
+
+			emit(Event{
+				Type:     EventDeviceReady,
+				DeviceID: device.ID(),
+				IP:       device.IP(),
+				Message:  fmt.Sprintf("Device is ready: docker %s, setup took %ds", ready.DockerVersion, ready.SetupSeconds),
+			})
+			return client, nil
+		}
+
+		status, err := client.Output("cloud-init status")
+		if err != nil {
+			// cloud-init exits non-zero once setup failed, the status is
+			// still printed.
+			if _, ok := sshExitStatus(err); !ok {
+				client.Close()
+				return nil, err
+			}
+		}
+
+		failed := strings.Contains(string(status), "status: error")
+		if strings.Contains(string(status), "status: done") {
+			// The marker may have been written since it was checked.
+			if _, err := client.Output("test -f " + readyMarker); err == nil {
+				continue
+			}
+			failed = true
+		}
+		if failed {
+			tail, _ := client.Output("tail -n 20 /var/log/cloud-init-output.log")
+			client.Close()
+			return nil, fmt.Errorf("device setup failed (%s), cloud-init output:\n%s", strings.TrimSpace(string(status)), tail)
+		}
+
+		if time.Now().After(deadline) {
+			client.Close()
+			return nil, fmt.Errorf("device was not ready after %s", timeout)
+		}
+
+		if err := sleep(ctx, readyPollInterval); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+}
+
+// finishProvisioning completes the provisioning of the created device id:
+// it waits for the device to run with running, pins its host key, saves its
+// login key and waits until it is ready. A device that fails any of these
+// steps, or whose provisioning is canceled, is deleted with del rather than
+// left running.
+func finishProvisioning(ctx context.Context, id string, running func(ctx context.Context) (Device, error), del func(ctx context.Context) error, hostKey *hostKey, loginKey *deviceKey, cfg Config) (device Device, err error) {
+	// pinned is set once the keys of the device may have been stored.
+	pinned := false
+	defer func() {
+		if err != nil {
+			Log("Deleting device %s", id)
+			if delErr := del(context.WithoutCancel(ctx)); delErr != nil {
+				Log("Error deleting device %s: %v", id, delErr)
+			}
+			if pinned {
+				if err := unpinHostKey(id); err != nil {
+					Log("Error removing host key: %v", err)
+				}
+				if err := removeDeviceKey(id); err != nil {
+					Log("Error removing device key: %v", err)
+				}
+			}
+		}
+	}()
+
+	device, err = running(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pinned = true
+	if err = pinHostKey(id, device.IP(), hostKey.public); err != nil {
+		return nil, fmt.Errorf("pinning host key: %w", err)
+	}
+	if err = saveDeviceKey(id, loginKey); err != nil {
+		return nil, fmt.Errorf("saving device key: %w", err)
+	}
+
+	Log("Waiting for the device to finish its setup...")
+	client, err := waitReady(ctx, device, readyTimeout(cfg))
+	if err != nil {
+		return nil, err
+	}
+	client.Close()
+
+	return device, nil
+}
@@ -0,0 +1,62 @@
+package spt
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFinishProvisioningForgetsKeysOnFailure(t *testing.T) {
+	t.Setenv("SPT_STATE_FILE", filepath.Join(t.TempDir(), "state.json"))
+	t.Setenv("SSH_AUTH_SOCK", "")
+	defer SetPollIntervals(10 * time.Millisecond)()
+
+	// Nothing listens on the device's port, so it never becomes ready.
+	port, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := port.Addr().String()
+	port.Close()
+
+	hostKey, err := newHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginKey, err := newDeviceKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg Config
+	cfg.Service.ReadyTimeout = 100 * time.Millisecond
+	server := &HetznerServer{id: 1, ip: addr}
+	id := server.ID()
+
+	deleted := false
+	_, err = finishProvisioning(context.Background(), id,
+		func(ctx context.Context) (Device, error) { return server, nil },
+		func(ctx context.Context) error { deleted = true; return nil },
+		hostKey, loginKey, cfg)
+	if err == nil {
+		t.Fatal("finishProvisioning() succeeded on an unreachable device")
+	}
+	if !deleted {
+		t.Error("device was not deleted")
+	}
+
+	knownHosts, err := KnownHostsPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(knownHosts); err == nil && strings.Contains(string(data), " "+id+"\n") {
+		t.Errorf("host key still pinned:\n%s", data)
+	}
+	if signer, err := loadDeviceKey(id); err != nil || signer != nil {
+		t.Errorf("loadDeviceKey() = %v, %v, want no key", signer, err)
+	}
+}
@@ -0,0 +1,38 @@
+package spt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// SignalError is the cancellation cause of a run stopped by a signal. spt
+// does not trap signals itself: a program that does cancels the context it
+// passed to Provision or Run with context.WithCancelCause and a
+// *SignalError, and a non-detached run forwards the signal to the container
+// before deleting the device.
+type SignalError struct {
+	Signal os.Signal
+}
+
+func (e *SignalError) Error() string {
+	return fmt.Sprintf("stopped by %s", e.Signal)
+}
+
+// stoppedBy returns the error of a run whose ctx was canceled: the
+// *SignalError it was canceled with, or ctx.Err().
+func stoppedBy(ctx context.Context) error {
+	return context.Cause(ctx)
+}
+
+// containerSignal returns the name of the signal to forward to the container
+// once ctx is canceled, as understood by `docker kill`: SIGINT when ctx was
+// canceled by an interrupt and SIGTERM otherwise.
+func containerSignal(ctx context.Context) string {
+	var sigErr *SignalError
+	if errors.As(context.Cause(ctx), &sigErr) && sigErr.Signal == os.Interrupt {
+		return "SIGINT"
+	}
+	return "SIGTERM"
+}
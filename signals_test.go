@@ -0,0 +1,34 @@
+package spt
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestStoppedBy(t *testing.T) {
+	tests := []struct {
+		name       string
+		cause      error
+		wantErr    string
+		wantSignal string
+	}{
+		{"canceled", nil, "context canceled", "SIGTERM"},
+		{"interrupt", &SignalError{Signal: os.Interrupt}, "stopped by interrupt", "SIGINT"},
+		{"terminate", &SignalError{Signal: syscall.SIGTERM}, "stopped by terminated", "SIGTERM"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancelCause(context.Background())
+			cancel(tt.cause)
+
+			if err := stoppedBy(ctx); err == nil || err.Error() != tt.wantErr {
+				t.Errorf("stoppedBy() = %v, want %s", err, tt.wantErr)
+			}
+			if got := containerSignal(ctx); got != tt.wantSignal {
+				t.Errorf("containerSignal() = %q, want %q", got, tt.wantSignal)
+			}
+		})
+	}
+}
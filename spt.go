@@ -2,22 +2,15 @@ package spt
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"net/http"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/ec2"
-	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
-	"github.com/equinix/equinix-sdk-go/services/metalv1"
-	metal "github.com/equinix/equinix-sdk-go/services/metalv1"
 )
 
 type (
@@ -26,31 +19,174 @@ type (
 		Project Project
 		Build   Build
 		Run     Run
+		GC      GC
 	}
 
 	Service struct {
-		Equinix struct {
-			Project         string
+		Provider string
+		// ReadyTimeout bounds how long spt waits for a new device to
+		// accept SSH connections and finish its setup.
+		ReadyTimeout time.Duration `toml:"ready_timeout"`
+		Equinix      struct {
+			Project string
+			// ApiKey mints every device an API key of its own for
+			// `spt self --delete`. Metal cannot scope API keys below
+			// the project, so a device key can manage the whole
+			// project until it is revoked: with the device, by the
+			// device itself shortly before run.max_duration expires,
+			// or by `spt gc`.
 			ApiKey          string  `toml:"api_key"`
 			SpotPriceMax    float32 `toml:"spot_price_max"`
 			Plan            string
 			OperatingSystem string `toml:"os"`
+			Metro           string
+			// Fallback plans and metros are tried in order when the
+			// device cannot be provisioned with Plan in Metro.
+			Fallback         []string
+			FallbackMetros   []string `toml:"fallback_metros"`
+			OnDemand         bool     `toml:"on_demand"`
+			OnDemandFallback bool     `toml:"on_demand_fallback"`
+			// Endpoint overrides the Metal API URL, e.g. to point spt at
+			// a fake API.
+			Endpoint string
 		}
 		AWS struct {
-			Region        string
-			AccessKey     string `toml:"access_key"`
-			SecretKey     string `toml:"secret_key"`
-			InstanceType  string `toml:"instance_type"`
-			AMI           string
-			SecurityGroup string  `toml:"security_group"`
-			SpotPriceMax  float32 `toml:"spot_price_max"`
-			KeyName       string  `toml:"key_name"`
-			VolumeSize    int     `toml:"volume_size"`
+			Region       string
+			AccessKey    string `toml:"access_key"`
+			SecretKey    string `toml:"secret_key"`
+			InstanceType string `toml:"instance_type"`
+			// InstanceTypes, Subnets and AvailabilityZones widen the spot
+			// pools the fleet may launch into.
+			InstanceTypes      []string `toml:"instance_types"`
+			Subnets            []string
+			AvailabilityZones  []string `toml:"availability_zones"`
+			AllocationStrategy string   `toml:"allocation_strategy"`
+			AMI                string
+			SecurityGroup      string  `toml:"security_group"`
+			SpotPriceMax       float32 `toml:"spot_price_max"`
+			KeyName            string  `toml:"key_name"`
+			VolumeSize         int     `toml:"volume_size"`
+			// IAMInstanceProfile is the name or ARN of the instance profile
+			// the instance uses to terminate itself.
+			IAMInstanceProfile string `toml:"iam_instance_profile"`
+			// EmbedAccessKeys writes the access keys above to the
+			// instance's user-data for `spt self --delete` when no
+			// instance profile is set. Anyone who can read the user-data
+			// or run code on the instance gets the keys.
+			EmbedAccessKeys bool `toml:"embed_access_keys"`
+			// Fallback instance types and regions are tried in order when
+			// no instance can be launched with the settings above.
+			Fallback         []string
+			FallbackRegions  []AWSRegion `toml:"fallback_regions"`
+			OnDemand         bool        `toml:"on_demand"`
+			OnDemandFallback bool        `toml:"on_demand_fallback"`
+			// Endpoint overrides the EC2 API URL, e.g. to point spt at a
+			// fake API.
+			Endpoint string
+		}
+		GCE struct {
+			Project     string
+			Zone        string
+			MachineType string `toml:"machine_type"`
+			// Image is the boot image, the latest Ubuntu 22.04 LTS image
+			// by default.
+			Image    string
+			DiskSize int `toml:"disk_size"`
+			Network  string
+			// ServiceAccount is the email of the service account the VM
+			// runs as and deletes itself with, the Compute Engine default
+			// service account when empty.
+			ServiceAccount string `toml:"service_account"`
+			// CredentialsFile is a service account key file. Without it,
+			// GOOGLE_APPLICATION_CREDENTIALS, GOOGLE_OAUTH_ACCESS_TOKEN
+			// and the metadata server are tried in order.
+			CredentialsFile string `toml:"credentials_file"`
+			// Endpoint overrides the Compute Engine API URL, e.g. to point
+			// spt at a fake API.
+			Endpoint string
+		}
+		Azure struct {
+			SubscriptionID string `toml:"subscription_id"`
+			ResourceGroup  string `toml:"resource_group"`
+			Location       string
+			VMSize         string `toml:"vm_size"`
+			// Image is the URN of the boot image, publisher:offer:sku:version,
+			// Ubuntu 22.04 LTS by default.
+			Image    string
+			DiskSize int `toml:"disk_size"`
+			// Subnet is the resource ID of the subnet VMs are attached to.
+			// Its network security group must allow SSH from spt.
+			Subnet string
+			// SpotPriceMax is the maximum price per hour in US dollars, up
+			// to the pay-as-you-go price when unset.
+			SpotPriceMax float32 `toml:"spot_price_max"`
+			// Identity is the resource ID of the user-assigned managed
+			// identity the VM deletes itself with.
+			Identity string
+			// A service principal to authenticate with. Without a client
+			// secret, the Azure SDK's default credential is used, such as
+			// the managed identity of the current VM or the Azure CLI
+			// login.
+			TenantID     string `toml:"tenant_id"`
+			ClientID     string `toml:"client_id"`
+			ClientSecret string `toml:"client_secret"`
+			// Endpoint overrides the Azure Resource Manager URL, e.g. to
+			// point spt at a stub server.
+			Endpoint string
+		}
+		Hetzner struct {
+			// Token is the API token of the Hetzner Cloud project.
+			Token string
+			// SelfDelete writes the token above to the server's
+			// user-data and /opt/spt for `spt self --delete` and
+			// `run.max_duration`. Anyone who can read the user-data or
+			// run code on the server gets the token, which controls the
+			// whole project.
+			SelfDelete bool   `toml:"self_delete"`
+			ServerType string `toml:"server_type"`
+			Location   string
+			Image      string
+			// SSHKeys are names of SSH keys in the project to authorize
+			// for root in addition to spt's own key.
+			SSHKeys []string `toml:"ssh_keys"`
+			// Endpoint overrides the Hetzner Cloud API URL, e.g. to point
+			// spt at a fake API.
+			Endpoint string
 		}
+		// Local boots VMs on this machine under QEMU.
+		Local struct {
+			// Image is the URL or path of the cloud image to boot, the
+			// Ubuntu 22.04 cloud image for this architecture by default.
+			Image string
+			CPUs  int `toml:"cpus"`
+			// Memory is the memory of the VM in MiB.
+			Memory int
+			// DiskSize is the size of the VM's disk in GB.
+			DiskSize int `toml:"disk_size"`
+			// Accel is kvm or tcg, kvm when /dev/kvm is usable by default.
+			Accel string
+			// QEMU is the system emulator to run, qemu-system-x86_64 or
+			// qemu-system-aarch64 by default.
+			QEMU string `toml:"qemu"`
+			// Firmware is the UEFI firmware aarch64 VMs boot from.
+			Firmware string
+			// Dir holds the cached images and the disks of the VMs, next to
+			// the state file by default.
+			Dir string
+		}
+	}
+
+	// AWSRegion holds the region specific settings of a fallback region.
+	AWSRegion struct {
+		Region        string
+		AMI           string
+		SecurityGroup string `toml:"security_group"`
+		Subnets       []string
 	}
 
 	Project struct {
-		Name string
+		Name  string
+		Owner string
 	}
 
 	Build struct {
@@ -63,210 +199,38 @@ type (
 		Env struct {
 			Passthrough []string
 		}
+		// MaxDuration is a hard time-to-live for provisioned devices. The
+		// provider deletes the device once it expires, even if spt is no
+		// longer running.
+		MaxDuration time.Duration `toml:"max_duration"`
+		// InterruptionSignal is sent to the container when the provider is
+		// about to reclaim the spot device, SIGTERM by default.
+		InterruptionSignal string `toml:"interruption_signal"`
+		// InterruptionRetries is how often an interrupted run is retried
+		// on a freshly provisioned device.
+		InterruptionRetries int `toml:"interruption_retries"`
 	}
-)
-
-func Log(format string, args ...interface{}) {
-	fmt.Printf("-- "+format+"\n", args...)
-}
-
-type DeviceCreator interface {
-	SetPlan(string)
-	SetOperatingSystem(string)
-	SetHostname(string)
-	SetUserdata(string)
-	SetTags([]string)
-	SetHardwareReservationId(string)
-	SetBillingCycle(metalv1.DeviceCreateInputBillingCycle)
-	SetSpotInstance(bool)
-	SetSpotPriceMax(float32)
-	SetTerminationTime(time.Time)
-	SetCustomdata(map[string]interface{})
-}
-
-type OneOfDeviceCreator interface {
-	DeviceCreator
-	GetActualInstance() interface{}
-}
-
-var _ DeviceCreator = (*metal.DeviceCreateInMetroInput)(nil)
-var _ DeviceCreator = (*metal.DeviceCreateInFacilityInput)(nil)
-
-func NewClient(cfg Config) Client {
-	apiKey := cfg.Service.Equinix.ApiKey
-	config := metal.NewConfiguration()
-	config.AddDefaultHeader("X-Auth-Token", apiKey)
-
-	client := metal.NewAPIClient(config)
-	return Client{metal: client, config: cfg}
-}
-
-func fetchMetadata() (Metadata, bool) {
-	url := "http://metadata.platformequinix.com/metadata"
-	client := &http.Client{
-		Timeout: 2 * time.Second,
-	}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return Metadata{}, false
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return Metadata{}, false
-	}
-
-	if resp.StatusCode != 200 {
-		return Metadata{}, false
-	}
-
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return Metadata{}, false
-	}
-
-	var metadata Metadata
-	err = json.Unmarshal(body, &metadata)
-	if err != nil {
-		return Metadata{}, false
-	}
-
-	return metadata, true
-}
-
-func fetchAWSMetadata() (string, bool) {
-	client := &http.Client{
-		Timeout: 2 * time.Second,
-	}
-
-	tokenUrl := "http://169.254.169.254/latest/api/token"
-	req, err := http.NewRequest("PUT", tokenUrl, nil)
-	if err != nil {
-		return "", false
-	}
-	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", false
-	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return "", false
+	GC struct {
+		MaxAge time.Duration `toml:"max_age"`
 	}
+)
 
-	tokenBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", false
-	}
-	token := string(tokenBody)
-
-	instanceUrl := "http://169.254.169.254/latest/meta-data/instance-id"
-	req, err = http.NewRequest("GET", instanceUrl, nil)
-	if err != nil {
-		return "", false
-	}
-	req.Header.Set("X-aws-ec2-metadata-token", token)
-
-	resp, err = client.Do(req)
-	if err != nil {
-		return "", false
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return "", false
-	}
-
-	instanceBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", false
-	}
-
-	return string(instanceBody), true
-}
-
-type Metadata struct {
-	Customdata struct {
-		ApiKey string `json:"api_key"`
-	} `json:"customdata"`
-	Id string `json:"id"`
-}
-
-func NewSelfDevice() Device {
-	// Try Equinix Metal first
-	metadata, ok := fetchMetadata()
-	if ok {
-		config := metal.NewConfiguration()
-		config.AddDefaultHeader("X-Auth-Token", metadata.Customdata.ApiKey)
-		client := metal.NewAPIClient(config)
-
-		device, _, err := client.DevicesApi.FindDeviceById(context.TODO(), metadata.Id).Execute()
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		return &MetalDevice{device: device, client: client}
-	}
-
-	// Try AWS EC2
-	instanceId, ok := fetchAWSMetadata()
-	if ok {
-		Log("Detected AWS EC2 instance: %s", instanceId)
-
-		// For self-device operations inside an EC2 instance, we don't need
-		// to initialize a full AWS client with credentials since we can use
-		// instance metadata service for self-operations
-
-		var ipAddr string
-
-		client := &http.Client{
-			Timeout: 2 * time.Second,
-		}
-
-		// First get a token for IMDSv2
-		tokenUrl := "http://169.254.169.254/latest/api/token"
-		req, err := http.NewRequest("PUT", tokenUrl, nil)
-		if err == nil {
-			req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
-			resp, err := client.Do(req)
-			if err == nil && resp.StatusCode == 200 {
-				tokenBody, err := ioutil.ReadAll(resp.Body)
-				resp.Body.Close()
-
-				if err == nil {
-					token := string(tokenBody)
-					// Get public IP
-					ipUrl := "http://169.254.169.254/latest/meta-data/public-ipv4"
-					req, err = http.NewRequest("GET", ipUrl, nil)
-					if err == nil {
-						req.Header.Set("X-aws-ec2-metadata-token", token)
-						resp, err = client.Do(req)
-						if err == nil && resp.StatusCode == 200 {
-							ipBytes, err := ioutil.ReadAll(resp.Body)
-							resp.Body.Close()
-							if err == nil {
-								ipAddr = string(ipBytes)
-							}
-						}
-					}
-				}
-			}
-		}
+// sleep pauses for d or until ctx is done, whichever comes first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
 
-		return &AWSInstance{
-			instanceId: instanceId,
-			ipAddr:     ipAddr,
-		}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
 	}
-
-	log.Fatal("Could not determine instance type. Are you running on Equinix Metal or AWS EC2?")
-	return nil // unreachable
 }
 
 const userScript = `#!/bin/bash
+spt_started=$(date +%s)
 export DEBIAN_FRONTEND=noninteractive
 apt-get update
 apt-get upgrade -y
@@ -286,404 +250,450 @@ mkdir -p /opt/spt
 `
 
 type Device interface {
-	Run(detach bool, args []string)
-	Delete()
+	ID() string
+	IP() string
+	Tags() Tags
+	// Run builds the project on the device and runs the resulting image
+	// with args. Unless detach is set, the device is deleted afterwards,
+	// also when ctx is canceled. Canceling ctx with a *SignalError
+	// forwards that signal to the container, SIGTERM is sent otherwise.
+	Run(ctx context.Context, detach bool, args []string) (RunResult, error)
+	Delete(ctx context.Context) error
 }
 
+// Client provisions and manages devices through the provider selected by
+// the configuration.
 type Client struct {
-	metal  *metal.APIClient
-	ec2    *ec2.Client
-	config Config
-}
-
-func NewAWSClient(cfg Config) (*Client, error) {
-	accessKey := cfg.Service.AWS.AccessKey
-	secretKey := cfg.Service.AWS.SecretKey
-	region := cfg.Service.AWS.Region
-
-	awsCfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithRegion(region),
-		config.WithCredentialsProvider(aws.CredentialsProviderFunc(
-			func(ctx context.Context) (aws.Credentials, error) {
-				return aws.Credentials{
-					AccessKeyID:     accessKey,
-					SecretAccessKey: secretKey,
-				}, nil
-			},
-		)),
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	ec2Client := ec2.NewFromConfig(awsCfg)
-	return &Client{ec2: ec2Client, config: cfg}, nil
+	provider Provider
+	config   Config
 }
 
-func (c *Client) Provision() (Device, error) {
-	config := c.config
+// ClientOption customizes a Client.
+type ClientOption func(*Client)
 
-	// Check which provider to use
-	if config.Service.AWS.Region != "" {
-		return c.provisionAWS()
+// WithProvider makes the client use provider instead of the provider
+// selected by the configuration. Fallbacks are created like provider when it
+// was made by this package, e.g. with the same injected API client, and from
+// the configuration otherwise.
+func WithProvider(provider Provider) ClientOption {
+	return func(c *Client) {
+		c.provider = provider
 	}
-
-	return c.provisionEquinix()
 }
 
-func (c *Client) provisionAWS() (*AWSInstance, error) {
-	config := c.config
-
-	Log("Provisioning AWS spot instance")
+func NewClient(cfg Config, opts ...ClientOption) (*Client, error) {
+	c := &Client{config: cfg}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.provider != nil {
+		return c, nil
+	}
 
-	credsScript := `
-# AWS credentials for self-termination
-cat > /opt/spt/aws-credentials.json << 'EOL'
-{
-  "region": "` + config.Service.AWS.Region + `",
-  "access_key": "` + config.Service.AWS.AccessKey + `",
-  "secret_key": "` + config.Service.AWS.SecretKey + `"
-}
-EOL
-chmod 600 /opt/spt/aws-credentials.json
-`
-	completeScript := userScript + "\n" + credsScript
-	userData := base64.StdEncoding.EncodeToString([]byte(completeScript))
-
-	spotPrice := fmt.Sprintf("%f", config.Service.AWS.SpotPriceMax)
-
-	volumeSize := 8
-	if config.Service.AWS.VolumeSize > 0 {
-		volumeSize = config.Service.AWS.VolumeSize
-	}
-
-	blockDeviceMapping := []types.BlockDeviceMapping{
-		{
-			DeviceName: aws.String("/dev/sda1"),
-			Ebs: &types.EbsBlockDevice{
-				VolumeSize: aws.Int32(int32(volumeSize)),
-				VolumeType: types.VolumeTypeGp2,
-			},
-		},
-	}
-
-	input := &ec2.RequestSpotInstancesInput{
-		InstanceCount: aws.Int32(1),
-		SpotPrice:     aws.String(spotPrice),
-		LaunchSpecification: &types.RequestSpotLaunchSpecification{
-			ImageId:      aws.String(config.Service.AWS.AMI),
-			InstanceType: types.InstanceType(config.Service.AWS.InstanceType),
-			UserData:     aws.String(userData),
-			SecurityGroupIds: []string{
-				config.Service.AWS.SecurityGroup,
-			},
-			KeyName: func() *string {
-				if config.Service.AWS.KeyName != "" {
-					return aws.String(config.Service.AWS.KeyName)
-				}
-				return nil
-			}(),
-			BlockDeviceMappings: blockDeviceMapping,
-		},
-	}
-
-	result, err := c.ec2.RequestSpotInstances(context.TODO(), input)
+	provider, err := NewProvider(cfg)
 	if err != nil {
 		return nil, err
 	}
+	c.provider = provider
+	return c, nil
+}
 
-	if len(result.SpotInstanceRequests) == 0 {
-		return nil, fmt.Errorf("no spot instance requests returned")
-	}
+// Provider returns the backend used by the client.
+func (c *Client) Provider() Provider {
+	return c.provider
+}
 
-	spotRequestId := *result.SpotInstanceRequests[0].SpotInstanceRequestId
-	Log("Spot request %s created, waiting for instance", spotRequestId)
+// Provision provisions a device with the configured provider. When that
+// fails for lack of capacity or because the spot price is too low, the
+// provider's fallback candidates are tried in order. Any other error is
+// returned right away.
+func (c *Client) Provision(ctx context.Context) (Device, error) {
+	device, err := c.provider.Provision(ctx)
+	if err == nil {
+		return c.track(device), nil
+	}
 
-	var instanceId string
-	describeInput := &ec2.DescribeSpotInstanceRequestsInput{
-		SpotInstanceRequestIds: []string{spotRequestId},
+	factory, _ := lookupProvider(c.provider.Name())
+	if factory.Fallbacks == nil {
+		return nil, err
 	}
 
-	for {
-		describeResult, err := c.ec2.DescribeSpotInstanceRequests(context.TODO(), describeInput)
-		if err != nil {
+	for _, fallback := range factory.Fallbacks(c.config) {
+		if ctx.Err() != nil || !canFallBack(err) {
 			return nil, err
 		}
 
-		if len(describeResult.SpotInstanceRequests) == 0 {
-			return nil, fmt.Errorf("spot instance request not found")
+		// A candidate that cannot be created is skipped, keeping err for
+		// the next one to decide on.
+		var provider Provider
+		var newErr error
+		if r, ok := c.provider.(reconfigurable); ok {
+			provider, newErr = r.withConfig(fallback.Config)
+		} else {
+			provider, newErr = factory.New(fallback.Config)
 		}
-
-		req := describeResult.SpotInstanceRequests[0]
-		if req.State == types.SpotInstanceStateFailed {
-			return nil, fmt.Errorf("spot instance request failed: %s", *req.Status.Message)
+		if newErr != nil {
+			Log("Skipping %s: %v", fallback.Description, newErr)
+			continue
 		}
 
-		if req.InstanceId != nil {
-			instanceId = *req.InstanceId
-			Log("Instance %s created, waiting for it to be ready", instanceId)
-			break
-		}
+		Log("Provisioning failed: %v", err)
+		Log("Falling back to %s", fallback.Description)
 
-		time.Sleep(5 * time.Second)
+		device, err = provider.Provision(ctx)
+		if err == nil {
+			return c.track(device), nil
+		}
 	}
 
-	instanceInput := &ec2.DescribeInstancesInput{
-		InstanceIds: []string{instanceId},
-	}
+	return nil, err
+}
 
-	var ipAddr string
-	for {
-		instanceResult, err := c.ec2.DescribeInstances(context.TODO(), instanceInput)
-		if err != nil {
-			return nil, err
-		}
+// canFallBack reports whether provisioning elsewhere might succeed after
+// err.
+func canFallBack(err error) bool {
+	return errors.Is(err, ErrNoCapacity) || errors.Is(err, ErrPriceTooLow)
+}
 
-		if len(instanceResult.Reservations) == 0 || len(instanceResult.Reservations[0].Instances) == 0 {
-			return nil, fmt.Errorf("instance not found")
-		}
+func (c *Client) Attach(ctx context.Context, id string) (Device, error) {
+	device, err := c.provider.Attach(ctx, id)
+	if err != nil {
+		return nil, err
+	}
 
-		instance := instanceResult.Reservations[0].Instances[0]
+	return c.track(device), nil
+}
 
-		if instance.State.Name == types.InstanceStateNameRunning {
-			if instance.PublicIpAddress != nil {
-				ipAddr = *instance.PublicIpAddress
-				Log("Instance is running at IP %s", ipAddr)
-				break
-			}
-		}
+// Lookup returns a handle to an existing device like Attach, but without
+// recording it in the state file, for read-only uses such as `spt status`.
+func (c *Client) Lookup(ctx context.Context, id string) (Device, error) {
+	return c.provider.Attach(ctx, id)
+}
 
-		if instance.State.Name == types.InstanceStateNameTerminated {
-			return nil, fmt.Errorf("instance was terminated")
-		}
+func (c *Client) List(ctx context.Context) ([]Device, error) {
+	return c.provider.List(ctx)
+}
 
-		time.Sleep(5 * time.Second)
+// DefaultMaxAge is the age after which `spt gc` considers a device leaked
+// when `gc.max_age` is not set.
+const DefaultMaxAge = 24 * time.Hour
+
+// Stale returns the devices of the configured project that look leaked:
+// those older than maxAge, and those created by the current owner that are
+// no longer in the local state file.
+func (c *Client) Stale(ctx context.Context, maxAge time.Duration) ([]Device, error) {
+	devices, err := c.provider.List(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	Log("Waiting for SSH to be available...")
-	for i := 0; i < 30; i++ {
-		cmd := exec.Command("nc", "-z", "-w", "1", ipAddr, "22")
-		if err := cmd.Run(); err == nil {
-			break
-		}
-		time.Sleep(5 * time.Second)
+	state, err := LoadState()
+	if err != nil {
+		return nil, err
 	}
 
-	time.Sleep(30 * time.Second)
+	owner := Owner(c.config)
+	var stale []Device
+	for _, device := range devices {
+		tags := device.Tags()
+		if tags.Project != c.config.Project.Name {
+			continue
+		}
 
-	awsInstance := &AWSInstance{
-		instanceId: instanceId,
-		ipAddr:     ipAddr,
-		client:     c.ec2,
-		config:     config,
+		_, known := state.Find(device.ID())
+		if time.Since(tags.CreatedAt) > maxAge || (tags.Owner == owner && !known) {
+			stale = append(stale, device)
+		}
 	}
 
-	return awsInstance, nil
+	return stale, nil
 }
 
-func (c *Client) provisionEquinix() (*MetalDevice, error) {
-	var ipAddr string
-	config := c.config
-	client := c.metal
+// KeyRevoker is implemented by providers that mint an API key for every
+// device, which a device deleted by the provider itself, e.g. at its
+// termination time, leaves behind.
+type KeyRevoker interface {
+	// OrphanedKeys returns the IDs of device keys whose device is gone.
+	OrphanedKeys(ctx context.Context) ([]string, error)
+	// RevokeKey deletes the device key with the given ID.
+	RevokeKey(ctx context.Context, id string) error
+}
 
-	var dc DeviceCreator
-	var createRequest metal.CreateDeviceRequest
+// OrphanedKeys returns the IDs of the device keys that outlived their
+// device, or none when the provider does not mint device keys.
+func (c *Client) OrphanedKeys(ctx context.Context) ([]string, error) {
+	revoker, ok := c.provider.(KeyRevoker)
+	if !ok {
+		return nil, nil
+	}
+	return revoker.OrphanedKeys(ctx)
+}
 
-	metro := "any"
+// RevokeKey deletes the device key with the given ID.
+func (c *Client) RevokeKey(ctx context.Context, id string) error {
+	revoker, ok := c.provider.(KeyRevoker)
+	if !ok {
+		return fmt.Errorf("provider %s does not mint device keys", c.provider.Name())
+	}
+	return revoker.RevokeKey(ctx, id)
+}
 
-	dc = &metal.DeviceCreateInMetroInput{
-		Metro: metro,
+func (c *Client) Delete(ctx context.Context, id string) error {
+	if err := c.provider.Delete(ctx, id); err != nil {
+		return err
 	}
-	createRequest = metal.CreateDeviceRequest{DeviceCreateInMetroInput: dc.(*metal.DeviceCreateInMetroInput)}
+	deleted(c.provider.Name(), id)
 
-	dc.SetSpotInstance(true)
-	dc.SetHostname(config.Project.Name + "-spt-instance")
-	dc.SetUserdata(userScript)
-	dc.SetCustomdata(map[string]interface{}{"api_key": config.Service.Equinix.ApiKey})
+	forgetDevice(id)
+	return nil
+}
 
-	if config.Service.Equinix.SpotPriceMax != 0 {
-		dc.SetSpotPriceMax(config.Service.Equinix.SpotPriceMax)
-	}
-	if config.Service.Equinix.Plan != "" {
-		dc.SetPlan(config.Service.Equinix.Plan)
-	}
-	if config.Service.Equinix.OperatingSystem != "" {
-		dc.SetOperatingSystem(config.Service.Equinix.OperatingSystem)
-	}
+// track records device in the state file and returns a Device that removes
+// the record again once the device is deleted.
+func (c *Client) track(device Device) Device {
+	recordDevice(c.provider.Name(), device, c.config)
+	return &trackedDevice{Device: device, provider: c.provider.Name()}
+}
 
-	Log("Provisioning Equinix Metal spot instance")
+type trackedDevice struct {
+	Device
 
-	projectID := config.Service.Equinix.Project
-	newDevice, _, err := client.DevicesApi.CreateDevice(context.TODO(), projectID).CreateDeviceRequest(createRequest).Execute()
-	if err != nil {
-		return nil, err
-	}
+	provider string
+}
 
-	Log("Device %s is being provisioned", newDevice.Id)
+func (d *trackedDevice) Run(ctx context.Context, detach bool, args []string) (RunResult, error) {
+	result, err := d.Device.Run(ctx, detach, args)
 
-	deviceID := *newDevice.Id
-	for {
-		newDevice, _, err = client.DevicesApi.FindDeviceById(context.TODO(), deviceID).Execute()
-		if err != nil {
-			return nil, err
-		}
+	if !detach && !cleanupFailed(err) {
+		forgetDevice(d.ID())
+	}
 
-		for _, ip := range newDevice.GetIpAddresses() {
-			if ip.GetPublic() && ip.GetAddressFamily() == 4 {
-				ipAddr = ip.GetAddress()
-			}
-		}
+	return result, err
+}
 
-		if ipAddr != "" {
-			break
+// cleanupFailed reports whether any of the errors in err's tree failed in
+// StageCleanup. A failed run and a failed deletion are joined, errors.As
+// alone would stop at the first RunError.
+func cleanupFailed(err error) bool {
+	switch err := err.(type) {
+	case nil:
+		return false
+	case *RunError:
+		return err.Stage == StageCleanup
+	case interface{ Unwrap() []error }:
+		for _, err := range err.Unwrap() {
+			if cleanupFailed(err) {
+				return true
+			}
 		}
+		return false
+	default:
+		return cleanupFailed(errors.Unwrap(err))
+	}
+}
 
-		time.Sleep(1 * time.Second)
+func (d *trackedDevice) Delete(ctx context.Context) error {
+	if err := d.Device.Delete(ctx); err != nil {
+		return err
 	}
+	deleted(d.provider, d.ID())
 
-	Log("IP %s", ipAddr)
-	Log("Waiting for Provisioning...")
-	stage := float32(0)
-	for {
-		newDevice, _, err = client.DevicesApi.FindDeviceById(context.TODO(), deviceID).Execute()
+	forgetDevice(d.ID())
+	return nil
+}
+
+// NewSelfDevice returns the device the current process is running on.
+// Providers that cannot be created without a configuration are skipped.
+func NewSelfDevice(ctx context.Context) (Device, error) {
+	for _, p := range providers {
+		provider, err := p.factory.New(Config{})
 		if err != nil {
-			return nil, err
+			Log("Skipping %s: %v", p.name, err)
+			continue
 		}
-		if newDevice.GetState() == metal.DEVICESTATE_PROVISIONING && stage != newDevice.GetProvisioningPercentage() {
-			stage = newDevice.GetProvisioningPercentage()
-			Log("Provisioning %v%% complete", newDevice.GetProvisioningPercentage())
+
+		device, err := provider.Self(ctx)
+		if err != nil {
+			return nil, err
 		}
-		if newDevice.GetState() == metal.DEVICESTATE_ACTIVE {
-			Log("Device State: %s", newDevice.GetState())
-			break
+		if device != nil {
+			return device, nil
 		}
-		time.Sleep(10 * time.Second)
 	}
 
-	metalDevice := &MetalDevice{device: newDevice, ipAddr: ipAddr, client: client, config: config}
-	return metalDevice, nil
+	return nil, fmt.Errorf("could not determine instance type, are you running on Equinix Metal, AWS EC2, GCE, Azure, Hetzner Cloud or a local VM?")
 }
 
-func (c *Client) Attach(id string) (Device, error) {
-	if len(id) > 2 && id[:2] == "i-" {
-		return c.attachAWS(id)
-	}
+// RunStage identifies the part of Device.Run that failed.
+type RunStage string
+
+const (
+	// StageSetup covers connecting to the device and preparing docker.
+	StageSetup RunStage = "setup"
+	// StageBuild covers building the image on the device.
+	StageBuild RunStage = "build"
+	// StageRun covers starting the container.
+	StageRun RunStage = "run"
+	// StageCleanup covers deleting the device after a non-detached run.
+	StageCleanup RunStage = "cleanup"
+)
 
-	return c.attachEquinix(id)
+// RunError is returned by Device.Run when the remote run could not complete.
+type RunError struct {
+	Stage RunStage
+	Err   error
 }
 
-func (c *Client) attachAWS(instanceId string) (*AWSInstance, error) {
-	input := &ec2.DescribeInstancesInput{
-		InstanceIds: []string{instanceId},
-	}
+func (e *RunError) Error() string {
+	return fmt.Sprintf("%s failed: %v", e.Stage, e.Err)
+}
 
-	result, err := c.ec2.DescribeInstances(context.TODO(), input)
-	if err != nil {
-		return nil, err
-	}
+func (e *RunError) Unwrap() error {
+	return e.Err
+}
 
-	if len(result.Reservations) == 0 || len(result.Reservations[0].Instances) == 0 {
-		return nil, fmt.Errorf("AWS instance not found: %s", instanceId)
-	}
+// RunResult is the outcome of a completed Device.Run.
+type RunResult struct {
+	// ExitCode is the exit status of the container. It is always zero for
+	// detached runs.
+	ExitCode int
+}
 
-	instance := result.Reservations[0].Instances[0]
+// dockerRunFailure is the exit status the docker CLI uses when it fails to
+// start the container, as opposed to the container itself exiting.
+const dockerRunFailure = 125
 
-	if instance.State.Name != types.InstanceStateNameRunning {
-		return nil, fmt.Errorf("AWS instance %s is not running (state: %s)", instanceId, instance.State.Name)
-	}
+// runAndDelete runs on device of the named provider and, unless detached,
+// deletes it afterwards. When ctx is canceled during a non-detached run,
+// the signal it was canceled with is forwarded to the container and the
+// device is still deleted.
+func runAndDelete(ctx context.Context, provider string, device Device, config Config, detach bool, args []string) (RunResult, error) {
+	result, err := runRemoteDocker(ctx, device, config, detach, args)
 
-	if instance.PublicIpAddress == nil {
-		return nil, fmt.Errorf("AWS instance %s has no public IP address", instanceId)
+	if !detach {
+		// The device is deleted even when ctx was canceled.
+		if delErr := device.Delete(context.WithoutCancel(ctx)); delErr != nil {
+			err = errors.Join(err, &RunError{Stage: StageCleanup, Err: delErr})
+		} else {
+			deleted(provider, device.ID())
+		}
 	}
 
-	ipAddr := *instance.PublicIpAddress
-
-	Log("Attached to AWS instance %s at IP %s", instanceId, ipAddr)
+	return result, err
+}
 
-	awsInstance := &AWSInstance{
-		instanceId: instanceId,
-		ipAddr:     ipAddr,
-		client:     c.ec2,
-		config:     c.config,
-	}
+// runExited emits EventRunExited for the container on device.
+func runExited(device Device, code int) {
+	emit(Event{
+		Type:     EventRunExited,
+		DeviceID: device.ID(),
+		ExitCode: &code,
+		Message:  fmt.Sprintf("Container exited with status %d", code),
+	})
+}
 
-	return awsInstance, nil
+// deleted emits EventDeleted for the device with the given ID.
+func deleted(provider, id string) {
+	emit(Event{Type: EventDeleted, Provider: provider, DeviceID: id, Message: fmt.Sprintf("Device %s deleted", id)})
 }
 
-func (c *Client) attachEquinix(id string) (*MetalDevice, error) {
-	device, _, err := c.metal.DevicesApi.FindDeviceById(context.TODO(), id).Execute()
-	if err != nil {
-		return nil, err
+var (
+	outputMu sync.Mutex
+	output   io.Writer = os.Stdout
+)
+
+// SetOutput redirects the output of the image build and of the container,
+// os.Stdout by default. Programs that print a document of their own on
+// stdout send it elsewhere, e.g. to os.Stderr.
+func SetOutput(w io.Writer) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+
+	if w == nil {
+		w = io.Discard
 	}
+	output = w
+}
 
-	var ipAddr string
-	for _, ip := range device.GetIpAddresses() {
-		if ip.GetPublic() && ip.GetAddressFamily() == 4 {
-			ipAddr = ip.GetAddress()
+// runOutput returns the writer set with SetOutput.
+func runOutput() io.Writer {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	return output
+}
+
+// dockerCommand returns a docker CLI invocation against the daemon at
+// dockerHost. The host is passed through the environment of the child
+// process only, leaving the user's docker contexts untouched. When ctx is
+// canceled, the CLI is interrupted.
+func dockerCommand(ctx context.Context, dockerHost string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, "DOCKER_HOST=") && !strings.HasPrefix(env, "DOCKER_CONTEXT=") {
+			cmd.Env = append(cmd.Env, env)
 		}
 	}
-
-	Log("Attached to Equinix Metal device %s at IP %s", id, ipAddr)
-	metalDevice := &MetalDevice{device: device, ipAddr: ipAddr, client: c.metal, config: c.config}
-	return metalDevice, nil
+	cmd.Env = append(cmd.Env, "DOCKER_HOST="+dockerHost)
+	return cmd
 }
 
-// Common run logic for all device types
-func runRemoteDocker(ipAddr string, config Config, detach bool, args []string) {
-	// Setup SSH
-	sshHost := fmt.Sprintf("ssh://ubuntu@%s", ipAddr)
-	Log(sshHost)
+// Common run logic for all device types.
+func runRemoteDocker(ctx context.Context, device Device, config Config, detach bool, args []string) (RunResult, error) {
+	ipAddr := device.IP()
 
-	cmd := exec.Command("ssh-keygen", "-R", ipAddr)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Run()
+	Log("Connecting to %s@%s", sshUser, ipAddr)
+	client, err := waitReady(ctx, device, readyTimeout(config))
+	if err != nil {
+		return RunResult{}, &RunError{Stage: StageSetup, Err: err}
+	}
+	defer client.Close()
 
-	waitForInit := "cloud-init status --wait"
-	cmd = exec.Command("ssh", "-o", "StrictHostKeyChecking=no", sshHost, waitForInit)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	// The docker CLI talks to the remote daemon through a local socket
+	// forwarded over the SSH connection.
+	socketDir, err := os.MkdirTemp("", "spt-")
+	if err != nil {
+		return RunResult{}, &RunError{Stage: StageSetup, Err: err}
+	}
+	defer os.RemoveAll(socketDir)
 
-	err := cmd.Run()
+	dockerSocket := filepath.Join(socketDir, "docker.sock")
+	forward, err := client.ForwardSocket(dockerSocket, "/var/run/docker.sock")
 	if err != nil {
-		fmt.Println(err)
-		return
+		return RunResult{}, &RunError{Stage: StageSetup, Err: fmt.Errorf("forwarding docker socket: %w", err)}
 	}
+	defer forward.Close()
 
-	cmd = exec.Command("docker", "context", "rm", "remote2")
-	cmd.Run()
+	dockerHost := "unix://" + dockerSocket
 
-	spawnCmd := fmt.Sprintf("docker context create remote2 --docker \"host=%s\"", sshHost)
-	Log("Creating docker context")
-	cmd = exec.Command("sh", "-c", spawnCmd)
-	err = cmd.Run()
-	if err != nil {
-		fmt.Println(err)
-		return
+	if ctx.Err() != nil {
+		return RunResult{}, &RunError{Stage: StageSetup, Err: stoppedBy(ctx)}
 	}
 
-	Log("Building docker image")
+	emit(Event{Type: EventBuildStarted, DeviceID: device.ID(), Message: "Building docker image"})
 	randomId := time.Now().Unix()
 	name := "spt-image-" + fmt.Sprint(randomId)
-	cmd = exec.Command("docker", "--context", "remote2", "build")
+	cmd := dockerCommand(ctx, dockerHost, "build")
 	for _, arg := range config.Build.Args.Passthrough {
 		cmd.Args = append(cmd.Args, "--build-arg", arg)
 	}
 	cmd.Args = append(cmd.Args, "--ssh", "default", "-t", name, ".")
 
 	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
+	cmd.Stdout = runOutput()
 	cmd.Stderr = os.Stderr
 	err = cmd.Run()
+	if ctx.Err() != nil {
+		return RunResult{}, &RunError{Stage: StageBuild, Err: stoppedBy(ctx)}
+	}
 	if err != nil {
-		fmt.Println(err)
-		return
+		return RunResult{}, &RunError{Stage: StageBuild, Err: err}
 	}
 
-	Log("Running docker image. Detached: %v", detach)
-	cmd = exec.Command("docker", "--context", "remote2", "run")
+	emit(Event{Type: EventRunStarted, DeviceID: device.ID(), Message: fmt.Sprintf("Running docker image. Detached: %v", detach)})
+	cmd = dockerCommand(ctx, dockerHost, "run")
 	if detach {
 		cmd.Args = append(cmd.Args, "-d")
 	}
@@ -691,162 +701,73 @@ func runRemoteDocker(ipAddr string, config Config, detach bool, args []string) {
 		cmd.Args = append(cmd.Args, "-e", env)
 	}
 
-	cmd.Args = append(cmd.Args, "--rm", "--network=host", "-v", "/opt/spt:/opt/spt", "-t", "-i", name)
+	cmd.Args = append(cmd.Args, "--rm", "--network=host", "-v", "/opt/spt:/opt/spt", "--name", name, "-i")
+	// A TTY is only allocated for a terminal, docker refuses one otherwise.
+	if stat, err := os.Stdin.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+		cmd.Args = append(cmd.Args, "-t")
+	}
+	cmd.Args = append(cmd.Args, name)
 	cmd.Args = append(cmd.Args, args...)
 
 	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
+	cmd.Stdout = runOutput()
 	cmd.Stderr = os.Stderr
-
-	err = cmd.Run()
-
-	// Cleanup
-	Log("Removing docker context")
-	cmd = exec.Command("docker", "context", "rm", "remote2")
-	err = cmd.Run()
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-}
-
-// Equinix Metal implementation
-type MetalDevice struct {
-	device *metal.Device
-	client *metal.APIClient
-	config Config
-	ipAddr string
-}
-
-func (c *MetalDevice) Run(detach bool, args []string) {
-	runRemoteDocker(c.ipAddr, c.config, detach, args)
-
-	if !detach {
-		c.Delete()
+	// The signal ctx was canceled with is forwarded to the container, the
+	// CLI exits once the container stopped.
+	cmd.Cancel = func() error {
+		signalContainer(dockerHost, name, containerSignal(ctx))
+		return nil
+	}
+
+	watchCtx, stopWatching := context.WithCancel(ctx)
+	interrupted := make(chan struct{})
+	if w, ok := device.(Interruptible); ok && !detach {
+		go watchInterruption(watchCtx, w, client.Output, func(at time.Time) {
+			emit(Event{
+				Type:     EventInterruptionNotice,
+				DeviceID: device.ID(),
+				Message:  fmt.Sprintf("Provider will reclaim device %s at %s", device.ID(), at.Format(time.RFC3339)),
+			})
+			close(interrupted)
+			signalContainer(dockerHost, name, interruptionSignal(config))
+		})
 	}
-}
 
-func (c *MetalDevice) Delete() {
-	Log("De-provisioning the Equinix Metal spot instance")
-	_, err := c.client.DevicesApi.DeleteDevice(context.TODO(), c.device.GetId()).Execute()
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-}
-
-// AWS implementation
-type AWSInstance struct {
-	instanceId string
-	client     *ec2.Client
-	config     Config
-	ipAddr     string
-}
-
-func (c *AWSInstance) Run(detach bool, args []string) {
-	runRemoteDocker(c.ipAddr, c.config, detach, args)
-
-	if !detach {
-		c.Delete()
-	}
-}
-
-func (c *AWSInstance) Delete() {
-	Log("Terminating the AWS spot instance")
-
-	selfInstanceId, isSelf := fetchAWSMetadata()
-	if isSelf && selfInstanceId == c.instanceId {
-		Log("Self-terminating EC2 instance %s", c.instanceId)
-
-		credsFile := "/opt/spt/aws-credentials.json"
-
-		credsData, err := ioutil.ReadFile(credsFile)
-		if err != nil {
-			Log("Error reading AWS credentials: %v", err)
-			Log("If running in Docker, make sure to mount /opt/spt from host")
-			return
-		}
-
-		var creds struct {
-			Region    string `json:"region"`
-			AccessKey string `json:"access_key"`
-			SecretKey string `json:"secret_key"`
-		}
-
-		if err := json.Unmarshal(credsData, &creds); err != nil {
-			Log("Error parsing AWS credentials: %v", err)
-			return
-		}
-
-		awsCfg, err := config.LoadDefaultConfig(context.TODO(),
-			config.WithRegion(creds.Region),
-			config.WithCredentialsProvider(aws.CredentialsProviderFunc(
-				func(ctx context.Context) (aws.Credentials, error) {
-					return aws.Credentials{
-						AccessKeyID:     creds.AccessKey,
-						SecretAccessKey: creds.SecretKey,
-					}, nil
-				},
-			)),
-		)
-		if err != nil {
-			Log("Error creating AWS config: %v", err)
-			return
-		}
-
-		ec2Client := ec2.NewFromConfig(awsCfg)
-
-		Log("Terminating instance %s using stored credentials", c.instanceId)
-		_, err = ec2Client.TerminateInstances(context.TODO(), &ec2.TerminateInstancesInput{
-			InstanceIds: []string{c.instanceId},
-		})
-		if err != nil {
-			Log("Error terminating instance: %v", err)
-			return
+	err = cmd.Run()
+	stopWatching()
+
+	select {
+	case <-interrupted:
+		var result RunResult
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			result.ExitCode = exitErr.ExitCode()
 		}
-
-		Log("Instance termination initiated")
-		return
+		return result, &RunError{Stage: StageRun, Err: ErrInterrupted}
+	default:
 	}
 
-	if c.client == nil {
-		fmt.Println("Error: AWS client not initialized for external termination")
-		return
+	if ctx.Err() != nil {
+		var result RunResult
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			result.ExitCode = exitErr.ExitCode()
+		}
+		return result, &RunError{Stage: StageRun, Err: stoppedBy(ctx)}
 	}
 
-	_, err := c.client.TerminateInstances(context.TODO(), &ec2.TerminateInstancesInput{
-		InstanceIds: []string{c.instanceId},
-	})
 	if err != nil {
-		fmt.Println(err)
-		return
-	}
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() == dockerRunFailure {
+			return RunResult{}, &RunError{Stage: StageRun, Err: err}
+		}
 
-	// Get spot instance request ID
-	describeInput := &ec2.DescribeInstancesInput{
-		InstanceIds: []string{c.instanceId},
-	}
-	result, err := c.client.DescribeInstances(context.TODO(), describeInput)
-	if err != nil {
-		fmt.Println("Error getting spot instance request ID:", err)
-		return
+		runExited(device, exitErr.ExitCode())
+		return RunResult{ExitCode: exitErr.ExitCode()}, nil
 	}
 
-	if len(result.Reservations) > 0 && len(result.Reservations[0].Instances) > 0 {
-		instance := result.Reservations[0].Instances[0]
-		if instance.SpotInstanceRequestId != nil {
-			spotRequestId := *instance.SpotInstanceRequestId
-			Log("Canceling spot request %s", spotRequestId)
-
-			cancelInput := &ec2.CancelSpotInstanceRequestsInput{
-				SpotInstanceRequestIds: []string{spotRequestId},
-			}
-			_, err = c.client.CancelSpotInstanceRequests(context.TODO(), cancelInput)
-			if err != nil {
-				fmt.Println("Error canceling spot instance request:", err)
-				return
-			}
-			Log("Spot request %s canceled", spotRequestId)
-		}
+	if !detach {
+		runExited(device, 0)
 	}
+	return RunResult{}, nil
 }
@@ -0,0 +1,246 @@
+package spt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanupFailed(t *testing.T) {
+	runErr := &RunError{Stage: StageRun, Err: errors.New("exit status 125")}
+	cleanupErr := &RunError{Stage: StageCleanup, Err: errors.New("device not found")}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"success", nil, false},
+		{"run failed", runErr, false},
+		{"delete failed", errors.Join(nil, cleanupErr), true},
+		{"run and delete failed", errors.Join(runErr, cleanupErr), true},
+		{"wrapped", fmt.Errorf("running: %w", errors.Join(runErr, cleanupErr)), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cleanupFailed(tt.err); got != tt.want {
+				t.Errorf("cleanupFailed(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// selfProvider is a provider that only detects the current machine.
+type selfProvider struct {
+	Provider
+	device Device
+}
+
+func (p selfProvider) Self(ctx context.Context) (Device, error) {
+	return p.device, nil
+}
+
+func TestNewSelfDeviceWithoutCredentials(t *testing.T) {
+	// No credentials of any cloud.
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("CLOUDSDK_CONFIG", home)
+	for _, env := range []string{
+		"GOOGLE_APPLICATION_CREDENTIALS", "GOOGLE_OAUTH_ACCESS_TOKEN",
+		"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_PROFILE",
+		"AZURE_CLIENT_ID", "AZURE_CLIENT_SECRET", "AZURE_TENANT_ID",
+		"SPT_STATE_FILE",
+	} {
+		t.Setenv(env, "")
+	}
+
+	// Every provider can be created to look for the current machine.
+	for _, p := range providers {
+		if _, err := p.factory.New(Config{}); err != nil {
+			t.Errorf("creating %s without credentials: %v", p.name, err)
+		}
+	}
+
+	// A provider that cannot be created does not hide the ones after it.
+	want := &HetznerServer{id: 42}
+	registered := providers
+	t.Cleanup(func() { providers = registered })
+	providers = []registeredProvider{
+		{name: "broken", factory: ProviderFactory{New: func(Config) (Provider, error) {
+			return nil, errors.New("no credentials")
+		}}},
+		{name: "self", factory: ProviderFactory{New: func(Config) (Provider, error) {
+			return selfProvider{device: want}, nil
+		}}},
+	}
+
+	device, err := NewSelfDevice(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device != want {
+		t.Errorf("NewSelfDevice() = %v, want %v", device, want)
+	}
+}
+
+// stubProvider provisions and attaches device.
+type stubProvider struct {
+	Provider
+	device Device
+}
+
+func (p stubProvider) Name() string { return "stub" }
+
+func (p stubProvider) Provision(ctx context.Context) (Device, error) {
+	return p.device, nil
+}
+
+func (p stubProvider) Attach(ctx context.Context, id string) (Device, error) {
+	return p.device, nil
+}
+
+func TestStatusKeepsConfigHash(t *testing.T) {
+	t.Setenv("SPT_STATE_FILE", filepath.Join(t.TempDir(), "state.json"))
+
+	var cfg Config
+	cfg.Project.Name = "spt-test"
+	cfg.Service.Hetzner.ServerType = "ccx33"
+	provider := stubProvider{device: &HetznerServer{id: 42, ip: "192.0.2.1"}}
+
+	client, err := NewClient(cfg, WithProvider(provider))
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, err := client.Provision(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		state, err := LoadState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		record, ok := state.Find(device.ID())
+		if !ok {
+			t.Fatalf("device %s is not recorded", device.ID())
+		}
+		if record.ConfigHash != ConfigHash(cfg) {
+			t.Fatalf("status %d: recorded config hash = %s, want %s", i, record.ConfigHash, ConfigHash(cfg))
+		}
+
+		// As `spt status` and `spt attach` do.
+		client, err := NewClient(ConfigFor(cfg, record), WithProvider(provider))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Lookup(context.Background(), record.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Attach(context.Background(), record.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// noCapacityProvider is a stub provider without capacity.
+type noCapacityProvider struct {
+	Provider
+}
+
+func (p noCapacityProvider) Name() string { return "stub" }
+
+func (p noCapacityProvider) Provision(ctx context.Context) (Device, error) {
+	return nil, fmt.Errorf("%w: sold out", ErrNoCapacity)
+}
+
+func TestProvisionSkipsBrokenFallbacks(t *testing.T) {
+	t.Setenv("SPT_STATE_FILE", filepath.Join(t.TempDir(), "state.json"))
+
+	want := &HetznerServer{id: 42, ip: "192.0.2.1"}
+	fallback := func(name string) Fallback {
+		var cfg Config
+		cfg.Project.Name = name
+		return Fallback{Description: name, Config: cfg}
+	}
+
+	tests := []struct {
+		name      string
+		fallbacks []Fallback
+		wantErr   error
+	}{
+		{"broken then working", []Fallback{fallback("broken"), fallback("working")}, nil},
+		{"only broken", []Fallback{fallback("broken")}, ErrNoCapacity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registered := providers
+			t.Cleanup(func() { providers = registered })
+			providers = []registeredProvider{
+				{name: "stub", factory: ProviderFactory{
+					New: func(cfg Config) (Provider, error) {
+						if cfg.Project.Name == "broken" {
+							return nil, errors.New("invalid configuration")
+						}
+						return stubProvider{device: want}, nil
+					},
+					Fallbacks: func(Config) []Fallback { return tt.fallbacks },
+				}},
+			}
+
+			client, err := NewClient(Config{}, WithProvider(noCapacityProvider{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			device, err := client.Provision(context.Background())
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Provision() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if device.ID() != want.ID() {
+				t.Errorf("Provision() = device %s, want %s", device.ID(), want.ID())
+			}
+		})
+	}
+}
+
+// deletableDevice is an unreachable device that can be deleted.
+type deletableDevice struct {
+	Device
+}
+
+func (d deletableDevice) ID() string { return "device-1" }
+
+func (d deletableDevice) IP() string { return "192.0.2.1" }
+
+func (d deletableDevice) Delete(ctx context.Context) error { return nil }
+
+func TestRunAndDeleteNamesProvider(t *testing.T) {
+	t.Setenv("SPT_STATE_FILE", filepath.Join(t.TempDir(), "state.json"))
+
+	var events []Event
+	defer Subscribe(func(e Event) {
+		if e.Type == EventDeleted {
+			events = append(events, e)
+		}
+	})()
+
+	// The run is canceled before it starts, the device is still deleted.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := runAndDelete(ctx, "hetzner", deletableDevice{}, Config{}, false, nil); err == nil {
+		t.Fatal("runAndDelete() succeeded with a canceled context")
+	}
+
+	if len(events) != 1 || events[0].Provider != "hetzner" || events[0].DeviceID != "device-1" {
+		t.Errorf("deleted events = %+v, want one for hetzner device device-1", events)
+	}
+}
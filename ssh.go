@@ -0,0 +1,261 @@
+package spt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshUser is the login user of the Ubuntu images spt provisions.
+const sshUser = "ubuntu"
+
+// sshRetryInterval is the pause between connection attempts.
+var sshRetryInterval = 5 * time.Second
+
+// sshKeyFiles are the private keys tried, after the device's own key and the
+// SSH agent, when authenticating to a device.
+var sshKeyFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// sshClient is an SSH connection to a device.
+type sshClient struct {
+	*ssh.Client
+
+	agent agent.ExtendedAgent
+	// agentConn is the connection to the local SSH agent, closed along
+	// with the client.
+	agentConn net.Conn
+}
+
+// Close closes the SSH connection and the connection to the local agent.
+func (c *sshClient) Close() error {
+	err := c.Client.Close()
+	if c.agentConn != nil {
+		c.agentConn.Close()
+	}
+	return err
+}
+
+// sshAuth returns the authentication methods for the device id: the key spt
+// generated for it, the keys held by the SSH agent at $SSH_AUTH_SOCK and the
+// default keys in ~/.ssh. The agent and the connection to it are returned as
+// well so that it can be forwarded, the caller closes the connection.
+func sshAuth(id string) ([]ssh.AuthMethod, agent.ExtendedAgent, net.Conn) {
+	var signers []ssh.Signer
+
+	if signer, err := loadDeviceKey(id); err != nil {
+		Log("Error loading device key: %v", err)
+	} else if signer != nil {
+		signers = append(signers, signer)
+	}
+
+	var keyring agent.ExtendedAgent
+	var agentConn net.Conn
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			agentConn = conn
+			keyring = agent.NewClient(conn)
+			if s, err := keyring.Signers(); err == nil {
+				signers = append(signers, s...)
+			}
+		}
+	}
+
+	if home, err := os.UserHomeDir(); err == nil {
+		for _, name := range sshKeyFiles {
+			data, err := os.ReadFile(filepath.Join(home, ".ssh", name))
+			if err != nil {
+				continue
+			}
+			signer, err := ssh.ParsePrivateKey(data)
+			if err != nil {
+				// Passphrase protected keys are only usable through the agent.
+				continue
+			}
+			signers = append(signers, signer)
+		}
+	}
+
+	return []ssh.AuthMethod{ssh.PublicKeys(signers...)}, keyring, agentConn
+}
+
+// sshHandshakeTimeout bounds a single connection attempt.
+const sshHandshakeTimeout = 10 * time.Second
+
+// dialSSH opens a single SSH connection to device.
+func dialSSH(ctx context.Context, device Device) (*sshClient, error) {
+	ipAddr := device.IP()
+
+	hostKeys, err := hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	auth, keyring, agentConn := sshAuth(device.ID())
+	closeAgent := func() {
+		if agentConn != nil {
+			agentConn.Close()
+		}
+	}
+	config := &ssh.ClientConfig{
+		User: sshUser,
+		Auth: auth,
+		// Devices only offer the ed25519 host key spt pinned when
+		// provisioning them.
+		HostKeyCallback:   hostKeys,
+		HostKeyAlgorithms: []string{ssh.KeyAlgoED25519},
+	}
+
+	addr := sshAddr(ipAddr)
+	dialer := net.Dialer{Timeout: sshHandshakeTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		closeAgent()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(sshHandshakeTimeout))
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		closeAgent()
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			return nil, hostKeyError(ipAddr, err)
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(clientConn, chans, reqs)
+	c := &sshClient{Client: client, agent: keyring, agentConn: agentConn}
+	if keyring != nil {
+		if err := agent.ForwardToAgent(client, keyring); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// sshAddr returns the SSH address of a device IP, which may carry a port
+// other than 22.
+func sshAddr(ipAddr string) string {
+	if _, _, err := net.SplitHostPort(ipAddr); err == nil {
+		return ipAddr
+	}
+	return net.JoinHostPort(ipAddr, "22")
+}
+
+// dialDevice connects to device, retrying until it accepts SSH connections,
+// deadline passes or ctx is done.
+func dialDevice(ctx context.Context, device Device, deadline time.Time) (*sshClient, error) {
+	for {
+		client, err := dialSSH(ctx, device)
+		if err == nil {
+			return client, nil
+		}
+		// A mismatching host key is retried, the device presents its own
+		// keys until the user-data installed the pinned one.
+		if unknownHost(err) || time.Now().After(deadline) {
+			return nil, fmt.Errorf("connecting to %s: %w", device.IP(), err)
+		}
+		if err := sleep(ctx, sshRetryInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Run runs cmd on the device, streaming its output to stdout and stderr.
+// The local SSH agent is forwarded to the command when available. A non-zero
+// exit status is reported as *ssh.ExitError.
+func (c *sshClient) Run(cmd string, stdout, stderr io.Writer) error {
+	session, err := c.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	if c.agent != nil {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			return err
+		}
+	}
+
+	session.Stdout = stdout
+	session.Stderr = stderr
+	return session.Run(cmd)
+}
+
+// Output runs cmd on the device and returns its standard output.
+func (c *sshClient) Output(cmd string) ([]byte, error) {
+	session, err := c.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	return session.Output(cmd)
+}
+
+// ForwardSocket listens on the local unix socket at localPath and forwards
+// every connection to the unix socket at remotePath on the device, until the
+// returned listener is closed.
+func (c *sshClient) ForwardSocket(localPath, remotePath string) (net.Listener, error) {
+	listener, err := net.Listen("unix", localPath)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			local, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer local.Close()
+
+				remote, err := c.Dial("unix", remotePath)
+				if err != nil {
+					Log("Error forwarding %s: %v", remotePath, err)
+					return
+				}
+				defer remote.Close()
+
+				done := make(chan struct{}, 2)
+				go func() {
+					io.Copy(remote, local)
+					done <- struct{}{}
+				}()
+				go func() {
+					io.Copy(local, remote)
+					done <- struct{}{}
+				}()
+				<-done
+			}()
+		}
+	}()
+
+	return listener, nil
+}
+
+// sshExitStatus returns the exit status of a remote command that failed
+// with err.
+func sshExitStatus(err error) (int, bool) {
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), true
+	}
+	return 0, false
+}
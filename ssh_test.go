@@ -0,0 +1,57 @@
+package spt
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestDialSSHClosesAgentConnection(t *testing.T) {
+	t.Setenv("SPT_STATE_FILE", filepath.Join(t.TempDir(), "state.json"))
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	t.Setenv("SSH_AUTH_SOCK", socket)
+
+	// closed receives once the agent connection is closed.
+	closed := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(agent.NewKeyring(), conn)
+				conn.Close()
+				closed <- struct{}{}
+			}()
+		}
+	}()
+
+	// Nothing listens on the device's port.
+	port, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := port.Addr().String()
+	port.Close()
+
+	if _, err := dialSSH(context.Background(), &HetznerServer{id: 1, ip: addr}); err == nil {
+		t.Fatal("dialSSH() succeeded without a server")
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent connection left open after dialSSH failed")
+	}
+}
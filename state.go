@@ -0,0 +1,214 @@
+package spt
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DeviceRecord is the locally persisted record of a device spt manages.
+type DeviceRecord struct {
+	ID            string    `json:"id"`
+	Provider      string    `json:"provider"`
+	IP            string    `json:"ip"`
+	Location      string    `json:"location,omitempty"`
+	SpotRequestID string    `json:"spot_request_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	Project       string    `json:"project"`
+	ConfigHash    string    `json:"config_hash"`
+}
+
+// State is the set of devices spt has provisioned or attached to and not
+// yet deleted.
+type State struct {
+	Devices []DeviceRecord `json:"devices"`
+
+	path string
+}
+
+// StatePath returns the location of the state file. It honors
+// SPT_STATE_FILE and otherwise lives under $XDG_STATE_HOME/spt.
+func StatePath() (string, error) {
+	if path := os.Getenv("SPT_STATE_FILE"); path != "" {
+		return path, nil
+	}
+
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+
+	return filepath.Join(dir, "spt", "state.json"), nil
+}
+
+// LoadState reads the state file. A missing file yields an empty state.
+func LoadState() (*State, error) {
+	path, err := StatePath()
+	if err != nil {
+		return nil, err
+	}
+
+	state := &State{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// Save atomically writes the state back to disk.
+func (s *State) Save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".state-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Find returns the record for the device with the given ID.
+func (s *State) Find(id string) (DeviceRecord, bool) {
+	for _, d := range s.Devices {
+		if d.ID == id {
+			return d, true
+		}
+	}
+	return DeviceRecord{}, false
+}
+
+// Put adds or replaces the record for rec.ID.
+func (s *State) Put(rec DeviceRecord) {
+	for i, d := range s.Devices {
+		if d.ID == rec.ID {
+			s.Devices[i] = rec
+			return
+		}
+	}
+	s.Devices = append(s.Devices, rec)
+}
+
+// Remove drops the record for the device with the given ID.
+func (s *State) Remove(id string) {
+	for i, d := range s.Devices {
+		if d.ID == id {
+			s.Devices = append(s.Devices[:i], s.Devices[i+1:]...)
+			return
+		}
+	}
+}
+
+// ConfigFor returns cfg adjusted to manage the device described by rec,
+// which may live in a different location than cfg selects after a fallback.
+func ConfigFor(cfg Config, rec DeviceRecord) Config {
+	if rec.Provider == "" {
+		return cfg
+	}
+
+	cfg.Service.Provider = rec.Provider
+	if factory, ok := lookupProvider(rec.Provider); ok && factory.Locate != nil && rec.Location != "" {
+		cfg = factory.Locate(cfg, rec.Location)
+	}
+	return cfg
+}
+
+// ConfigHash returns a short fingerprint of cfg, used to tell which
+// configuration a device was provisioned from.
+func ConfigHash(cfg Config) string {
+	data, _ := json.Marshal(cfg)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// updateState loads the state file, applies fn and saves it. Failures are
+// logged rather than returned so that bookkeeping never breaks a run.
+func updateState(fn func(s *State)) {
+	state, err := LoadState()
+	if err != nil {
+		Log("Error loading state: %v", err)
+		return
+	}
+
+	fn(state)
+
+	if err := state.Save(); err != nil {
+		Log("Error saving state: %v", err)
+	}
+}
+
+// recordDevice stores device in the state file. When the device is already
+// known, the creation time, project and configuration hash of its record
+// are kept, as cfg may have been adjusted by ConfigFor since.
+func recordDevice(provider string, device Device, cfg Config) {
+	updateState(func(s *State) {
+		rec := DeviceRecord{
+			ID:         device.ID(),
+			Provider:   provider,
+			IP:         device.IP(),
+			CreatedAt:  time.Now().UTC(),
+			Project:    cfg.Project.Name,
+			ConfigHash: ConfigHash(cfg),
+		}
+		if sr, ok := device.(interface{ SpotRequestID() string }); ok {
+			rec.SpotRequestID = sr.SpotRequestID()
+		}
+		if l, ok := device.(interface{ Location() string }); ok {
+			rec.Location = l.Location()
+		}
+		if old, ok := s.Find(rec.ID); ok {
+			rec.CreatedAt = old.CreatedAt
+			rec.Project = old.Project
+			rec.ConfigHash = old.ConfigHash
+		}
+		s.Put(rec)
+	})
+}
+
+// forgetDevice removes the device with the given ID from the state file,
+// its pinned host key from spt's known_hosts and its private key.
+func forgetDevice(id string) {
+	updateState(func(s *State) {
+		s.Remove(id)
+	})
+
+	if err := unpinHostKey(id); err != nil {
+		Log("Error removing host key: %v", err)
+	}
+	if err := removeDeviceKey(id); err != nil {
+		Log("Error removing device key: %v", err)
+	}
+}
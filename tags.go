@@ -0,0 +1,92 @@
+package spt
+
+import (
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	tagProject   = "spt:project"
+	tagOwner     = "spt:owner"
+	tagCreatedAt = "spt:created-at"
+)
+
+// Tags identify a cloud resource as created by spt. Every provider attaches
+// them to the instances and spot requests it creates so that leaked
+// resources can be found again with `spt gc`.
+type Tags struct {
+	Project   string
+	Owner     string
+	CreatedAt time.Time
+}
+
+// newTags returns the tags for a resource created now from cfg.
+func newTags(cfg Config) Tags {
+	return Tags{
+		Project:   cfg.Project.Name,
+		Owner:     Owner(cfg),
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+// Owner returns the owner recorded on created resources: `project.owner`
+// when set, otherwise the local user name.
+func Owner(cfg Config) string {
+	if cfg.Project.Owner != "" {
+		return cfg.Project.Owner
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// Map returns the tags as key/value pairs.
+func (t Tags) Map() map[string]string {
+	return map[string]string{
+		tagProject:   t.Project,
+		tagOwner:     t.Owner,
+		tagCreatedAt: t.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+// List returns the tags as "key=value" strings, for providers that only
+// support flat tags.
+func (t Tags) List() []string {
+	var tags []string
+	for k, v := range t.Map() {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// parseTags reads tags back from key/value pairs. It reports false when the
+// resource was not created by spt.
+func parseTags(m map[string]string) (Tags, bool) {
+	project, ok := m[tagProject]
+	if !ok {
+		return Tags{}, false
+	}
+
+	createdAt, _ := time.Parse(time.RFC3339, m[tagCreatedAt])
+	return Tags{
+		Project:   project,
+		Owner:     m[tagOwner],
+		CreatedAt: createdAt,
+	}, true
+}
+
+// parseTagList is parseTags for "key=value" strings.
+func parseTagList(list []string) (Tags, bool) {
+	m := make(map[string]string)
+	for _, tag := range list {
+		if k, v, ok := strings.Cut(tag, "="); ok {
+			m[k] = v
+		}
+	}
+	return parseTags(m)
+}